@@ -16,6 +16,8 @@ type AggregateStats struct {
 	CreateCost   *Bigint
 	ModifyCost   *Bigint
 	AccessCost   *Bigint
+	Histograms   *Histograms
+	Extremes     *Extremes
 }
 
 // Add adds aggregate values where a set of group/user/tag is in the StatMappings
@@ -40,6 +42,8 @@ func (stats *AggregateStats) Add(addend *AggregateStats) (err error) {
 	stats.CreateCost.Add(stats.CreateCost, addend.CreateCost)
 	stats.ModifyCost.Add(stats.ModifyCost, addend.ModifyCost)
 	stats.AccessCost.Add(stats.AccessCost, addend.AccessCost)
+	stats.Histograms = sumHistograms(stats.Histograms, addend.Histograms)
+	stats.Extremes = mergeExtremes(stats.Extremes, addend.Extremes)
 	return
 }
 
@@ -51,7 +55,7 @@ func (stats *AggregateStats) String() (s string) {
 	s += fmt.Sprintf(" ccost: %v ", stats.CreateCost.Text(10))
 	r := stats.StatMappings.Values()
 	for j := range r {
-		s += fmt.Sprintf(" mappings: %v, %v, %v ", r[j].Group, r[j].User, r[j].Tag)
+		s += fmt.Sprintf(" mappings: %v, %v, %v, %v ", r[j].Group, r[j].User, r[j].Tag, r[j].Dimensions)
 	}
 
 	return
@@ -87,6 +91,8 @@ func combineAggregateStats(input []*AggregateStats) (combined []*AggregateStats,
 			a.CreateCost = input[i].CreateCost
 			a.Size = input[i].Size
 			a.Count = input[i].Count
+			a.Histograms = input[i].Histograms
+			a.Extremes = input[i].Extremes
 
 			got, OK := flattened[keys[k]] // does this combination already exist?
 			if !OK {
@@ -115,6 +121,9 @@ func combineAggregateStats(input []*AggregateStats) (combined []*AggregateStats,
 				b5.Add(a.Count, got.Count)
 				a.Count = b5
 
+				a.Histograms = sumHistograms(a.Histograms, got.Histograms)
+				a.Extremes = mergeExtremes(a.Extremes, got.Extremes)
+
 				flattened[keys[k]] = a
 			}
 
@@ -136,8 +145,9 @@ func combineAggregateStats(input []*AggregateStats) (combined []*AggregateStats,
 	return
 }
 
-// saveAggregateStats saves a set of stats to the databases.
-func (ts *TreeServe) saveAggregateStats(node *Md5Key, aggregateStats []*AggregateStats) (err error) {
+// saveAggregateStats saves a set of stats to the databases. Histograms and extremes are only
+// saved for directories, as those of a file are of that one file.
+func (ts *TreeServe) saveAggregateStats(node *Md5Key, aggregateStats []*AggregateStats, isDir bool) (err error) {
 	//log.Info("SAVING AGGREGATE STATS")
 
 	for i := range aggregateStats {
@@ -199,6 +209,22 @@ func (ts *TreeServe) saveAggregateStats(node *Md5Key, aggregateStats []*Aggregat
 			//err = ts.AggregateSizeDB.Add(localKey, aggregateStats.Size, true)
 
 			//err = ts.AggregateCountDB.Add(localKey, aggregateStats.Count, true)
+
+			if isDir && aggregateStats[i].Histograms != nil {
+				err = ts.AggregateHistogramsDB.Add(k1, aggregateStats[i].Histograms, true)
+				if err != nil {
+					LogError(err)
+					return
+				}
+			}
+
+			if isDir && aggregateStats[i].Extremes != nil {
+				err = ts.AggregateExtremesDB.Add(k1, aggregateStats[i].Extremes, true)
+				if err != nil {
+					LogError(err)
+					return
+				}
+			}
 		}
 
 	}
@@ -7,8 +7,8 @@ import (
 
 func TestCombineAggregateStats(t *testing.T) {
 	testdata := []*AggregateStats{}
-	categories1 := StatMapping{"u1", "g2", "t3"}
-	categories2 := StatMapping{"u1", "g2", "t4"}
+	categories1 := StatMapping{User: "u1", Group: "g2", Tag: "t3"}
+	categories2 := StatMapping{User: "u1", Group: "g2", Tag: "t4"}
 
 	cat1Key := categories1.GetKey()
 	cat2Key := categories2.GetKey()
@@ -32,9 +32,9 @@ func TestCombineAggregateStats(t *testing.T) {
 	b5 := NewBigint()
 	b5.SetInt64(5)
 
-	testdata = append(testdata, &AggregateStats{stat1, b1, b2, b3, b4, b5})
+	testdata = append(testdata, &AggregateStats{StatMappings: stat1, Size: b1, Count: b2, CreateCost: b3, ModifyCost: b4, AccessCost: b5})
 	//testdata = append(testdata, &AggregateStats{stat1, b1, b1, b1, b1, b1})
-	testdata = append(testdata, &AggregateStats{stat2, b1, b1, b1, b1, b1})
+	testdata = append(testdata, &AggregateStats{StatMappings: stat2, Size: b1, Count: b1, CreateCost: b1, ModifyCost: b1, AccessCost: b1})
 
 	a, b := combineAggregateStats(testdata)
 
@@ -0,0 +1,134 @@
+package treeserve
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// apiPrefix is where the versioned API is served. The original /tree and /raw routes are
+// aliases for the same handlers.
+const apiPrefix = "/api/v2"
+
+// Error codes in APIError bodies
+const (
+	errorBadRequest   = "bad_request"
+	errorNotFound     = "not_found"
+	errorInternal     = "internal_error"
+	errorNotReady     = "not_ready"
+	errorTooLarge     = "too_large"   // the response would be over MaxTreeNodes or MaxResponseBytes
+	errorOverLimits   = "over_limits" // the request asks for more than is allowed, eg. depth over MaxTreeDepth
+	errorUnauthorized = "unauthorized"
+	errorForbidden    = "forbidden"
+)
+
+// APIError is the JSON body of an error response. Path is the tree path the request was for.
+type APIError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Path    string `json:"path,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%d %s: %s (path %s)", e.Status, e.Code, e.Message, e.Path)
+}
+
+func badRequest(path string, format string, a ...interface{}) *APIError {
+	return &APIError{Status: http.StatusBadRequest, Code: errorBadRequest, Message: fmt.Sprintf(format, a...), Path: path}
+}
+
+func notFound(path string, format string, a ...interface{}) *APIError {
+	return &APIError{Status: http.StatusNotFound, Code: errorNotFound, Message: fmt.Sprintf(format, a...), Path: path}
+}
+
+// notReady is the error for requests while there is no tree ready to serve, saying why
+func notReady(format string, a ...interface{}) *APIError {
+	return &APIError{Status: http.StatusServiceUnavailable, Code: errorNotReady, Message: fmt.Sprintf(format, a...)}
+}
+
+// internalError hides the details of err from the client, they are logged instead
+func internalError(path string, err error) *APIError {
+	LogError(err)
+	return &APIError{Status: http.StatusInternalServerError, Code: errorInternal, Message: "internal error, see server log", Path: path}
+}
+
+// apiHandlerFunc handles an API request, returning an APIError instead of writing a response if it fails
+type apiHandlerFunc func(w http.ResponseWriter, r *http.Request) *APIError
+
+// apiHandler makes an http.HandlerFunc from h that holds the LMDB environment while it runs,
+// refuses requests until the tree is ready and writes any error as JSON. Responses are compressed
+// if the client accepts it.
+func (ts *TreeServe) apiHandler(h apiHandlerFunc) http.HandlerFunc {
+	return ts.holdLMDB(func(w http.ResponseWriter, r *http.Request) {
+		if apiErr := ts.checkReady(w); apiErr != nil {
+			if apiErr.Code == errorNotReady {
+				ts.metrics.rejected.add(labels("code", errorNotReady), 1)
+			}
+			writeAPIError(w, apiErr)
+			return
+		}
+		if cw := newCompressWriter(w, r); cw != nil {
+			defer cw.close()
+			w = cw
+		}
+		if apiErr := h(w, r); apiErr != nil {
+			ts.metrics.rejected.add(labels("code", apiErr.Code), 1)
+			writeAPIError(w, apiErr)
+		}
+	})
+}
+
+// checkReady gets an error if there is no tree ready to serve, setting Retry-After on w if there
+// will be one later. The environment must be held, and is not used while it is not open.
+func (ts *TreeServe) checkReady(w http.ResponseWriter) *APIError {
+	if !ts.lmdbOpen {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Minute/time.Second)))
+		return notReady("%s", errNoBuildOpen)
+	}
+	state, err := ts.GetState()
+	if err != nil {
+		return internalError("", err)
+	}
+	if state != "treeReady" {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Minute/time.Second)))
+		return notReady("tree is not ready, state is %s", state)
+	}
+	return nil
+}
+
+// writeAPIError writes apiErr as the JSON body of a response with its status
+func writeAPIError(w http.ResponseWriter, apiErr *APIError) {
+	j, err := json.Marshal(apiErr)
+	LogError(err)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(apiErr.Status)
+	w.Write(j)
+}
+
+// writeJSON writes j as the body of a successful response
+func writeJSON(w http.ResponseWriter, j []byte) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(j)
+}
+
+// apiNotFound handles requests for anything in the API that does not exist
+func apiNotFound(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, &APIError{Status: http.StatusNotFound, Code: errorNotFound, Message: "no such endpoint " + r.URL.Path})
+}
+
+// nodeKeyForPath gets the key of the node at path, or a not found error if it is not in the tree
+func (ts *TreeServe) nodeKeyForPath(path string) (nodeKey *Md5Key, apiErr *APIError) {
+	nodeKey = ts.getPathKey(path)
+	exists, err := ts.TreeNodeDB.Exists(nodeKey)
+	if err != nil {
+		return nil, internalError(path, err)
+	}
+	if !exists {
+		return nil, notFound(path, "path is not in the tree")
+	}
+	return
+}
@@ -0,0 +1,67 @@
+package treeserve
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestAPIErrors(t *testing.T) {
+	lmdbDir, err := ioutil.TempDir("", "api_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory for LMDB: %v", err)
+	}
+	defer os.RemoveAll(lmdbDir)
+
+	ts := buildTestTree(t, lmdbDir+"/lmdb", testTreeLines)
+	defer ts.CloseLMDB()
+	handler := ts.apiHandler(ts.tree)
+
+	get := func(query string) (status int, apiErr APIError) {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", apiPrefix+"/tree?"+query, nil))
+		if w.Code != http.StatusOK {
+			err := json.Unmarshal(w.Body.Bytes(), &apiErr)
+			if err != nil {
+				t.Errorf("failed to unmarshal error body %s: %v", w.Body.String(), err)
+			}
+		}
+		return w.Code, apiErr
+	}
+
+	status, apiErr := get("path=/lustre")
+	if status != http.StatusServiceUnavailable || apiErr.Code != errorNotReady {
+		t.Errorf("Expected %d %s before the tree is ready, got %d %s", http.StatusServiceUnavailable, errorNotReady, status, apiErr.Code)
+	}
+
+	err = ts.SetState("treeReady")
+	if err != nil {
+		t.Fatalf("failed to set state: %v", err)
+	}
+
+	tests := []struct {
+		query  string
+		status int
+		code   string
+	}{
+		{"path=/lustre&depth=1", http.StatusOK, ""},
+		{"path=/lustre/nowhere", http.StatusNotFound, errorNotFound},
+		{"path=/lustre&depth=deep", http.StatusBadRequest, errorBadRequest},
+		{"path=/lustre&depth=-1", http.StatusBadRequest, errorBadRequest},
+		{"path=lustre", http.StatusBadRequest, errorBadRequest},
+	}
+	for _, test := range tests {
+		status, apiErr = get(test.query)
+		if status != test.status || apiErr.Code != test.code {
+			t.Errorf("%s: expected %d %s, got %d %s", test.query, test.status, test.code, status, apiErr.Code)
+		}
+	}
+
+	_, apiErr = get("path=/lustre/nowhere")
+	if apiErr.Path != "/lustre/nowhere" {
+		t.Errorf("Expected error for path %s, got %s", "/lustre/nowhere", apiErr.Path)
+	}
+}
@@ -0,0 +1,350 @@
+package treeserve
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// principal is who a request is from and which uids and gids they may see data for
+type principal struct {
+	user   string
+	all    bool      // admins see every user and group
+	scopes []idScope // the longest prefix first
+}
+
+// idScope is the uids and gids a principal has in the trees under prefix, which depend on the
+// name source used for them
+type idScope struct {
+	prefix string
+	uids   map[string]bool
+	gids   map[string]bool
+}
+
+// idsAt gets the ids p has in the tree at path, from the scope with the longest prefix it is under
+func (p *principal) idsAt(path string) idScope {
+	for _, s := range p.scopes {
+		if underPrefix(path, s.prefix) {
+			return s
+		}
+	}
+	return idScope{}
+}
+
+// sees is true if p may see a set of aggregates of the tree at path. Rollups over every group are
+// only visible through the user and rollups over every user through the group.
+func (p *principal) sees(path string, a Aggregates) bool {
+	if p == nil || p.all {
+		return true
+	}
+	ids := p.idsAt(path)
+	return (a.Group != "*" && ids.gids[a.Group]) || (a.User != "*" && ids.uids[a.User])
+}
+
+// cacheKey distinguishes the responses made for p from those for principals who see something else
+func (p *principal) cacheKey() string {
+	if p == nil || p.all {
+		return ""
+	}
+	var scopes []string
+	for _, s := range p.scopes {
+		var ids []string
+		for uid := range s.uids {
+			ids = append(ids, "u"+uid)
+		}
+		for gid := range s.gids {
+			ids = append(ids, "g"+gid)
+		}
+		sort.Strings(ids)
+		scopes = append(scopes, s.prefix+"="+strings.Join(ids, ","))
+	}
+	return "@" + strings.Join(scopes, ";")
+}
+
+type principalContextKey struct{}
+
+// principalFor gets who r was authenticated as, nil if authentication is off
+func principalFor(r *http.Request) *principal {
+	p, _ := r.Context().Value(principalContextKey{}).(*principal)
+	return p
+}
+
+// authenticator checks who requests are from and works out what they may see from the user and
+// group names
+type authenticator struct {
+	passwords       map[string][]byte   // htpasswd hashes by user
+	tokens          map[[32]byte]string // users by the SHA-256 of their bearer token
+	proxyHeader     string
+	trustedProxies  []*net.IPNet
+	trustUnixSocket bool
+	admins          map[string]bool
+	names           *nameResolver
+}
+
+// newAuthenticator loads the credentials for authentication. It returns nil if no way of
+// authenticating is configured, in which case everyone sees everything.
+func (ts *TreeServe) newAuthenticator() (auth *authenticator, err error) {
+	if ts.HtpasswdFile == "" && ts.TokenFile == "" && ts.TrustedProxyHeader == "" {
+		return
+	}
+	auth = &authenticator{proxyHeader: ts.TrustedProxyHeader, trustUnixSocket: ts.ListenSocket != "" && ts.TrustListenSocket, admins: make(map[string]bool), names: ts.names}
+	for _, admin := range ts.AuthAdmins {
+		auth.admins[admin] = true
+	}
+	for _, cidr := range ts.TrustedProxies {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		auth.trustedProxies = append(auth.trustedProxies, network)
+	}
+	if ts.HtpasswdFile != "" {
+		auth.passwords, err = readHtpasswd(ts.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ts.TokenFile != "" {
+		auth.tokens, err = readTokens(ts.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// readLines calls f with the fields of each line of a file that is not blank or a comment
+func readLines(path string, sep string, f func(fields []string)) (err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err, "path": path}).Error("failed to open file")
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if sep == "" {
+			f(strings.Fields(line))
+		} else {
+			f(strings.Split(line, sep))
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err, "path": path}).Error("failed to read file")
+	}
+	return
+}
+
+// readHtpasswd reads an htpasswd file. Only bcrypt (htpasswd -B) and {SHA} hashes are supported.
+func readHtpasswd(path string) (passwords map[string][]byte, err error) {
+	passwords = make(map[string][]byte)
+	err = readLines(path, "", func(fields []string) {
+		userHash := strings.SplitN(fields[0], ":", 2)
+		if len(userHash) != 2 {
+			return
+		}
+		user, hash := userHash[0], userHash[1]
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			log.WithFields(log.Fields{"user": user, "path": path}).Warn("unsupported htpasswd hash, use htpasswd -B")
+			return
+		}
+		passwords[user] = []byte(hash)
+	})
+	return
+}
+
+// readTokens reads a file of "<user> <token>" lines
+func readTokens(path string) (tokens map[[32]byte]string, err error) {
+	tokens = make(map[[32]byte]string)
+	err = readLines(path, "", func(fields []string) {
+		if len(fields) != 2 {
+			log.WithFields(log.Fields{"path": path}).Warn("ignoring token file line that is not <user> <token>")
+			return
+		}
+		tokens[sha256.Sum256([]byte(fields[1]))] = fields[0]
+	})
+	return
+}
+
+// checkPassword checks password against the htpasswd hash for user
+func (auth *authenticator) checkPassword(user string, password string) bool {
+	hash, ok := auth.passwords[user]
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(string(hash), "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare(hash, []byte(expected)) == 1
+	}
+	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+}
+
+// fromTrustedProxy is true if r came through a connection the proxy header is accepted from
+func (auth *authenticator) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// connections on a unix socket have no address, and anyone who can connect to it could
+		// have sent the header unless its permissions only let the proxy in
+		return auth.trustUnixSocket
+	}
+	ip := net.ParseIP(host)
+	for _, network := range auth.trustedProxies {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate gets the user a request is from, "" if it has no valid credentials
+func (auth *authenticator) authenticate(r *http.Request) (user string) {
+	if auth.proxyHeader != "" && r.Header.Get(auth.proxyHeader) != "" {
+		if auth.fromTrustedProxy(r) {
+			return r.Header.Get(auth.proxyHeader)
+		}
+		log.WithFields(log.Fields{"remoteAddr": r.RemoteAddr, "header": auth.proxyHeader}).Warn("ignoring user header from untrusted address")
+	}
+	header := r.Header.Get("Authorization")
+	if auth.tokens != nil && strings.HasPrefix(header, "Bearer ") {
+		return auth.tokens[sha256.Sum256([]byte(strings.TrimPrefix(header, "Bearer ")))]
+	}
+	if auth.passwords != nil {
+		if name, password, ok := r.BasicAuth(); ok && auth.checkPassword(name, password) {
+			return name
+		}
+	}
+	return ""
+}
+
+// principal works out what user may see, from their uid and groups in the name source used for
+// each prefix
+func (auth *authenticator) principal(user string) *principal {
+	p := &principal{user: user, all: auth.admins[user]}
+	for _, prefix := range auth.names.prefixes() {
+		s := idScope{prefix: prefix, uids: make(map[string]bool), gids: make(map[string]bool)}
+		uids, gids := auth.names.memberships(prefix, user)
+		for _, uid := range uids {
+			s.uids[uid] = true
+		}
+		for _, gid := range gids {
+			s.gids[gid] = true
+		}
+		p.scopes = append(p.scopes, s)
+	}
+	return p
+}
+
+// challenge sets the WWW-Authenticate headers for the ways a client can authenticate
+func (auth *authenticator) challenge(w http.ResponseWriter) {
+	if auth.passwords != nil {
+		w.Header().Add("WWW-Authenticate", `Basic realm="treeserve", charset="UTF-8"`)
+	}
+	if auth.tokens != nil {
+		w.Header().Add("WWW-Authenticate", `Bearer realm="treeserve"`)
+	}
+}
+
+// authenticated makes h only handle requests from authenticated users, or only from admins if
+// adminOnly is set, with the principal in the request context. It does nothing if authentication
+// is off.
+func (ts *TreeServe) authenticated(h http.HandlerFunc, adminOnly bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := ts.auth
+		if auth == nil {
+			h(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "private")
+		user := auth.authenticate(r)
+		if user == "" {
+			auth.challenge(w)
+			ts.metrics.rejected.add(labels("code", errorUnauthorized), 1)
+			writeAPIError(w, &APIError{Status: http.StatusUnauthorized, Code: errorUnauthorized, Message: "authentication required"})
+			return
+		}
+		p := auth.principal(user)
+		if adminOnly && !p.all {
+			ts.metrics.rejected.add(labels("code", errorForbidden), 1)
+			writeAPIError(w, &APIError{Status: http.StatusForbidden, Code: errorForbidden, Message: fmt.Sprintf("%s is not an admin", user)})
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), principalContextKey{}, p)))
+	}
+}
+
+// cors sets the Access-Control headers on every response and answers preflight requests, so that
+// browsers on CORSOrigin can use the API
+func (ts *TreeServe) cors(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ts.CORSOrigin == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", ts.CORSOrigin)
+		if ts.auth != nil && ts.CORSOrigin != "*" {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Accept, If-None-Match")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// visibleNodeKey gets the key of the node at path like nodeKeyForPath, but also reports paths
+// where the principal of r cannot see any data as not in the tree
+func (ts *TreeServe) visibleNodeKey(r *http.Request, path string) (nodeKey *Md5Key, apiErr *APIError) {
+	nodeKey, apiErr = ts.nodeKeyForPath(path)
+	if apiErr != nil {
+		return
+	}
+	visible, err := ts.visible(principalFor(r), path, nodeKey)
+	if err != nil {
+		return nil, internalError(path, err)
+	}
+	if !visible {
+		return nil, notFound(path, "path is not in the tree")
+	}
+	return
+}
+
+// visible is true if p can see any of the aggregates of the node at path, whose key is nodeKey
+func (ts *TreeServe) visible(p *principal, path string, nodeKey *Md5Key) (visible bool, err error) {
+	if p == nil || p.all {
+		return true, nil
+	}
+	stats, err := ts.retrieveAggregates(nodeKey)
+	if err != nil {
+		return
+	}
+	for _, a := range stats {
+		if p.sees(path, a) {
+			return true, nil
+		}
+	}
+	return
+}
@@ -0,0 +1,211 @@
+package treeserve
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuth(t *testing.T) {
+	ts, cleanup := newReadyTestTree(t)
+	defer cleanup()
+	dir := filepath.Dir(ts.LMDBPath)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("alicepw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	files := map[string]string{
+		"htpasswd": "alice:" + string(hash) + "\n" +
+			"bob:{SHA}" + "KXV5lfOmXj1HOy0eE1tRGdIyUHw=" + "\n" + // bobpw
+			"admin:" + string(hash) + "\n",
+		"tokens": "# user token\ncarol s3cret\n",
+		"passwd": "alice:x:1:10::/home/alice:/bin/bash\nbob:x:2:20::/home/bob:/bin/bash\ncarol:x:3:30::/home/carol:/bin/bash\n",
+		"group":  "hgi:x:10:\nother:x:20:carol\nthird:x:30:\n",
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(dir+"/"+name, []byte(content), 0600)
+		if err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+	ts.HtpasswdFile = dir + "/htpasswd"
+	ts.TokenFile = dir + "/tokens"
+	ts.TrustedProxyHeader = "X-Remote-User"
+	ts.TrustedProxies = []string{"127.0.0.0/8"}
+	ts.AuthAdmins = []string{"admin"}
+	ts.names.configure([]NameSource{{UserFile: dir + "/passwd", GroupFile: dir + "/group"}}, false)
+	ts.auth, err = ts.newAuthenticator()
+	if err != nil {
+		t.Fatalf("failed to load authentication: %v", err)
+	}
+
+	tree := ts.authenticated(ts.apiHandler(ts.cached(ts.tree)), false)
+	raw := ts.authenticated(ts.apiHandler(ts.cached(ts.raw)), false)
+	get := func(h http.HandlerFunc, query string, setAuth func(r *http.Request)) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", apiPrefix+"/tree?"+query, nil)
+		if setAuth != nil {
+			setAuth(r)
+		}
+		h(w, r)
+		return w
+	}
+	basic := func(user, password string) func(r *http.Request) {
+		return func(r *http.Request) { r.SetBasicAuth(user, password) }
+	}
+	childPaths := func(w *httptest.ResponseRecorder) (paths []string) {
+		var ft fullTree
+		err := json.Unmarshal(w.Body.Bytes(), &ft)
+		if err != nil {
+			t.Fatalf("failed to unmarshal tree %s: %v", w.Body.String(), err)
+		}
+		for _, child := range ft.Tree.ChildDirs {
+			if child.Name != "*.*" {
+				paths = append(paths, child.Path)
+			}
+		}
+		return
+	}
+	const scratch = "path=/lustre/scratch&depth=1"
+
+	w := get(tree, scratch, nil)
+	if w.Code != http.StatusUnauthorized || len(w.Header()["Www-Authenticate"]) != 2 {
+		t.Errorf("Expected 401 with two challenges without credentials, got %d %v", w.Code, w.Header())
+	}
+	if w := get(tree, scratch, basic("alice", "wrong")); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for a wrong password, got %d", w.Code)
+	}
+
+	// alice is in hgi, which owns a
+	w = get(tree, scratch, basic("alice", "alicepw"))
+	if paths := childPaths(w); len(paths) != 1 || paths[0] != "/lustre/scratch/a" {
+		t.Errorf("Expected alice to only see /lustre/scratch/a, got %v", paths)
+	}
+	var ft fullTree
+	json.Unmarshal(w.Body.Bytes(), &ft)
+	for g, users := range ft.Tree.Data.Count {
+		for u := range users {
+			if (g != "hgi" && u != "alice") || (g == "*" && u == "*") {
+				t.Errorf("Expected alice not to see group %s user %s", g, u)
+			}
+		}
+	}
+	if w := get(tree, "path=/lustre/scratch/b", basic("alice", "alicepw")); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a path alice cannot see, got %d", w.Code)
+	}
+
+	// bob owns b, carol is a member of its group
+	if paths := childPaths(get(tree, scratch, basic("bob", "bobpw"))); len(paths) != 1 || paths[0] != "/lustre/scratch/b" {
+		t.Errorf("Expected bob to only see /lustre/scratch/b, got %v", paths)
+	}
+	carol := func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") }
+	if paths := childPaths(get(tree, scratch, carol)); len(paths) != 1 || paths[0] != "/lustre/scratch/b" {
+		t.Errorf("Expected carol to only see /lustre/scratch/b, got %v", paths)
+	}
+
+	// the admin must not be given alice's cached response
+	if paths := childPaths(get(tree, scratch, basic("admin", "alicepw"))); len(paths) != 2 {
+		t.Errorf("Expected admin to see both directories, got %v", paths)
+	}
+
+	// the proxy header is only accepted from trusted addresses
+	proxied := func(remoteAddr string) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.RemoteAddr = remoteAddr
+			r.Header.Set("X-Remote-User", "bob")
+		}
+	}
+	if w := get(tree, scratch, proxied("192.0.2.1:1234")); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for the proxy header from an untrusted address, got %d", w.Code)
+	}
+	if paths := childPaths(get(tree, scratch, proxied("127.0.0.1:1234"))); len(paths) != 1 || paths[0] != "/lustre/scratch/b" {
+		t.Errorf("Expected the proxied bob to only see /lustre/scratch/b, got %v", paths)
+	}
+	// by default no address is trusted, as any local user could connect
+	ts.TrustedProxies = NewTreeServe("", 0, 0, 0, 0, 0, 0, false).TrustedProxies
+	ts.auth, err = ts.newAuthenticator()
+	if err != nil {
+		t.Fatalf("failed to load authentication: %v", err)
+	}
+	if w := get(tree, scratch, proxied("127.0.0.1:1234")); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for the proxy header from localhost by default, got %d", w.Code)
+	}
+	// nor is the unix socket, connections on which have no address, unless it is made trusted
+	ts.ListenSocket = dir + "/treeserve.sock"
+	ts.auth, err = ts.newAuthenticator()
+	if err != nil {
+		t.Fatalf("failed to load authentication: %v", err)
+	}
+	if w := get(tree, scratch, proxied("@")); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 for the proxy header on the unix socket by default, got %d", w.Code)
+	}
+	ts.TrustListenSocket = true
+	ts.auth, err = ts.newAuthenticator()
+	if err != nil {
+		t.Fatalf("failed to load authentication: %v", err)
+	}
+	if paths := childPaths(get(tree, scratch, proxied("@"))); len(paths) != 1 || paths[0] != "/lustre/scratch/b" {
+		t.Errorf("Expected bob proxied on a trusted unix socket to only see /lustre/scratch/b, got %v", paths)
+	}
+	ts.ListenSocket = ""
+	ts.TrustedProxies = []string{"127.0.0.0/8"}
+	ts.auth, err = ts.newAuthenticator()
+	if err != nil {
+		t.Fatalf("failed to load authentication: %v", err)
+	}
+
+	w = get(raw, "path=/lustre/scratch", basic("alice", "alicepw"))
+	var entries DatabaseEntries
+	err = json.Unmarshal(w.Body.Bytes(), &entries)
+	if err != nil {
+		t.Fatalf("failed to unmarshal raw %s: %v", w.Body.String(), err)
+	}
+	if len(entries.Children) != 1 || !strings.HasSuffix(entries.Children[0], "/a") {
+		t.Errorf("Expected alice's raw children to only be a, got %v", entries.Children)
+	}
+	for _, mapping := range entries.StatMappings {
+		if strings.HasPrefix(mapping, "Group: 20 ") || strings.HasPrefix(mapping, "Group: *  User: *") {
+			t.Errorf("Expected alice not to see mapping %s", mapping)
+		}
+	}
+
+	w = get(raw, "path=/lustre/scratch/a", basic("alice", "alicepw"))
+	entries = DatabaseEntries{}
+	err = json.Unmarshal(w.Body.Bytes(), &entries)
+	if err != nil {
+		t.Fatalf("failed to unmarshal raw %s: %v", w.Body.String(), err)
+	}
+	if len(entries.Children) != 2 {
+		t.Errorf("Expected alice to see both files in a, got %v", entries.Children)
+	}
+
+	metrics := ts.authenticated(ts.metricsHandler, true)
+	if w := get(metrics, "", basic("alice", "alicepw")); w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for /metrics for a user who is not an admin, got %d", w.Code)
+	}
+	if w := get(metrics, "", basic("admin", "alicepw")); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 for /metrics for an admin, got %d", w.Code)
+	}
+
+	// cross-origin access is off by default, and preflight requests are answered without credentials
+	w = httptest.NewRecorder()
+	ts.cors(tree).ServeHTTP(w, httptest.NewRequest("GET", apiPrefix+"/tree?"+scratch, nil))
+	if origin := w.Header().Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("Expected no Access-Control-Allow-Origin by default, got %s", origin)
+	}
+	ts.CORSOrigin = "https://ui.example.org"
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("OPTIONS", apiPrefix+"/tree", nil)
+	r.Header.Set("Access-Control-Request-Method", "GET")
+	ts.cors(tree).ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != ts.CORSOrigin || w.Header().Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("Unexpected preflight response %d %v", w.Code, w.Header())
+	}
+}
@@ -51,6 +51,18 @@ func (bi *Bigint) Text(base int) (s string) {
 	s = bi.i.Text(base)
 	return
 }
+
+// Float64 returns the nearest float64 to a Bigint
+func (bi *Bigint) Float64() (f float64) {
+	f, _ = new(big.Float).SetInt(bi.i).Float64()
+	return
+}
+
+// Uint64 returns a Bigint as a uint64, which it must fit in
+func (bi *Bigint) Uint64() uint64 {
+	return bi.i.Uint64()
+}
+
 func Divide(x, y *Bigint) (f string) {
 	f1 := new(big.Float).SetInt(x.i)
 	f2 := new(big.Float).SetInt(y.i)
@@ -0,0 +1,254 @@
+package treeserve
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Default size of the response cache
+const (
+	defaultResponseCacheEntries = 100
+	defaultResponseCacheBytes   = 64 * 1024 * 1024
+)
+
+// cachedHeaders are the response headers kept with a cached body
+var cachedHeaders = []string{"Content-Type", "Content-Disposition"}
+
+// cachedResponse is the uncompressed body and headers of a successful response
+type cachedResponse struct {
+	key    string
+	header http.Header
+	body   []byte
+}
+
+// responseCache holds the most recently used responses for the tree being served. The tree does
+// not change once it is ready, so entries only need to be dropped when a new build is opened.
+type responseCache struct {
+	mu      sync.Mutex
+	entries *list.List // most recently used first
+	byKey   map[string]*list.Element
+	bytes   int64
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{entries: list.New(), byKey: make(map[string]*list.Element)}
+}
+
+// get returns the response cached for key, or nil
+func (c *responseCache) get(key string) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.byKey[key]
+	if !ok {
+		return nil
+	}
+	c.entries.MoveToFront(e)
+	return e.Value.(*cachedResponse)
+}
+
+// add caches cr, dropping the least recently used responses to keep within maxEntries and maxBytes
+func (c *responseCache) add(cr *cachedResponse, maxEntries int, maxBytes int64) {
+	size := int64(len(cr.body))
+	if maxEntries <= 0 || size > maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.byKey[cr.key]; ok {
+		c.remove(e)
+	}
+	c.byKey[cr.key] = c.entries.PushFront(cr)
+	c.bytes += size
+	for c.entries.Len() > maxEntries || c.bytes > maxBytes {
+		c.remove(c.entries.Back())
+	}
+}
+
+func (c *responseCache) remove(e *list.Element) {
+	cr := c.entries.Remove(e).(*cachedResponse)
+	delete(c.byKey, cr.key)
+	c.bytes -= int64(len(cr.body))
+}
+
+// size is how many responses and bytes are cached
+func (c *responseCache) size() (entries int, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries.Len(), c.bytes
+}
+
+// purge drops every cached response
+func (c *responseCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries.Init()
+	c.byKey = make(map[string]*list.Element)
+	c.bytes = 0
+}
+
+// loadBuildID gets the id saved when the tree was published. Trees published before ids were
+// saved get one from the environment file instead.
+func (ts *TreeServe) loadBuildID() {
+	buildID, err := ts.GetMetadata("buildID")
+	LogError(err)
+	if buildID == "" {
+		buildID = fmt.Sprintf("%x-%x", ts.lmdbFileInfo.ModTime().UnixNano(), ts.lmdbFileInfo.Size())
+	}
+	ts.buildID = buildID
+}
+
+// newBuildID makes a random id for a new build
+func newBuildID() (buildID string, err error) {
+	b := make([]byte, 8)
+	_, err = rand.Read(b)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to make build id")
+		return
+	}
+	buildID = hex.EncodeToString(b)
+	return
+}
+
+// normalisedQuery is the endpoint and parameters of r in a fixed order, so that requests for the
+// same thing have the same key however they were written. The format from the Accept header is
+// included as it changes the response.
+func normalisedQuery(r *http.Request) string {
+	vals := r.URL.Query()
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	b.WriteString(strings.TrimPrefix(r.URL.Path, apiPrefix))
+	for _, k := range keys {
+		values := append([]string(nil), vals[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			b.WriteString("&" + k + "=" + v)
+		}
+	}
+	if format, apiErr := formatParameter(r, ""); apiErr == nil {
+		b.WriteString("#" + format)
+	}
+	return b.String()
+}
+
+// etag is a strong ETag for query against the tree being served. Each content encoding is a
+// different representation so gets a different tag.
+func (ts *TreeServe) etag(query string, encoding string) string {
+	sum := sha1.Sum([]byte(query))
+	tag := ts.buildID + "-" + hex.EncodeToString(sum[:8])
+	if encoding != "" {
+		tag += "-" + encoding
+	}
+	return `"` + tag + `"`
+}
+
+// etagMatches checks whether etag is one of those in an If-None-Match header. * is not taken as
+// a match, as it is checked before the handler has found whether there is anything at the path.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// cached makes h answer conditional requests with 304 Not Modified and serve repeated requests
+// from the response cache. Successful responses that fit in the cache are added to it.
+func (ts *TreeServe) cached(h apiHandlerFunc) apiHandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) *APIError {
+		// responses have names in, so change with them
+		query := normalisedQuery(r) + principalFor(r).cacheKey() + fmt.Sprintf("#names%d", ts.names.getGeneration())
+		encoding := ""
+		if cw, ok := w.(*compressWriter); ok {
+			encoding = cw.encoding
+		}
+		etag := ts.etag(query, encoding)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			ts.metrics.cache.add(labels("result", "not_modified"), 1)
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+
+		key := ts.buildID + "\x00" + query
+		if cr := ts.responseCache.get(key); cr != nil {
+			ts.metrics.cache.add(labels("result", "hit"), 1)
+			for k, v := range cr.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("ETag", etag)
+			w.WriteHeader(http.StatusOK)
+			w.Write(cr.body)
+			return nil
+		}
+
+		ts.metrics.cache.add(labels("result", "miss"), 1)
+		rec := &cacheRecorder{ResponseWriter: w, etag: etag, maxBytes: ts.ResponseCacheBytes}
+		apiErr := h(rec, r)
+		if apiErr == nil && rec.status == http.StatusOK && !rec.tooLarge {
+			cr := &cachedResponse{key: key, header: make(http.Header), body: rec.body.Bytes()}
+			for _, k := range cachedHeaders {
+				if v, ok := w.Header()[k]; ok {
+					cr.header[k] = v
+				}
+			}
+			ts.responseCache.add(cr, ts.ResponseCacheEntries, ts.ResponseCacheBytes)
+		}
+		return apiErr
+	}
+}
+
+// cacheRecorder keeps a copy of a response as it is written, unless it gets bigger than maxBytes
+type cacheRecorder struct {
+	http.ResponseWriter
+	etag     string
+	status   int
+	body     bytes.Buffer
+	maxBytes int64
+	tooLarge bool
+}
+
+func (rec *cacheRecorder) WriteHeader(status int) {
+	rec.status = status
+	if status == http.StatusOK {
+		rec.Header().Set("ETag", rec.etag)
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *cacheRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.tooLarge {
+		if int64(rec.body.Len()+len(p)) > rec.maxBytes {
+			rec.tooLarge = true
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(p)
+		}
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+func (rec *cacheRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
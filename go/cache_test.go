@@ -0,0 +1,137 @@
+package treeserve
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	for header, expected := range map[string]string{
+		"":                       "",
+		"identity":               "",
+		"gzip":                   "gzip",
+		"deflate, gzip":          "gzip",
+		"deflate":                "deflate",
+		"gzip;q=0.5, deflate":    "deflate",
+		"gzip;q=0, br":           "",
+		"br, GZIP;q=0.8":         "gzip",
+		"deflate;q=0.4,gzip;q=x": "deflate",
+	} {
+		if encoding := acceptedEncoding(header); encoding != expected {
+			t.Errorf("Accept-Encoding %q: expected %q, got %q", header, expected, encoding)
+		}
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	ts, cleanup := newReadyTestTree(t)
+	defer cleanup()
+
+	ts.names.sources = []*nameSource{{groups: &nameFile{names: newIDNames(map[string]string{"10": "hgi", "20": "other"})}}}
+
+	handler := ts.apiHandler(ts.cached(ts.tree))
+	get := func(query string, header map[string]string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", apiPrefix+"/tree?"+query, nil)
+		for k, v := range header {
+			r.Header.Set(k, v)
+		}
+		handler(w, r)
+		return w
+	}
+
+	first := get("path=/lustre&depth=2&group=hgi,other", nil)
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("Expected 200 with an ETag, got %d %q", first.Code, etag)
+	}
+	if ts.responseCache.entries.Len() != 1 {
+		t.Errorf("Expected 1 cached response, got %d", ts.responseCache.entries.Len())
+	}
+
+	// the same query written differently is served from the cache
+	second := get("depth=2&group=other,hgi&path=/lustre", nil)
+	if second.Header().Get("ETag") == etag {
+		t.Errorf("Expected a different ETag for a differently split group list")
+	}
+	third := get("group=hgi,other&depth=2&path=/lustre", nil)
+	if third.Header().Get("ETag") != etag || !bytes.Equal(third.Body.Bytes(), first.Body.Bytes()) {
+		t.Errorf("Expected the cached response for reordered parameters")
+	}
+	if third.Header().Get("Content-Type") != first.Header().Get("Content-Type") {
+		t.Errorf("Expected cached Content-Type %q, got %q", first.Header().Get("Content-Type"), third.Header().Get("Content-Type"))
+	}
+	if ts.responseCache.entries.Len() != 2 {
+		t.Errorf("Expected 2 cached responses, got %d", ts.responseCache.entries.Len())
+	}
+
+	if w := get("path=/lustre&depth=2&group=hgi,other", map[string]string{"If-None-Match": etag}); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("Expected 304 with no body, got %d", w.Code)
+	}
+	if w := get("path=/lustre&depth=1", map[string]string{"If-None-Match": etag}); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a different query, got %d", w.Code)
+	}
+	if w := get("path=/lustre/nowhere&depth=1", map[string]string{"If-None-Match": "*"}); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a path not in the tree with If-None-Match: *, got %d", w.Code)
+	}
+
+	// compressed responses have their own ETags and decompress to the same body
+	gz := get("path=/lustre&depth=2&group=hgi,other", map[string]string{"Accept-Encoding": "gzip"})
+	if gz.Header().Get("Content-Encoding") != "gzip" || gz.Header().Get("ETag") == etag {
+		t.Errorf("Expected gzip with its own ETag, got %q %q", gz.Header().Get("Content-Encoding"), gz.Header().Get("ETag"))
+	}
+	gr, err := gzip.NewReader(gz.Body)
+	if err != nil {
+		t.Fatalf("failed to read gzip response: %v", err)
+	}
+	body, err := ioutil.ReadAll(gr)
+	if err != nil || !bytes.Equal(body, first.Body.Bytes()) {
+		t.Errorf("gzip response differs from uncompressed: %v", err)
+	}
+	df := get("path=/lustre&depth=2&group=hgi,other", map[string]string{"Accept-Encoding": "deflate"})
+	zr, err := zlib.NewReader(df.Body)
+	if err != nil {
+		t.Fatalf("failed to read deflate response: %v", err)
+	}
+	body, err = ioutil.ReadAll(zr)
+	if err != nil || !bytes.Equal(body, first.Body.Bytes()) {
+		t.Errorf("deflate response differs from uncompressed: %v", err)
+	}
+
+	// errors are not cached
+	if w := get("path=/nowhere", nil); w.Code != http.StatusNotFound || w.Header().Get("ETag") != "" {
+		t.Errorf("Expected 404 without an ETag, got %d %q", w.Code, w.Header().Get("ETag"))
+	}
+
+	// the least recently used responses are dropped
+	namesKey := fmt.Sprintf("#names%d", ts.names.getGeneration())
+	ts.ResponseCacheEntries = 2
+	get("path=/lustre&depth=0", nil)
+	if ts.responseCache.entries.Len() != 2 || ts.responseCache.get(ts.buildID+"\x00/tree&depth=2&group=other,hgi&path=/lustre#nested"+namesKey) != nil {
+		t.Errorf("Expected the least recently used responses to be dropped, have %d", ts.responseCache.entries.Len())
+	}
+	if ts.responseCache.get(ts.buildID+"\x00/tree&depth=2&group=hgi,other&path=/lustre#nested"+namesKey) == nil {
+		t.Errorf("Expected the recently used response to be kept")
+	}
+
+	// a new build gets new ETags and an empty cache
+	ts.CloseLMDB()
+	err = ts.OpenLMDB()
+	if err != nil {
+		t.Fatalf("failed to reopen LMDB: %v", err)
+	}
+	if ts.responseCache.entries.Len() != 0 {
+		t.Errorf("Expected the cache to be emptied on reopening")
+	}
+	ts.SetMetadata("buildID", "next")
+	ts.loadBuildID()
+	if w := get("path=/lustre&depth=2&group=hgi,other", map[string]string{"If-None-Match": etag}); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 after the build changed, got %d", w.Code)
+	}
+}
@@ -0,0 +1,248 @@
+package treeserve
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// bytesInTiB is the number of bytes in a tebibyte
+const bytesInTiB = 1 << 40
+
+// chargebackPeriods are the periods charges can be worked out for, in years
+var chargebackPeriods = map[string]float64{"month": 1.0 / 12, "quarter": 1.0 / 4, "year": 1}
+
+// Ways the chargeback report can be broken down
+const (
+	chargebackByProject    = "project"
+	chargebackByCostCentre = "cost_centre"
+)
+
+// chargebackColumns are the columns of the CSV chargeback report, in order
+var chargebackColumns = []string{"project", "pi", "cost_centre", "count", "size", "tib", "rate", "charge"}
+
+// ChargebackRates are the prices per TiB year of storage used for the chargeback report
+type ChargebackRates struct {
+	Default float64            // for projects without a rate of their own
+	ByName  map[string]float64 // by project, or by cost centre for the projects of it without one
+}
+
+// ParseChargebackRates parses a comma separated list of <project or cost centre>=<rate> and an
+// optional <rate> for the rest, which is otherwise the per TiB year cost of the cost model
+func ParseChargebackRates(s string) (rates ChargebackRates, err error) {
+	rates = ChargebackRates{Default: costPerTibYear, ByName: make(map[string]float64)}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		nameRate := strings.SplitN(entry, "=", 2)
+		rate, parseErr := strconv.ParseFloat(nameRate[len(nameRate)-1], 64)
+		if parseErr != nil || rate < 0 {
+			return rates, fmt.Errorf("chargeback rate %s is not [<project or cost centre>=]<rate per TiB year>", entry)
+		}
+		if len(nameRate) == 1 {
+			rates.Default = rate
+		} else {
+			rates.ByName[nameRate[0]] = rate
+		}
+	}
+	return
+}
+
+// rate gets the rate for a project with cost centre costCentre
+func (rates ChargebackRates) rate(project, costCentre string) float64 {
+	if rate, ok := rates.ByName[project]; ok {
+		return rate
+	}
+	if rate, ok := rates.ByName[costCentre]; ok && costCentre != "" {
+		return rate
+	}
+	return rates.Default
+}
+
+// chargebackRow is the usage and charge of a project, or of a cost centre with the rate and
+// project fields left empty
+type chargebackRow struct {
+	Project    string  `json:"project,omitempty"`
+	PI         string  `json:"pi,omitempty"`
+	CostCentre string  `json:"cost_centre"`
+	Count      uint64  `json:"count"`
+	Size       uint64  `json:"size"`
+	TiB        float64 `json:"tib"`
+	Rate       float64 `json:"rate,omitempty"`
+	Charge     float64 `json:"charge"`
+}
+
+func (row *chargebackRow) values() []string {
+	rate := ""
+	if row.Rate != 0 {
+		rate = strconv.FormatFloat(row.Rate, 'f', -1, 64)
+	}
+	return []string{row.Project, row.PI, row.CostCentre, strconv.FormatUint(row.Count, 10), strconv.FormatUint(row.Size, 10),
+		strconv.FormatFloat(row.TiB, 'f', 6, 64), rate, strconv.FormatFloat(row.Charge, 'f', 2, 64)}
+}
+
+// chargebackResponse is the body of a /api/v2/chargeback response
+type chargebackResponse struct {
+	Date        string           `json:"date"` // when the input the tree was built from was made
+	Path        string           `json:"path"`
+	Period      string           `json:"period"`
+	By          string           `json:"by"`
+	Rows        []*chargebackRow `json:"rows"`
+	TotalCharge float64          `json:"total_charge"`
+}
+
+// chargebackRows works out the charges for the usage by project in stats, the aggregates of a
+// directory, over a period of years
+func (ts *TreeServe) chargebackRows(stats []Aggregates, projects map[string]Project, years float64, by string) (rows []*chargebackRow, total float64) {
+	byCostCentre := make(map[string]*chargebackRow)
+	for _, a := range stats {
+		if a.Group != "*" || a.User != "*" || a.Tag != "*" || !strings.HasPrefix(a.Dimensions, dimensionProject+"=") ||
+			strings.Contains(a.Dimensions, dimensionSeparator) || a.Count.isZero() {
+			continue
+		}
+		name := strings.TrimPrefix(a.Dimensions, dimensionProject+"=")
+		p := projects[name]
+		row := &chargebackRow{Project: name, PI: p.PI, CostCentre: p.CostCentre, Count: a.Count.Uint64(), Size: a.Size.Uint64(),
+			Rate: ts.ChargebackRates.rate(name, p.CostCentre)}
+		row.TiB = float64(row.Size) / bytesInTiB
+		row.Charge = row.TiB * row.Rate * years
+		total += row.Charge
+		if by == chargebackByProject {
+			rows = append(rows, row)
+			continue
+		}
+		cc, ok := byCostCentre[row.CostCentre]
+		if !ok {
+			cc = &chargebackRow{CostCentre: row.CostCentre}
+			byCostCentre[row.CostCentre] = cc
+			rows = append(rows, cc)
+		}
+		cc.Count += row.Count
+		cc.Size += row.Size
+		cc.TiB += row.TiB
+		cc.Charge += row.Charge
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].Charge != rows[j].Charge {
+			return rows[i].Charge > rows[j].Charge
+		}
+		return rows[i].Project+"\x00"+rows[i].CostCentre < rows[j].Project+"\x00"+rows[j].CostCentre
+	})
+	return
+}
+
+// wantsCSV is true if format=csv or, with no format, the Accept header asks for CSV
+func wantsCSV(r *http.Request, path string) (csv bool, apiErr *APIError) {
+	switch format := r.URL.Query().Get("format"); format {
+	case formatCSV:
+		return true, nil
+	case "json":
+		return false, nil
+	case "":
+	default:
+		return false, badRequest(path, "format must be json or csv, not %q", format)
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == "text/csv" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// chargeback handles requests of the form
+// <url>/api/v2/chargeback?path=/lustre/scratch115&period=month&by=project&format=csv, for what
+// each project or cost centre is charged for the space it uses under path over a period. The
+// usage is of every group, so it is not given to users who can only see some.
+func (ts *TreeServe) chargeback(w http.ResponseWriter, r *http.Request) *APIError {
+	path, _, apiErr := queryParameters(r)
+	if apiErr != nil {
+		return apiErr
+	}
+	vals := r.URL.Query()
+	period := vals.Get("period")
+	if period == "" {
+		period = "month"
+	}
+	years, ok := chargebackPeriods[period]
+	if !ok {
+		return badRequest(path, "period must be month, quarter or year, not %q", period)
+	}
+	by := vals.Get("by")
+	if by == "" {
+		by = chargebackByProject
+	}
+	if by != chargebackByProject && by != chargebackByCostCentre {
+		return badRequest(path, "by must be %s or %s, not %q", chargebackByProject, chargebackByCostCentre, by)
+	}
+	asCSV, apiErr := wantsCSV(r, path)
+	if apiErr != nil {
+		return apiErr
+	}
+	if p := principalFor(r); p != nil && !p.all {
+		return &APIError{Status: http.StatusForbidden, Code: errorForbidden, Path: path,
+			Message: "the chargeback report is of every group, which " + p.user + " cannot see"}
+	}
+	nodeKey, apiErr := ts.visibleNodeKey(r, path)
+	if apiErr != nil {
+		return apiErr
+	}
+
+	info, err := ts.GetBuildInfo()
+	if err != nil {
+		return internalError(path, err)
+	}
+	hasProjects := false
+	for _, d := range info.Dimensions {
+		hasProjects = hasProjects || d == dimensionProject
+	}
+	if !hasProjects {
+		return notFound(path, "the tree was not built with the project dimension, see -projectFile")
+	}
+	projects, err := ts.getProjects()
+	if err != nil {
+		return internalError(path, err)
+	}
+	stats, err := ts.retrieveAggregates(nodeKey)
+	if err != nil {
+		return internalError(path, err)
+	}
+	rows, total := ts.chargebackRows(stats, projects, years, by)
+
+	if !asCSV {
+		if rows == nil {
+			rows = []*chargebackRow{}
+		}
+		j, err := json.Marshal(chargebackResponse{Date: ts.scanDate.String(), Path: path, Period: period, By: by, Rows: rows, TotalCharge: total})
+		if err != nil {
+			return internalError(path, err)
+		}
+		writeJSON(w, j)
+		return nil
+	}
+
+	var b bytes.Buffer
+	c := csv.NewWriter(&b)
+	c.Write(chargebackColumns)
+	for _, row := range rows {
+		c.Write(row.values())
+	}
+	c.Flush()
+	if err = c.Error(); err != nil {
+		return internalError(path, err)
+	}
+	w.Header().Set("Content-Type", formatContentTypes[formatCSV])
+	w.Header().Set("Content-Disposition", "attachment; filename=\"chargeback-"+ts.scanDate.Format("2006-01")+"-"+by+".csv\"")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b.Bytes())
+	return nil
+}
@@ -0,0 +1,121 @@
+package treeserve
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChargeback(t *testing.T) {
+	ts, cleanup := newReadyTestTree(t)
+	defer cleanup()
+
+	projectFile := filepath.Dir(ts.LMDBPath) + "/projects"
+	err := ioutil.WriteFile(projectFile, []byte("# pattern\tproject\tPI\tcost centre\n/lustre/scratch/a/\talpha\tDr A\tCC1\n/lustre/scratch/[b-c]\tbeta\tDr B\tCC1\n/lustre gamma Dr_G CC2\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write project file: %v", err)
+	}
+	projects, err := LoadProjectFile(projectFile)
+	if err != nil || len(projects) != 3 || projects[0] != (Project{Pattern: "/lustre/scratch/a", Project: "alpha", PI: "Dr A", CostCentre: "CC1"}) {
+		t.Fatalf("Unexpected projects %+v %v", projects, err)
+	}
+	for _, bad := range []string{"/lustre\n", "lustre alpha\n", "/lustre/[ alpha\n", "/a alpha A CC1\n/b alpha B CC1\n"} {
+		err = ioutil.WriteFile(projectFile, []byte(bad), 0644)
+		if err != nil {
+			t.Fatalf("failed to write project file: %v", err)
+		}
+		if _, err = LoadProjectFile(projectFile); err == nil {
+			t.Errorf("Expected an error loading %q", bad)
+		}
+	}
+
+	rates, err := ParseChargebackRates("100,alpha=200,CC2=50")
+	if err != nil || rates.Default != 100 || rates.rate("alpha", "CC1") != 200 || rates.rate("gamma", "CC2") != 50 || rates.rate("beta", "CC1") != 100 {
+		t.Errorf("Unexpected rates %+v %v", rates, err)
+	}
+	if _, err = ParseChargebackRates("alpha=cheap"); err == nil {
+		t.Errorf("Expected an error for a rate that is not a number")
+	}
+
+	get := func(query string, p *principal) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", apiPrefix+"/chargeback?"+query, nil)
+		if p != nil {
+			r = r.WithContext(context.WithValue(r.Context(), principalContextKey{}, p))
+		}
+		w := httptest.NewRecorder()
+		ts.apiHandler(ts.chargeback)(w, r)
+		return w
+	}
+	if w := get("path=/lustre/scratch", nil); w.Code != 404 {
+		t.Errorf("Expected 404 for a tree without projects, got %d %s", w.Code, w.Body.String())
+	}
+
+	// every combination of user, group and tag is kept, with project only on its own
+	ts.SetProjects(projects)
+	if len(ts.Dimensions) != 4 || ts.Dimensions[3] != "project" || len(ts.Rollups) != 8 || len(ts.Rollups[7]) != 1 || ts.Rollups[7][0] != "project" {
+		t.Errorf("Expected the project dimension and rollup to be enabled, got %v %v", ts.Dimensions, ts.Rollups)
+	}
+	ts.Dimensions, ts.Rollups = defaultDimensions, [][]string{{"group"}}
+	ts.SetProjects(projects)
+	if len(ts.Dimensions) != 4 || ts.Dimensions[3] != "project" || len(ts.Rollups) != 2 {
+		t.Errorf("Expected the project rollup to be added, got %v %v", ts.Dimensions, ts.Rollups)
+	}
+	ts.ChargebackRates = rates
+	err = ts.Finalize("/", 2)
+	if err != nil {
+		t.Fatalf("failed to finalize: %v", err)
+	}
+
+	w := get("path=/lustre/scratch&period=year", nil)
+	var response chargebackResponse
+	err = json.Unmarshal(w.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatalf("failed to unmarshal %s: %v", w.Body.String(), err)
+	}
+	expected := []chargebackRow{
+		{Project: "alpha", PI: "Dr A", CostCentre: "CC1", Count: 3, Size: 4396, Rate: 200},
+		{Project: "beta", PI: "Dr B", CostCentre: "CC1", Count: 3, Size: 8492, Rate: 100},
+		{Project: "gamma", PI: "Dr_G", CostCentre: "CC2", Count: 1, Size: 4096, Rate: 50},
+	}
+	if len(response.Rows) != len(expected) {
+		t.Fatalf("Expected %d rows, got %s", len(expected), w.Body.String())
+	}
+	total := 0.0
+	for i, e := range expected {
+		e.TiB = float64(e.Size) / bytesInTiB
+		e.Charge = e.TiB * e.Rate
+		total += e.Charge
+		if got := *response.Rows[i]; got.Project != e.Project || got.PI != e.PI || got.CostCentre != e.CostCentre || got.Count != e.Count ||
+			got.Size != e.Size || got.Rate != e.Rate || math.Abs(got.Charge-e.Charge) > 1e-12 {
+			t.Errorf("Expected row %d to be %+v, got %+v", i, e, got)
+		}
+	}
+	if math.Abs(response.TotalCharge-total) > 1e-12 {
+		t.Errorf("Expected total charge %g, got %g", total, response.TotalCharge)
+	}
+
+	w = get("path=/lustre/scratch&by=cost_centre&format=csv", nil)
+	records, err := csv.NewReader(strings.NewReader(w.Body.String())).ReadAll()
+	if err != nil || len(records) != 3 || strings.Join(records[0], ",") != strings.Join(chargebackColumns, ",") ||
+		records[1][2] != "CC1" || records[1][4] != "12888" || records[2][2] != "CC2" {
+		t.Errorf("Unexpected CSV %v %v", records, err)
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") || !strings.Contains(w.Header().Get("Content-Disposition"), "attachment") {
+		t.Errorf("Expected a CSV attachment, got %v", w.Header())
+	}
+
+	for query, code := range map[string]int{"period=week": 400, "by=pi": 400, "format=xml": 400, "path=/nothere": 404} {
+		if w = get(query, nil); w.Code != code {
+			t.Errorf("Expected %d for %s, got %d", code, query, w.Code)
+		}
+	}
+	if w = get("path=/lustre/scratch", &principal{user: "u1", scopes: []idScope{{gids: map[string]bool{"10": true}}}}); w.Code != 403 {
+		t.Errorf("Expected 403 for a user who cannot see every group, got %d", w.Code)
+	}
+}
@@ -0,0 +1,222 @@
+package treeserve
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// Values of sort= for child_dirs
+const (
+	sortBySize  = "size"
+	sortByCount = "count"
+	sortByACost = "acost"
+	sortByMCost = "mcost"
+	sortByCCost = "ccost"
+	sortByName  = "name"
+)
+
+// childArrangement orders, pages and collapses the child_dirs of each directory in a tree
+type childArrangement struct {
+	sortBy        string // "" keeps the order from the database
+	descending    bool
+	offset        int
+	limit         int     // -1 for no limit
+	collapseBelow float64 // children with less than this of the sort metric (size when sorting by name) are folded together, 0 for none
+}
+
+// arrangementParameters gets sort, order, limit, offset and collapse_below from a request.
+// It returns nil if child_dirs are to be output as they are.
+func arrangementParameters(r *http.Request, path string) (ca *childArrangement, apiErr *APIError) {
+	vals := r.URL.Query()
+	if vals.Get("sort") == "" && vals.Get("order") == "" && vals.Get("limit") == "" && vals.Get("offset") == "" && vals.Get("collapse_below") == "" {
+		return
+	}
+	ca = &childArrangement{limit: -1}
+
+	ca.sortBy = vals.Get("sort")
+	switch ca.sortBy {
+	case "", sortByName:
+	case sortBySize, sortByCount, sortByACost, sortByMCost, sortByCCost:
+		// biggest first unless asked otherwise
+		ca.descending = true
+	default:
+		return nil, badRequest(path, "sort must be one of size, count, acost, mcost, ccost or name, not %q", ca.sortBy)
+	}
+
+	switch order := vals.Get("order"); order {
+	case "":
+	case "asc":
+		ca.descending = false
+	case "desc":
+		ca.descending = true
+	default:
+		return nil, badRequest(path, "order must be asc or desc, not %q", order)
+	}
+
+	if val := vals.Get("limit"); val != "" {
+		limit, err := strconv.Atoi(val)
+		if err != nil || limit < 0 {
+			return nil, badRequest(path, "limit must be a whole number, not %q", val)
+		}
+		ca.limit = limit
+	}
+	if val := vals.Get("offset"); val != "" {
+		offset, err := strconv.Atoi(val)
+		if err != nil || offset < 0 {
+			return nil, badRequest(path, "offset must be a whole number, not %q", val)
+		}
+		ca.offset = offset
+	}
+	if val := vals.Get("collapse_below"); val != "" {
+		collapseBelow, err := strconv.ParseFloat(val, 64)
+		if err != nil || collapseBelow < 0 {
+			return nil, badRequest(path, "collapse_below must be a number, not %q", val)
+		}
+		ca.collapseBelow = collapseBelow
+	}
+	return
+}
+
+// metric is the value children are compared on for sorting and collapsing
+func (ca *childArrangement) metric() string {
+	if ca.sortBy == "" || ca.sortBy == sortByName {
+		return sortBySize
+	}
+	return ca.sortBy
+}
+
+// arrangeLevel orders, pages and collapses the children of the directory at path, returning them
+// and how many directories there were to start with
+func (ca *childArrangement) arrangeLevel(path string, children []*dirTree) (arranged []*dirTree, total int) {
+	var dirs []*dirTree
+	var summary *dirTree
+	for _, child := range children {
+		if child.Name == "*.*" {
+			summary = child
+			continue
+		}
+		dirs = append(dirs, child)
+	}
+	total = len(dirs)
+	if ca == nil || total == 0 {
+		return children, total
+	}
+
+	metric := ca.metric()
+	values := make(map[*dirTree]float64, len(dirs))
+	for _, d := range dirs {
+		values[d] = totalValue(d.stats, metric)
+	}
+
+	if ca.sortBy == sortByName {
+		sort.SliceStable(dirs, func(i, j int) bool {
+			if ca.descending {
+				return dirs[i].Name > dirs[j].Name
+			}
+			return dirs[i].Name < dirs[j].Name
+		})
+	} else if ca.sortBy != "" {
+		sort.SliceStable(dirs, func(i, j int) bool {
+			if ca.descending {
+				return values[dirs[i]] > values[dirs[j]]
+			}
+			return values[dirs[i]] < values[dirs[j]]
+		})
+	}
+
+	var other *dirTree
+	if ca.collapseBelow > 0 {
+		var kept, collapsed []*dirTree
+		for _, d := range dirs {
+			if values[d] < ca.collapseBelow {
+				collapsed = append(collapsed, d)
+			} else {
+				kept = append(kept, d)
+			}
+		}
+		if len(collapsed) > 0 {
+			dirs = kept
+			other = collapseDirs(path, collapsed)
+		}
+	}
+
+	if ca.offset >= len(dirs) {
+		dirs = nil
+	} else {
+		dirs = dirs[ca.offset:]
+	}
+	if ca.limit >= 0 && ca.limit < len(dirs) {
+		dirs = dirs[:ca.limit]
+	}
+
+	arranged = dirs
+	if other != nil {
+		arranged = append(arranged, other)
+	}
+	if summary != nil {
+		arranged = append(arranged, summary)
+	}
+	return
+}
+
+// collapseDirs makes a synthetic directory with the total aggregates of dirs
+func collapseDirs(path string, dirs []*dirTree) *dirTree {
+	totals := make(map[string]Aggregates)
+	for _, d := range dirs {
+		for _, a := range d.stats {
+			addToAggregateMap(totals, a)
+		}
+	}
+	var stats []Aggregates
+	for _, a := range totals {
+		stats = append(stats, a)
+	}
+
+	name := fmt.Sprintf("(other %d dirs)", len(dirs))
+	return &dirTree{stats: stats, Name: name, Path: path + "/" + name}
+}
+
+// totalValue works out a single value of metric for a directory from its aggregates. Where a
+// category has a "*" rollup only that is used, so the same files are not counted more than once.
+// Those broken down by other dimensions are left out for the same reason.
+func totalValue(stats []Aggregates, metric string) (total float64) {
+	star := func(pick func(Aggregates) string) bool {
+		for _, a := range stats {
+			if pick(a) == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	groupStar := star(func(a Aggregates) string { return a.Group })
+	userStar := star(func(a Aggregates) string { return a.User })
+	tagStar := star(func(a Aggregates) string { return a.Tag })
+
+	for _, a := range stats {
+		if (groupStar && a.Group != "*") || (userStar && a.User != "*") || (tagStar && a.Tag != "*") || a.Dimensions != "" {
+			continue
+		}
+		switch metric {
+		case sortBySize:
+			total += a.Size.Float64()
+		case sortByCount:
+			total += a.Count.Float64()
+		case sortByACost:
+			total += costValue(a.AccessCost)
+		case sortByMCost:
+			total += costValue(a.ModifyCost)
+		case sortByCCost:
+			total += costValue(a.ChangeCost)
+		}
+	}
+	return
+}
+
+// costValue is a cost in the units it is output in
+func costValue(b *Bigint) float64 {
+	f, err := strconv.ParseFloat(convertstatsForOutput(b), 64)
+	LogError(err)
+	return f
+}
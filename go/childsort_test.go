@@ -0,0 +1,65 @@
+package treeserve
+
+import "testing"
+
+func TestArrangeChildDirs(t *testing.T) {
+	ts, cleanup := newReadyTestTree(t)
+	defer cleanup()
+
+	get := func(query string) fullTree {
+		return getTestTree(t, ts, "path=/lustre/scratch&depth=1&"+query)
+	}
+	names := func(ft fullTree) (n []string) {
+		for _, child := range ft.Tree.ChildDirs {
+			if child.Name != "*.*" {
+				n = append(n, child.Name)
+			}
+		}
+		return
+	}
+	equal := func(a, b []string) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	// a holds 4396 bytes and b 8492
+	tests := []struct {
+		query string
+		names []string
+	}{
+		{"sort=size", []string{"b", "a"}},
+		{"sort=size&order=asc", []string{"a", "b"}},
+		{"sort=name&order=desc", []string{"b", "a"}},
+		{"sort=name&limit=1", []string{"a"}},
+		{"sort=name&offset=1", []string{"b"}},
+		{"sort=name&offset=2", nil},
+		{"sort=size&collapse_below=5000", []string{"b", "(other 1 dirs)"}},
+	}
+	for _, test := range tests {
+		ft := get(test.query)
+		if !equal(names(ft), test.names) {
+			t.Errorf("%s: expected %v, got %v", test.query, test.names, names(ft))
+		}
+	}
+
+	ft := get("sort=size&limit=1")
+	if ft.Tree.TotalChildDirs != 2 {
+		t.Errorf("Expected 2 child dirs in total, got %d", ft.Tree.TotalChildDirs)
+	}
+
+	ft = get("collapse_below=1000000")
+	if len(names(ft)) != 1 {
+		t.Fatalf("Expected everything collapsed, got %v", names(ft))
+	}
+	other := ft.Tree.ChildDirs[0]
+	if other.Name != "(other 2 dirs)" || other.Data.Size["*"]["*"]["*"] != "12888" || other.Data.Count["*"]["*"]["*"] != "6" {
+		t.Errorf("Expected (other 2 dirs) with size 12888 and count 6, got %s %v %v", other.Name, other.Data.Size, other.Data.Count)
+	}
+}
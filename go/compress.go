@@ -0,0 +1,105 @@
+package treeserve
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptedEncoding picks gzip or deflate from an Accept-Encoding header, preferring gzip when the
+// client gives them the same weight, or "" to send the response as it is
+func acceptedEncoding(acceptEncoding string) (encoding string) {
+	best := 0.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name != "gzip" && name != "deflate" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				q, err = strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					q = 0
+				}
+			}
+		}
+		if q > best || (q == best && q > 0 && name == "gzip") {
+			best = q
+			encoding = name
+		}
+	}
+	return
+}
+
+// compressWriter compresses a response with encoding. Responses without a body, such as
+// 304 Not Modified, are left alone.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	compressor  io.WriteCloser
+	wroteHeader bool
+}
+
+// newCompressWriter wraps w to compress with the encoding r accepts, or returns nil if it
+// accepts neither
+func newCompressWriter(w http.ResponseWriter, r *http.Request) *compressWriter {
+	w.Header().Add("Vary", "Accept-Encoding")
+	encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return nil
+	}
+	return &compressWriter{ResponseWriter: w, encoding: encoding}
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	if status != http.StatusNotModified && status != http.StatusNoContent {
+		cw.Header().Set("Content-Encoding", cw.encoding)
+		cw.Header().Del("Content-Length")
+		if cw.encoding == "gzip" {
+			cw.compressor = gzip.NewWriter(cw.ResponseWriter)
+		} else {
+			cw.compressor = zlib.NewWriter(cw.ResponseWriter)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.compressor == nil {
+		return cw.ResponseWriter.Write(p)
+	}
+	return cw.compressor.Write(p)
+}
+
+// Flush sends what has been compressed so far
+func (cw *compressWriter) Flush() {
+	if f, ok := cw.compressor.(interface {
+		Flush() error
+	}); ok {
+		LogError(f.Flush())
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// close finishes the compressed stream
+func (cw *compressWriter) close() {
+	if cw.compressor != nil {
+		LogError(cw.compressor.Close())
+	}
+}
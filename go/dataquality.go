@@ -0,0 +1,252 @@
+package treeserve
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// defaultQualitySamples is how many paths are kept as examples of each data quality problem
+const defaultQualitySamples = 10
+
+// knownFileTypes are the file types written by mpistat and wrstat: file, directory, link,
+// socket, block device, character device and FIFO
+const knownFileTypes = "fdlsbcF"
+
+// QualityCheck is how many times a data quality problem was found, with some of the paths it
+// was found for
+type QualityCheck struct {
+	Count   int64    `json:"count"`
+	Samples []string `json:"samples"`
+}
+
+// DataQuality is a report of the problems with the input found while building a tree. The
+// first three are found when reading the input, the rest when finalizing.
+type DataQuality struct {
+	UnknownFileTypes QualityCheck `json:"unknown_file_types"` // not one of knownFileTypes
+	NonUTF8Paths     QualityCheck `json:"non_utf8_paths"`     // samples are quoted with the bytes escaped
+	DuplicateLines   QualityCheck `json:"duplicate_lines"`    // lines for a path there already was a line for
+	PlaceholderDirs  QualityCheck `json:"placeholder_dirs"`   // parent directories in the input without a line of their own
+	ZeroCtime        QualityCheck `json:"zero_ctime"`         // lines with a ctime of 0, left out of the aggregates
+	NegativeAges     QualityCheck `json:"negative_ages"`      // times after the cost reference time, which give negative costs
+}
+
+// counts gets the number of times each problem was found, keyed as in the JSON report
+func (dq *DataQuality) counts() map[string]int64 {
+	return map[string]int64{
+		"unknown_file_types": dq.UnknownFileTypes.Count,
+		"non_utf8_paths":     dq.NonUTF8Paths.Count,
+		"duplicate_lines":    dq.DuplicateLines.Count,
+		"placeholder_dirs":   dq.PlaceholderDirs.Count,
+		"zero_ctime":         dq.ZeroCtime.Count,
+		"negative_ages":      dq.NegativeAges.Count,
+	}
+}
+
+// dataQuality collects the report of a build from the input and finalize workers
+type dataQuality struct {
+	sync.Mutex
+	report     DataQuality
+	aboveInput map[string]bool // placeholders that only join the input to the root, set before finalizing
+}
+
+// note counts a problem found for path, keeping path as a sample if there are fewer than samples
+func (q *dataQuality) note(check func(dq *DataQuality) *QualityCheck, path string, samples int) {
+	q.Lock()
+	defer q.Unlock()
+	c := check(&q.report)
+	c.Count++
+	if len(c.Samples) < samples {
+		c.Samples = append(c.Samples, path)
+	}
+}
+
+// checkLine notes the problems with a line of input for nodePath, before it is added to the tree
+func (ts *TreeServe) checkLine(nodePath string, nodeStats NodeStats) {
+	if !utf8.ValidString(nodePath) {
+		ts.dataQuality.note(func(dq *DataQuality) *QualityCheck { return &dq.NonUTF8Paths }, strconv.Quote(nodePath), ts.QualitySamples)
+	}
+	if strings.IndexByte(knownFileTypes, nodeStats.FileType) < 0 {
+		ts.dataQuality.note(func(dq *DataQuality) *QualityCheck { return &dq.UnknownFileTypes }, nodePath, ts.QualitySamples)
+	}
+}
+
+// noteDuplicateLine notes a line of input for nodePath that replaced one read before
+func (ts *TreeServe) noteDuplicateLine(nodePath string) {
+	ts.dataQuality.note(func(dq *DataQuality) *QualityCheck { return &dq.DuplicateLines }, nodePath, ts.QualitySamples)
+}
+
+// checkNode notes the problems with a node of the finished tree as it is finalized
+func (ts *TreeServe) checkNode(treeNode *TreeNode) {
+	stats := treeNode.Stats
+	if stats == (NodeStats{}) {
+		ts.dataQuality.Lock()
+		aboveInput := ts.dataQuality.aboveInput[treeNode.Name]
+		ts.dataQuality.Unlock()
+		if !aboveInput {
+			ts.dataQuality.note(func(dq *DataQuality) *QualityCheck { return &dq.PlaceholderDirs }, treeNode.Name, ts.QualitySamples)
+		}
+		return
+	}
+	if stats.AccessTime > ts.CostReferenceTime || stats.ModificationTime > ts.CostReferenceTime || stats.ChangeTime > ts.CostReferenceTime {
+		ts.dataQuality.note(func(dq *DataQuality) *QualityCheck { return &dq.NegativeAges }, treeNode.Name, ts.QualitySamples)
+	}
+	if stats.ChangeTime == 0 {
+		ts.dataQuality.note(func(dq *DataQuality) *QualityCheck { return &dq.ZeroCtime }, treeNode.Name, ts.QualitySamples)
+	}
+}
+
+// resetInputQuality starts the report of a build again before its input is read
+func (ts *TreeServe) resetInputQuality() {
+	ts.dataQuality.Lock()
+	defer ts.dataQuality.Unlock()
+	ts.dataQuality.report = DataQuality{}
+}
+
+// resetFinalizeQuality clears what finalizing found from the report, taking what was found when
+// reading the input from the saved report if there is one, as when finalizing is started again
+func (ts *TreeServe) resetFinalizeQuality() (err error) {
+	saved, err := ts.GetDataQuality()
+	if err != nil {
+		return
+	}
+	aboveInput, err := ts.placeholdersAboveInput()
+	if err != nil {
+		return
+	}
+	ts.dataQuality.Lock()
+	defer ts.dataQuality.Unlock()
+	ts.dataQuality.aboveInput = aboveInput
+	if saved != nil {
+		ts.dataQuality.report = *saved
+	}
+	ts.dataQuality.report.PlaceholderDirs = QualityCheck{}
+	ts.dataQuality.report.ZeroCtime = QualityCheck{}
+	ts.dataQuality.report.NegativeAges = QualityCheck{}
+	return
+}
+
+// placeholdersAboveInput gets the names of the placeholders from the root down to the directory
+// all the input is under, eg. / and /lustre for a scan of /lustre/scratch115, which are not
+// missing from the input
+func (ts *TreeServe) placeholdersAboveInput() (names map[string]bool, err error) {
+	names = make(map[string]bool)
+	nodeKey := ts.getPathKey("/")
+	haveRoot, err := ts.TreeNodeDB.HasKey(nodeKey)
+	if err != nil || !haveRoot {
+		return
+	}
+	for {
+		node, err := ts.GetTreeNode(nodeKey)
+		if err != nil {
+			return nil, err
+		}
+		if node.Stats != (NodeStats{}) {
+			return names, nil
+		}
+		names[node.Name] = true
+		childKeys, err := ts.children(nodeKey)
+		if err != nil {
+			return nil, err
+		}
+		// a placeholder with more than one child is the directory the input is under
+		if len(childKeys) != 1 {
+			return names, nil
+		}
+		nodeKey = childKeys[0]
+	}
+}
+
+// saveDataQuality saves the report so far in the tree
+func (ts *TreeServe) saveDataQuality() (err error) {
+	ts.dataQuality.Lock()
+	j, err := json.Marshal(&ts.dataQuality.report)
+	ts.dataQuality.Unlock()
+	if err != nil {
+		return
+	}
+	return ts.SetMetadata("dataQuality", string(j))
+}
+
+// GetDataQuality gets the data quality report saved in the tree, nil if the tree was built
+// before reports were kept
+func (ts *TreeServe) GetDataQuality() (dq *DataQuality, err error) {
+	j, err := ts.GetMetadata("dataQuality")
+	if err != nil {
+		return
+	}
+	if j == "" {
+		return
+	}
+	dq = &DataQuality{}
+	err = json.Unmarshal([]byte(j), dq)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to parse data quality report saved in tree")
+	}
+	return
+}
+
+// finishDataQuality saves the report once the tree is finalized, with the counts in the build
+// info, and logs them
+func (ts *TreeServe) finishDataQuality() (err error) {
+	err = ts.saveDataQuality()
+	if err != nil {
+		return
+	}
+	ts.dataQuality.Lock()
+	counts := ts.dataQuality.report.counts()
+	ts.dataQuality.Unlock()
+	err = ts.updateBuildInfo(func(info *BuildInfo) {
+		info.DataQuality = counts
+	})
+	if err != nil {
+		return
+	}
+	fields := log.Fields{}
+	var problems int64
+	for name, count := range counts {
+		fields[name] = count
+		problems += count
+	}
+	if problems > 0 {
+		log.WithFields(fields).Warn("data quality problems found in input, see /api/v2/quality")
+	} else {
+		log.Info("no data quality problems found in input")
+	}
+	return
+}
+
+// qualityResponse is the body of a /api/v2/quality response
+type qualityResponse struct {
+	Date string `json:"date"` // when the input the tree was built from was made
+	*DataQuality
+}
+
+// quality handles requests of the form <url>/api/v2/quality, for the problems with the input
+// found while building the tree. The samples are paths of every group, so it is not given to
+// users who can only see some.
+func (ts *TreeServe) quality(w http.ResponseWriter, r *http.Request) *APIError {
+	if p := principalFor(r); p != nil && !p.all {
+		return &APIError{Status: http.StatusForbidden, Code: errorForbidden,
+			Message: "the data quality report has paths of every group, which " + p.user + " cannot see"}
+	}
+	dq, err := ts.GetDataQuality()
+	if err != nil {
+		return internalError("", err)
+	}
+	if dq == nil {
+		return notFound("", "the tree was built before data quality reports were kept, rebuild it")
+	}
+
+	j, err := json.Marshal(qualityResponse{Date: ts.scanDate.String(), DataQuality: dq})
+	if err != nil {
+		return internalError("", err)
+	}
+	writeJSON(w, j)
+	return nil
+}
@@ -0,0 +1,109 @@
+package treeserve
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestDataQuality(t *testing.T) {
+	lines := append(append([]string{}, testTreeLines...),
+		testLine("/lustre/scratch/missing/f.txt", 10, 1, 10, 1000, "f"),
+		testLine("/lustre/scratch/a/x.bam", 100, 1, 10, 1000, "f"),
+		testLine("/lustre/scratch/a/future", 10, 1, 10, 3000, "f"),
+		testLine("/lustre/scratch/a/bad\xff", 10, 1, 10, 1000, "f"),
+		testLine("/lustre/scratch/a/odd", 10, 1, 10, 1000, "X"),
+		testLine("/lustre/scratch/a/zero", 10, 1, 10, 0, "f"),
+	)
+	ts, cleanup := newReadyTestTree(t, lines...)
+	defer cleanup()
+
+	check := func(dq *DataQuality) {
+		for name, expected := range map[string]struct {
+			c      QualityCheck
+			sample string
+		}{
+			"placeholder":  {dq.PlaceholderDirs, "/lustre/scratch/missing"},
+			"duplicate":    {dq.DuplicateLines, "/lustre/scratch/a/x.bam"},
+			"negative age": {dq.NegativeAges, "/lustre/scratch/a/future"},
+			"non UTF-8":    {dq.NonUTF8Paths, strconv.Quote("/lustre/scratch/a/bad\xff")},
+			"unknown type": {dq.UnknownFileTypes, "/lustre/scratch/a/odd"},
+			"zero ctime":   {dq.ZeroCtime, "/lustre/scratch/a/zero"},
+		} {
+			if expected.c.Count != 1 || len(expected.c.Samples) != 1 || expected.c.Samples[0] != expected.sample {
+				t.Errorf("Expected one %s sampled as %s, got %+v", name, expected.sample, expected.c)
+			}
+		}
+	}
+	dq, err := ts.GetDataQuality()
+	if err != nil || dq == nil {
+		t.Fatalf("failed to get data quality report: %v", err)
+	}
+	check(dq)
+	info, err := ts.GetBuildInfo()
+	if err != nil || info.DataQuality["placeholder_dirs"] != 1 || info.DataQuality["duplicate_lines"] != 1 {
+		t.Errorf("Expected the counts in the build info, got %v %v", info.DataQuality, err)
+	}
+
+	// finalizing again keeps what was found in the input and does not count the rest twice
+	err = ts.Finalize("/", 2)
+	if err != nil {
+		t.Fatalf("failed to finalize again: %v", err)
+	}
+	dq, err = ts.GetDataQuality()
+	if err != nil || dq == nil {
+		t.Fatalf("failed to get data quality report: %v", err)
+	}
+	check(dq)
+
+	// serving the tree does not count anything
+	getTestTree(t, ts, "path=/lustre/scratch&depth=2")
+	ts.dataQuality.Lock()
+	counts := ts.dataQuality.report.counts()
+	ts.dataQuality.Unlock()
+	if counts["placeholder_dirs"] != 1 || counts["zero_ctime"] != 1 || counts["negative_ages"] != 1 {
+		t.Errorf("Expected serving the tree not to change the counts, got %v", counts)
+	}
+
+	get := func(p *principal) (response qualityResponse, code int) {
+		r := httptest.NewRequest("GET", apiPrefix+"/quality", nil)
+		if p != nil {
+			r = r.WithContext(context.WithValue(r.Context(), principalContextKey{}, p))
+		}
+		w := httptest.NewRecorder()
+		ts.apiHandler(ts.quality)(w, r)
+		if w.Code == 200 {
+			err := json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatalf("failed to unmarshal %s: %v", w.Body.String(), err)
+			}
+		}
+		return response, w.Code
+	}
+	response, code := get(nil)
+	if code != 200 || response.DataQuality == nil {
+		t.Fatalf("Unexpected data quality response %d %+v", code, response)
+	}
+	check(response.DataQuality)
+	if _, code = get(&principal{user: "u1", scopes: []idScope{{gids: map[string]bool{"10": true}}}}); code != 403 {
+		t.Errorf("Expected 403 for a user who cannot see every group, got %d", code)
+	}
+
+	err = ts.SetMetadata("dataQuality", "")
+	if err != nil {
+		t.Fatalf("failed to clear data quality report: %v", err)
+	}
+	if _, code = get(nil); code != 404 {
+		t.Errorf("Expected 404 for a tree without a data quality report, got %d", code)
+	}
+
+	// / and /lustre are only there to join a scan of /lustre/scratch to the root
+	scratch, scratchCleanup := newReadyTestTree(t, testTreeLines[2:]...)
+	defer scratchCleanup()
+	dq, err = scratch.GetDataQuality()
+	if err != nil || dq == nil || dq.PlaceholderDirs.Count != 0 {
+		t.Errorf("Expected no placeholders above the input, got %+v %v", dq, err)
+	}
+}
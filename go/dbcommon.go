@@ -1,6 +1,7 @@
 package treeserve
 
 import (
+	"bytes"
 	"encoding"
 
 	log "github.com/Sirupsen/logrus"
@@ -16,7 +17,7 @@ type DBCommon struct {
 // Reset the database to its initial state.
 func (db *DBCommon) Reset() (err error) {
 	ts := db.TS
-	err = ts.LMDBEnv.Update(func(txn *lmdb.Txn) (err error) {
+	err = ts.update(func(txn *lmdb.Txn) (err error) {
 		err = txn.Drop(db.DBI, false)
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -38,7 +39,7 @@ func (db *DBCommon) Reset() (err error) {
 
 func (db *DBCommon) Stat() (dbiStat *lmdb.Stat, err error) {
 	ts := db.TS
-	err = ts.LMDBEnv.View(func(txn *lmdb.Txn) (err error) {
+	err = ts.view(func(txn *lmdb.Txn) (err error) {
 		dbiStat, err = txn.Stat(db.DBI)
 		return
 	})
@@ -60,7 +61,7 @@ func (db *DBCommon) HasKey(key encoding.BinaryMarshaler) (present bool, err erro
 		}).Error("could not marshal key")
 	}
 	present = false
-	err = ts.LMDBEnv.View(func(txn *lmdb.Txn) (err error) {
+	err = ts.view(func(txn *lmdb.Txn) (err error) {
 		_, err = txn.Get(db.DBI, keyBytes)
 		return
 	})
@@ -80,3 +81,64 @@ func (db *DBCommon) HasKey(key encoding.BinaryMarshaler) (present bool, err erro
 	}
 	return
 }
+
+// KeyVisitor is called with each key in a database
+type KeyVisitor func(key *Md5Key) error
+
+// forEachKeyBatchSize is the number of keys read in each transaction by ForEachKey
+const forEachKeyBatchSize = 10000
+
+// ForEachKey calls visit for every key in the database, in key order.
+// Keys are read in batches so that visit is free to use other databases
+// without a read transaction being held open.
+func (db *DBCommon) ForEachKey(visit KeyVisitor) (err error) {
+	ts := db.TS
+	var lastKey []byte
+	for {
+		var keys []*Md5Key
+		err = ts.view(func(txn *lmdb.Txn) (err error) {
+			cur, err := txn.OpenCursor(db.DBI)
+			if err != nil {
+				return
+			}
+			defer cur.Close()
+
+			var k []byte
+			if lastKey == nil {
+				k, _, err = cur.Get(nil, nil, lmdb.First)
+			} else {
+				k, _, err = cur.Get(lastKey, nil, lmdb.SetRange)
+				if err == nil && bytes.Equal(k, lastKey) {
+					k, _, err = cur.Get(nil, nil, lmdb.NextNoDup)
+				}
+			}
+			for err == nil && len(keys) < forEachKeyBatchSize {
+				key := Md5Key{}
+				key.SetBytes(k)
+				keys = append(keys, &key)
+				k, _, err = cur.Get(nil, nil, lmdb.NextNoDup)
+			}
+			if lmdb.IsNotFound(err) {
+				err = nil
+			}
+			return
+		})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+				"db":  db.Name,
+			}).Error("failed to iterate over database keys")
+			return
+		}
+		if len(keys) == 0 {
+			return
+		}
+		for _, key := range keys {
+			err = visit(key)
+			if err != nil {
+				return
+			}
+		}
+		lastKey = keys[len(keys)-1].GetBytes()
+	}
+}
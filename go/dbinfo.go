@@ -0,0 +1,187 @@
+package treeserve
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// DBIInfo is the storage used by one database in the LMDB environment
+type DBIInfo struct {
+	Name          string `json:"name"`
+	Entries       uint64 `json:"entries"`
+	Depth         uint   `json:"depth"`
+	BranchPages   uint64 `json:"branch_pages"`
+	LeafPages     uint64 `json:"leaf_pages"`
+	OverflowPages uint64 `json:"overflow_pages"`
+	Pages         uint64 `json:"pages"`
+	Bytes         uint64 `json:"bytes"`
+}
+
+// DBInfo is the storage used by the LMDB environment. Pages that have been freed, for example
+// by resetting a database, are reused by LMDB but the file never shrinks, so FileBytes can be
+// much more than DataBytes. Compact makes a copy without the free pages.
+type DBInfo struct {
+	LMDBPath      string    `json:"lmdb_path"`
+	SchemaVersion int       `json:"schema_version"`
+	State         string    `json:"state"`
+	FileBytes     int64     `json:"file_bytes"`
+	MapSize       int64     `json:"map_size"`
+	PageSize      uint      `json:"page_size"`
+	UsedBytes     int64     `json:"used_bytes"` // up to the highest page written
+	DataBytes     uint64    `json:"data_bytes"` // in the pages of the databases
+	DBIs          []DBIInfo `json:"dbis"`
+}
+
+// databases lists every database in the environment apart from the TreeServe one
+func (ts *TreeServe) databases() []*DBCommon {
+	return []*DBCommon{&ts.TreeNodeDB.DBCommon, &ts.StatMappingDB.DBCommon, &ts.ChildrenDB.DBCommon, &ts.StatMappingsDB.DBCommon,
+		&ts.AggregateSizeDB.DBCommon, &ts.AggregateCountDB.DBCommon, &ts.AggregateCreateCostDB.DBCommon,
+		&ts.AggregateModifyCostDB.DBCommon, &ts.AggregateAccessCostDB.DBCommon,
+		&ts.AggregateHistogramsDB.DBCommon, &ts.AggregateExtremesDB.DBCommon, &ts.TopDB.DBCommon, &ts.ExtensionsDB.DBCommon}
+}
+
+func newDBIInfo(name string, dbiStat *lmdb.Stat) DBIInfo {
+	pages := dbiStat.BranchPages + dbiStat.LeafPages + dbiStat.OverflowPages
+	return DBIInfo{
+		Name:          name,
+		Entries:       dbiStat.Entries,
+		Depth:         dbiStat.Depth,
+		BranchPages:   dbiStat.BranchPages,
+		LeafPages:     dbiStat.LeafPages,
+		OverflowPages: dbiStat.OverflowPages,
+		Pages:         pages,
+		Bytes:         pages * uint64(dbiStat.PSize),
+	}
+}
+
+// DBInfo gets the storage used by each database in the environment
+func (ts *TreeServe) DBInfo() (info *DBInfo, err error) {
+	info = &DBInfo{LMDBPath: ts.LMDBPath}
+
+	fileInfo, err := os.Stat(ts.LMDBPath)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":      err,
+			"LMDBPath": ts.LMDBPath,
+		}).Error("failed to stat LMDB environment")
+		return
+	}
+	info.FileBytes = fileInfo.Size()
+
+	envInfo, err := ts.LMDBEnv.Info()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to get LMDB environment info")
+		return
+	}
+	info.MapSize = envInfo.MapSize
+
+	info.SchemaVersion, err = ts.GetSchemaVersion()
+	if err != nil {
+		return
+	}
+	info.State, err = ts.GetState()
+	if err != nil {
+		return
+	}
+
+	// the main database holds the names of the others
+	envStat, err := ts.LMDBEnv.Stat()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to get LMDB environment stats")
+		return
+	}
+	info.PageSize = envStat.PSize
+	info.UsedBytes = (envInfo.LastPNO + 1) * int64(envStat.PSize)
+	info.DBIs = append(info.DBIs, newDBIInfo("(main)", envStat))
+
+	var treeServeStat *lmdb.Stat
+	err = ts.view(func(txn *lmdb.Txn) (err error) {
+		treeServeStat, err = txn.Stat(ts.TreeServeDBI)
+		return
+	})
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to get stats for TreeServe database")
+		return
+	}
+	info.DBIs = append(info.DBIs, newDBIInfo("TreeServe", treeServeStat))
+
+	for _, db := range ts.databases() {
+		dbiStat, err := db.Stat()
+		if err != nil {
+			return info, err
+		}
+		info.DBIs = append(info.DBIs, newDBIInfo(db.Name, dbiStat))
+	}
+
+	for _, dbiInfo := range info.DBIs {
+		info.DataBytes += dbiInfo.Bytes
+	}
+	return
+}
+
+// CompactInfo compares the size of an environment with its compacted copy
+type CompactInfo struct {
+	LMDBPath     string  `json:"lmdb_path"`
+	OutputPath   string  `json:"output_path"`
+	BytesBefore  int64   `json:"bytes_before"`
+	BytesAfter   int64   `json:"bytes_after"`
+	PercentSaved float64 `json:"percent_saved"`
+}
+
+// Compact writes a copy of the environment to outputPath leaving out free pages and
+// renumbering the rest, so it is only as large as its contents.
+func (ts *TreeServe) Compact(outputPath string) (compactInfo *CompactInfo, err error) {
+	compactInfo = &CompactInfo{LMDBPath: ts.LMDBPath, OutputPath: outputPath}
+
+	fileInfo, err := os.Stat(ts.LMDBPath)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":      err,
+			"LMDBPath": ts.LMDBPath,
+		}).Error("failed to stat LMDB environment")
+		return
+	}
+	compactInfo.BytesBefore = fileInfo.Size()
+
+	err = ts.LMDBEnv.CopyFlag(outputPath, lmdb.CopyCompact)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":        err,
+			"LMDBPath":   ts.LMDBPath,
+			"outputPath": outputPath,
+		}).Error("failed to write compacted copy of LMDB environment")
+		return
+	}
+
+	fileInfo, err = os.Stat(outputPath)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":        err,
+			"outputPath": outputPath,
+		}).Error("failed to stat compacted LMDB environment")
+		return
+	}
+	compactInfo.BytesAfter = fileInfo.Size()
+	if compactInfo.BytesBefore > 0 {
+		compactInfo.PercentSaved = 100 * float64(compactInfo.BytesBefore-compactInfo.BytesAfter) / float64(compactInfo.BytesBefore)
+	}
+	return
+}
+
+// adminDB handles requests for /admin/db and returns the storage used by each database in json format
+func (ts *TreeServe) adminDB(w http.ResponseWriter, r *http.Request) *APIError {
+	info, err := ts.DBInfo()
+	if err != nil {
+		return internalError("", err)
+	}
+	j, err := json.Marshal(info)
+	if err != nil {
+		return internalError("", err)
+	}
+	writeJSON(w, j)
+	return nil
+}
@@ -0,0 +1,76 @@
+package treeserve
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestDBInfoAndCompact(t *testing.T) {
+	lmdbDir, err := ioutil.TempDir("", "dbinfo_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory for LMDB: %v", err)
+	}
+	defer os.RemoveAll(lmdbDir)
+
+	ts := buildTestTree(t, lmdbDir+"/lmdb", testTreeLines)
+	defer ts.CloseLMDB()
+
+	info, err := ts.DBInfo()
+	if err != nil {
+		t.Fatalf("failed to get database info: %v", err)
+	}
+	if len(info.DBIs) != len(ts.databases())+2 {
+		t.Errorf("Expected %d databases, got %d", len(ts.databases())+2, len(info.DBIs))
+	}
+	for _, dbiInfo := range info.DBIs {
+		if dbiInfo.Name == "TreeNode" && dbiInfo.Entries != uint64(len(testTreeLines)) {
+			t.Errorf("Expected %d tree nodes, got %d", len(testTreeLines), dbiInfo.Entries)
+		}
+	}
+	if info.SchemaVersion != SchemaVersion {
+		t.Errorf("Expected schema version %d, got %d", SchemaVersion, info.SchemaVersion)
+	}
+
+	// /admin/db answers like the rest of the API, errors included
+	adminDB := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ts.apiHandler(ts.adminDB)(w, httptest.NewRequest("GET", "/admin/db", nil))
+		return w
+	}
+	w := adminDB()
+	var apiErr APIError
+	if w.Code != http.StatusServiceUnavailable || json.Unmarshal(w.Body.Bytes(), &apiErr) != nil || apiErr.Code != errorNotReady {
+		t.Errorf("Expected a JSON not_ready error before the tree is ready, got %d %s", w.Code, w.Body.String())
+	}
+	err = ts.SetState("treeReady")
+	if err != nil {
+		t.Fatalf("failed to set state: %v", err)
+	}
+	w = adminDB()
+	var served DBInfo
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &served) != nil || len(served.DBIs) != len(info.DBIs) {
+		t.Errorf("Expected the database info, got %d %s", w.Code, w.Body.String())
+	}
+
+	compactPath := lmdbDir + "/compact"
+	compactInfo, err := ts.Compact(compactPath)
+	if err != nil {
+		t.Fatalf("failed to compact: %v", err)
+	}
+	if compactInfo.BytesAfter <= 0 {
+		t.Errorf("Expected compacted copy to have a size, got %d", compactInfo.BytesAfter)
+	}
+
+	// the copy is a complete tree
+	compacted := NewTreeServe(compactPath, 64*1024*1024, 2000, 1000, -1, 1000, -1, false)
+	err = compacted.OpenLMDB()
+	if err != nil {
+		t.Fatalf("failed to open compacted environment: %v", err)
+	}
+	defer compacted.CloseLMDB()
+	verifyTestTree(t, compacted, "compacted tree")
+}
@@ -0,0 +1,166 @@
+package treeserve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// the dimensions aggregates can be broken down by. User, group and tag are kept in their own
+// fields of StatMapping, the others together in Dimensions.
+const (
+	dimensionUser      = "user"
+	dimensionGroup     = "group"
+	dimensionTag       = "tag"
+	dimensionVolume    = "volume"    // the first VolumeDepth components of the path
+	dimensionProject   = "project"   // from the most specific matching pattern in the project file
+	dimensionFileType  = "filetype"  // file, directory, link...
+	dimensionSizeClass = "sizeclass" // the size histogram bucket
+	dimensionAgeClass  = "ageclass"  // the atime age histogram bucket
+)
+
+// dimensionSeparator separates the name=value pairs in StatMapping.Dimensions
+const dimensionSeparator = ";"
+
+// knownDimensions are all the dimensions, in the order they are kept in when enabled
+var knownDimensions = []string{dimensionUser, dimensionGroup, dimensionTag, dimensionVolume, dimensionProject, dimensionFileType, dimensionSizeClass, dimensionAgeClass}
+
+// defaultDimensions are the dimensions aggregates were always broken down by
+var defaultDimensions = []string{dimensionUser, dimensionGroup, dimensionTag}
+
+// defaultVolumeDepth makes the volume of /lustre/scratch115/projects/x /lustre/scratch115
+const defaultVolumeDepth = 2
+
+// ParseDimensions parses a comma separated list of dimensions to break aggregates down by,
+// returning them in the order they are kept in
+func ParseDimensions(s string) (dimensions []string, err error) {
+	enabled := make(map[string]bool)
+	for _, d := range strings.Split(s, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" {
+			continue
+		}
+		if !isKnownDimension(d) {
+			return nil, fmt.Errorf("unknown dimension %s, expected one of %s", d, strings.Join(knownDimensions, ","))
+		}
+		enabled[d] = true
+	}
+	for _, d := range knownDimensions {
+		if enabled[d] {
+			dimensions = append(dimensions, d)
+		}
+	}
+	return
+}
+
+func isKnownDimension(d string) bool {
+	for _, k := range knownDimensions {
+		if d == k {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseRollups parses a comma separated list of combinations of dimensions, each joined by +, eg.
+// group+user+tag,group+volume. Aggregates are kept with the values of the dimensions in each
+// combination and "*" for the rest, as well as with "*" for every dimension. "" gives nil, for
+// every combination of dimensions.
+func ParseRollups(s string, dimensions []string) (rollups [][]string, err error) {
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		in := make(map[string]bool)
+		for _, d := range strings.Split(entry, "+") {
+			if !isKnownDimension(d) {
+				return nil, fmt.Errorf("rollup %s has unknown dimension %s", entry, d)
+			}
+			in[d] = true
+		}
+		var combination []string
+		for _, d := range dimensions {
+			if in[d] {
+				combination = append(combination, d)
+				delete(in, d)
+			}
+		}
+		for d := range in {
+			return nil, fmt.Errorf("rollup %s has dimension %s which is not enabled", entry, d)
+		}
+		rollups = append(rollups, combination)
+	}
+	return
+}
+
+// rollupCombinations gets the combinations of dimensions aggregates are kept for, starting with
+// the one with "*" for every dimension
+func (ts *TreeServe) rollupCombinations() (combinations [][]string) {
+	combinations = [][]string{{}}
+	if ts.Rollups != nil {
+		return append(combinations, ts.Rollups...)
+	}
+	for _, d := range ts.Dimensions {
+		for _, c := range combinations {
+			combinations = append(combinations, append(append([]string{}, c...), d))
+		}
+	}
+	return
+}
+
+// rollupNames gets the combinations of dimensions aggregates are kept for as ParseRollups takes them
+func (ts *TreeServe) rollupNames() (names []string) {
+	for _, c := range ts.rollupCombinations()[1:] {
+		names = append(names, strings.Join(c, "+"))
+	}
+	return
+}
+
+// dimensionValues gets the values of tn for each enabled dimension, only tag can have more than one
+func (ts *TreeServe) dimensionValues(tn *TreeNode) (values map[string][]string) {
+	values = make(map[string][]string, len(ts.Dimensions))
+	for _, d := range ts.Dimensions {
+		switch d {
+		case dimensionUser:
+			values[d] = []string{strconv.FormatUint(tn.Stats.Uid, 10)}
+		case dimensionGroup:
+			values[d] = []string{strconv.FormatUint(tn.Stats.Gid, 10)}
+		case dimensionTag:
+			for _, t := range ts.GetTags(tn) {
+				if t != "*" {
+					values[d] = append(values[d], t)
+				}
+			}
+		case dimensionVolume:
+			values[d] = []string{volumeOf(tn.Name, ts.VolumeDepth)}
+		case dimensionProject:
+			values[d] = []string{ts.projectOf(tn.Name)}
+		case dimensionFileType:
+			values[d] = []string{fileTypeName(tn.Stats.FileType)}
+		case dimensionSizeClass:
+			values[d] = []string{histogramBucketNames.Size[sizeBucket(tn.Stats.FileSize)]}
+		case dimensionAgeClass:
+			values[d] = []string{histogramBucketNames.Atime[ageBucket(ts.CostReferenceTime-tn.Stats.AccessTime)]}
+		}
+	}
+	return
+}
+
+// volumeOf gets the first depth components of path
+func volumeOf(path string, depth int) string {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) > depth {
+		parts = parts[:depth]
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// tagKey is the key of a under its group and user in /tree output: the tag, followed by the
+// values of any other dimensions
+func (a Aggregates) tagKey() string {
+	if a.Dimensions == "" {
+		return a.Tag
+	}
+	return a.Tag + dimensionSeparator + a.Dimensions
+}
@@ -0,0 +1,90 @@
+package treeserve
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDimensions(t *testing.T) {
+	dimensions, err := ParseDimensions("tag, volume,user")
+	if err != nil || !reflect.DeepEqual(dimensions, []string{"user", "tag", "volume"}) {
+		t.Errorf("Expected dimensions in order, got %v %v", dimensions, err)
+	}
+	if _, err = ParseDimensions("user,colour"); err == nil {
+		t.Errorf("Expected an error for an unknown dimension")
+	}
+	rollups, err := ParseRollups("volume+group,tag", []string{"user", "group", "tag", "volume"})
+	if err != nil || !reflect.DeepEqual(rollups, [][]string{{"group", "volume"}, {"tag"}}) {
+		t.Errorf("Unexpected rollups %v %v", rollups, err)
+	}
+	if _, err = ParseRollups("group+project", []string{"user", "group", "tag"}); err == nil {
+		t.Errorf("Expected an error for a rollup of a dimension that is not enabled")
+	}
+
+	for path, expected := range map[string]string{"/": "/", "/lustre": "/lustre", "/lustre/scratch/a/x.bam": "/lustre/scratch"} {
+		if got := volumeOf(path, 2); got != expected {
+			t.Errorf("Expected the volume of %s to be %s, got %s", path, expected, got)
+		}
+	}
+
+	ts, cleanup := newReadyTestTree(t)
+	defer cleanup()
+	projectFile := filepath.Dir(ts.LMDBPath) + "/projects"
+	err = ioutil.WriteFile(projectFile, []byte("# path project\n/lustre/scratch/a alpha\n/lustre/scratch/ab other\n/lustre beta\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write project file: %v", err)
+	}
+
+	// by default every combination of user, group and tag is kept, as always
+	tn := &TreeNode{Name: "/lustre/scratch/a/x.bam", Stats: NodeStats{Uid: 1, Gid: 10, FileType: 'f'}}
+	if n := len(ts.GetStatMappings(tn).Keys()); n != 4*len(ts.GetTags(tn)) {
+		t.Errorf("Expected %d default mappings, got %d", 4*len(ts.GetTags(tn)), n)
+	}
+
+	ts.Projects, err = LoadProjectFile(projectFile)
+	if err != nil {
+		t.Fatalf("failed to load project file: %v", err)
+	}
+	for path, expected := range map[string]string{"/lustre/scratch/a/x.bam": "alpha", "/lustre/scratch/b": "beta", "/nfs": noProject} {
+		if got := ts.projectOf(path); got != expected {
+			t.Errorf("Expected the project of %s to be %s, got %s", path, expected, got)
+		}
+	}
+
+	ts.Dimensions = []string{"group", "project", "filetype"}
+	ts.Rollups = [][]string{{"group", "project"}, {"filetype"}}
+	err = ts.Finalize("/", 2)
+	if err != nil {
+		t.Fatalf("failed to finalize: %v", err)
+	}
+	mappings := ts.GetStatMappings(tn).Values()
+	if len(mappings) != 3 {
+		t.Errorf("Expected 3 mappings, got %+v", mappings)
+	}
+
+	ft := getTestTree(t, ts, "path=/lustre/scratch&depth=0")
+	for _, c := range []struct {
+		group, tag, count string
+	}{
+		{"*", "*", "7"},
+		{"10", "*;project=alpha", "3"},
+		{"20", "*;project=beta", "3"},
+		{"*", "*;filetype=file", "3"},
+		{"*", "*;filetype=directory", "4"},
+	} {
+		if got := ft.Tree.Data.Count[c.group]["*"][c.tag]; got != c.count {
+			t.Errorf("Expected count %s for group %s tag %s, got %s", c.count, c.group, c.tag, got)
+		}
+	}
+	if _, ok := ft.Tree.Data.Count["10"]["*"]["*"]; ok {
+		t.Errorf("Expected no rollup of group alone, got %v", ft.Tree.Data.Count)
+	}
+
+	verifyTestTree(t, ts, "the tree with other dimensions")
+	info, err := ts.GetBuildInfo()
+	if err != nil || !reflect.DeepEqual(info.Rollups, []string{"group+project", "filetype"}) {
+		t.Errorf("Expected the rollups in the build info, got %+v %v", info, err)
+	}
+}
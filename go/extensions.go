@@ -0,0 +1,222 @@
+package treeserve
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// defaultTopExtensions is how many file extensions are kept for each directory
+const defaultTopExtensions = 20
+
+// extensionsKeptFactor is how many times M extensions a census keeps while it is merged up the
+// tree, so that an extension just outside the M largest in each subdirectory can still be among
+// the M largest above them. Only the M largest are saved.
+const extensionsKeptFactor = 10
+
+// noExtension is what files without an extension are counted under
+const noExtension = "(none)"
+
+// compressionExtensions are kept together with the extension before them, eg. vcf.gz
+var compressionExtensions = map[string]bool{"gz": true, "bgz": true, "bz2": true, "xz": true, "zst": true}
+
+// fileExtension gets the lower cased extension of the file at path
+func fileExtension(path string) string {
+	name := strings.ToLower(filepath.Base(path))
+	parts := strings.Split(strings.TrimLeft(name, "."), ".")
+	if len(parts) < 2 {
+		return noExtension
+	}
+	ext := parts[len(parts)-1]
+	if compressionExtensions[ext] && len(parts) > 2 {
+		ext = parts[len(parts)-2] + "." + ext
+	}
+	return ext
+}
+
+// extensionCount is the number and size of the files with an extension
+type extensionCount struct {
+	Extension string `json:"extension,omitempty"`
+	Count     uint64 `json:"count"`
+	Size      uint64 `json:"size"`
+}
+
+// ExtensionCensus is kept for each directory by Finalize: the number and size of the files under
+// it with each of the M extensions with the most bytes, largest first, and of the rest together.
+// While it is merged up the tree a census keeps extensionsKeptFactor times M extensions, and an
+// extension left in Other below a directory stays there above it, so the census is approximate
+// only where a subtree has more extensions than that.
+type ExtensionCensus struct {
+	M          int              `json:"m"`
+	Extensions []extensionCount `json:"extensions"`
+	Other      extensionCount   `json:"other"`
+}
+
+func (ts *TreeServe) newExtensionCensus() *ExtensionCensus {
+	return &ExtensionCensus{M: ts.TopExtensions}
+}
+
+// MarshalBinary encodes ec as JSON for LMDB storage
+func (ec *ExtensionCensus) MarshalBinary() (data []byte, err error) {
+	data, err = json.Marshal(ec)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to marshal extension census")
+	}
+	return
+}
+
+func (ec *ExtensionCensus) UnmarshalBinary(data []byte) (err error) {
+	err = json.Unmarshal(data, ec)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to unmarshal extension census")
+	}
+	return
+}
+
+// merge adds others, the censuses of the children of a directory, to ec, largest first, folding
+// all but the extensionsKeptFactor*M largest extensions into Other
+func (ec *ExtensionCensus) merge(others []*ExtensionCensus) {
+	if ec.M <= 0 {
+		return
+	}
+	counts := make(map[string]*extensionCount)
+	other := ec.Other
+	for _, census := range append([]*ExtensionCensus{ec}, others...) {
+		if census == nil {
+			continue
+		}
+		for _, c := range census.Extensions {
+			existing, ok := counts[c.Extension]
+			if !ok {
+				existing = &extensionCount{Extension: c.Extension}
+				counts[c.Extension] = existing
+			}
+			existing.Count += c.Count
+			existing.Size += c.Size
+		}
+		if census != ec {
+			other.Count += census.Other.Count
+			other.Size += census.Other.Size
+		}
+	}
+
+	extensions := make([]extensionCount, 0, len(counts))
+	for _, c := range counts {
+		extensions = append(extensions, *c)
+	}
+	sort.Slice(extensions, func(i, j int) bool {
+		if extensions[i].Size != extensions[j].Size {
+			return extensions[i].Size > extensions[j].Size
+		}
+		if extensions[i].Count != extensions[j].Count {
+			return extensions[i].Count > extensions[j].Count
+		}
+		return extensions[i].Extension < extensions[j].Extension
+	})
+	ec.Extensions, ec.Other = foldExtensions(extensions, ec.M*extensionsKeptFactor, other)
+}
+
+// top gets the census of the M largest extensions in ec, which has been merged, with the rest
+// folded into Other
+func (ec *ExtensionCensus) top() *ExtensionCensus {
+	extensions, other := foldExtensions(ec.Extensions, ec.M, ec.Other)
+	return &ExtensionCensus{M: ec.M, Extensions: extensions, Other: other}
+}
+
+// foldExtensions adds all but the first n of extensions to other
+func foldExtensions(extensions []extensionCount, n int, other extensionCount) ([]extensionCount, extensionCount) {
+	if len(extensions) <= n {
+		return extensions, other
+	}
+	for _, c := range extensions[n:] {
+		other.Count += c.Count
+		other.Size += c.Size
+	}
+	return extensions[:n], other
+}
+
+// addFile counts a file in ec. The count is added as it is, which can leave more than
+// extensionsKeptFactor*M extensions until ec is merged into the census of the directory above.
+func (ec *ExtensionCensus) addFile(treeNode *TreeNode) {
+	if ec.M <= 0 || treeNode.Stats.FileType != 'f' {
+		return
+	}
+	ext := fileExtension(treeNode.Name)
+	for i := range ec.Extensions {
+		if ec.Extensions[i].Extension == ext {
+			ec.Extensions[i].Count++
+			ec.Extensions[i].Size += treeNode.Stats.FileSize
+			return
+		}
+	}
+	ec.Extensions = append(ec.Extensions, extensionCount{Extension: ext, Count: 1, Size: treeNode.Stats.FileSize})
+}
+
+// saveExtensionCensus saves the M largest extensions of the merged census for the directory at node
+func (ts *TreeServe) saveExtensionCensus(node *Md5Key, ec *ExtensionCensus) (err error) {
+	if ec.M <= 0 {
+		return
+	}
+	err = ts.ExtensionsDB.Add(node, ec.top(), true)
+	if err != nil {
+		LogError(err)
+	}
+	return
+}
+
+// getExtensionCensus gets the census saved for the directory at nodeKey, which is empty if it has
+// no files under it
+func (ts *TreeServe) getExtensionCensus(nodeKey *Md5Key) (ec *ExtensionCensus, err error) {
+	data, err := ts.ExtensionsDB.Get(nodeKey)
+	if lmdb.IsNotFound(err) {
+		return &ExtensionCensus{Extensions: []extensionCount{}}, nil
+	}
+	if err != nil {
+		return
+	}
+	ec = data.(*ExtensionCensus)
+	return
+}
+
+// extensionsResponse is the body of a /api/v2/extensions response
+type extensionsResponse struct {
+	Date       string           `json:"date"` // when the input the tree was built from was made
+	Path       string           `json:"path"`
+	M          int              `json:"m"`
+	Extensions []extensionCount `json:"extensions"`
+	Other      extensionCount   `json:"other"`
+}
+
+// extensions handles requests of the form <url>/api/v2/extensions?path=/lustre/scratch115, for the
+// number and size of the files under path with each of the most common extensions. The census is
+// of every group, so it is not given to users who can only see some.
+func (ts *TreeServe) extensions(w http.ResponseWriter, r *http.Request) *APIError {
+	path, _, apiErr := queryParameters(r)
+	if apiErr != nil {
+		return apiErr
+	}
+	if p := principalFor(r); p != nil && !p.all {
+		return &APIError{Status: http.StatusForbidden, Code: errorForbidden, Path: path,
+			Message: "the extension census is of every group, which " + p.user + " cannot see"}
+	}
+	nodeKey, apiErr := ts.visibleNodeKey(r, path)
+	if apiErr != nil {
+		return apiErr
+	}
+	ec, err := ts.getExtensionCensus(nodeKey)
+	if err != nil {
+		return internalError(path, err)
+	}
+
+	j, err := json.Marshal(extensionsResponse{Date: ts.scanDate.String(), Path: path, M: ec.M, Extensions: ec.Extensions, Other: ec.Other})
+	if err != nil {
+		return internalError(path, err)
+	}
+	writeJSON(w, j)
+	return nil
+}
@@ -0,0 +1,101 @@
+package treeserve
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExtensions(t *testing.T) {
+	for path, expected := range map[string]string{
+		"/a/x.BAM":         "bam",
+		"/a/calls.vcf.gz":  "vcf.gz",
+		"/a/archive.gz":    "gz",
+		"/a/.bashrc":       noExtension,
+		"/a/README":        noExtension,
+		"/a/b.c/d.tar.bz2": "tar.bz2",
+	} {
+		if got := fileExtension(path); got != expected {
+			t.Errorf("Expected the extension of %s to be %s, got %s", path, expected, got)
+		}
+	}
+
+	ec := &ExtensionCensus{M: 2, Extensions: []extensionCount{{"bam", 1, 100}}, Other: extensionCount{Count: 1, Size: 1}}
+	ec.merge([]*ExtensionCensus{
+		{Extensions: []extensionCount{{"bam", 1, 50}, {"txt", 2, 20}}},
+		{Extensions: []extensionCount{{"cram", 1, 300}}, Other: extensionCount{Count: 3, Size: 3}},
+	})
+	if len(ec.Extensions) != 3 || ec.Extensions[0] != (extensionCount{"cram", 1, 300}) || ec.Extensions[1] != (extensionCount{"bam", 2, 150}) ||
+		ec.Extensions[2] != (extensionCount{"txt", 2, 20}) || ec.Other != (extensionCount{Count: 4, Size: 4}) {
+		t.Errorf("Unexpected merged census %+v", ec)
+	}
+	top := ec.top()
+	if len(top.Extensions) != 2 || top.Extensions[1] != (extensionCount{"bam", 2, 150}) || top.Other != (extensionCount{Count: 6, Size: 24}) {
+		t.Errorf("Unexpected top of merged census %+v", top)
+	}
+	// files are counted as they are and only folded into Other when merged
+	ec = &ExtensionCensus{M: 1}
+	for _, name := range []string{"/a/x.bam", "/a/y.txt", "/a/z.bam"} {
+		ec.addFile(&TreeNode{Name: name, Stats: NodeStats{FileType: 'f', FileSize: 10}})
+	}
+	if len(ec.Extensions) != 2 || ec.Extensions[0] != (extensionCount{"bam", 2, 20}) || ec.Extensions[1] != (extensionCount{"txt", 1, 10}) {
+		t.Errorf("Unexpected census of files %+v", ec)
+	}
+	parent := &ExtensionCensus{M: 1}
+	parent.merge([]*ExtensionCensus{ec})
+	top = parent.top()
+	if len(top.Extensions) != 1 || top.Extensions[0] != (extensionCount{"bam", 2, 20}) || top.Other != (extensionCount{Count: 1, Size: 10}) {
+		t.Errorf("Unexpected merged census of files %+v", top)
+	}
+	// an extension just outside the M largest of every child is still the largest above them
+	parent = &ExtensionCensus{M: 1}
+	parent.merge([]*ExtensionCensus{
+		{M: 1, Extensions: []extensionCount{{"bam", 1, 100}, {"txt", 1, 60}}},
+		{M: 1, Extensions: []extensionCount{{"cram", 1, 100}, {"txt", 1, 60}}},
+	})
+	if top = parent.top(); len(top.Extensions) != 1 || top.Extensions[0] != (extensionCount{"txt", 2, 120}) || top.Other != (extensionCount{Count: 2, Size: 200}) {
+		t.Errorf("Expected txt to be the largest extension, got %+v", top)
+	}
+
+	ts, cleanup := newReadyTestTree(t)
+	defer cleanup()
+
+	get := func(path string, p *principal) (response extensionsResponse, code int) {
+		r := httptest.NewRequest("GET", apiPrefix+"/extensions?path="+path, nil)
+		if p != nil {
+			r = r.WithContext(context.WithValue(r.Context(), principalContextKey{}, p))
+		}
+		w := httptest.NewRecorder()
+		ts.apiHandler(ts.extensions)(w, r)
+		if w.Code == 200 {
+			err := json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatalf("failed to unmarshal %s: %v", w.Body.String(), err)
+			}
+		}
+		return response, w.Code
+	}
+
+	response, code := get("/lustre/scratch", nil)
+	if code != 200 || response.M != defaultTopExtensions || len(response.Extensions) != 3 ||
+		response.Extensions[0] != (extensionCount{"cram", 1, 300}) || response.Extensions[2] != (extensionCount{"bam", 1, 100}) {
+		t.Errorf("Unexpected census of /lustre/scratch %d %+v", code, response)
+	}
+	response, code = get("/lustre/scratch/b/c", nil)
+	if code != 200 || len(response.Extensions) != 1 || response.Extensions[0].Extension != "cram" {
+		t.Errorf("Unexpected census of /lustre/scratch/b/c %d %+v", code, response)
+	}
+	if _, code = get("/lustre/scratch/a/x.bam", nil); code != 200 {
+		t.Errorf("Expected an empty census for a file, got %d", code)
+	}
+	if _, code = get("/lustre/nothere", nil); code != 404 {
+		t.Errorf("Expected 404 for a path not in the tree, got %d", code)
+	}
+	if _, code = get("/lustre/scratch", &principal{user: "u1", scopes: []idScope{{gids: map[string]bool{"10": true}}}}); code != 403 {
+		t.Errorf("Expected 403 for a user who cannot see every group, got %d", code)
+	}
+	if _, code = get("/lustre/scratch", &principal{user: "admin", all: true}); code != 200 {
+		t.Errorf("Expected an admin to get the census, got %d", code)
+	}
+}
@@ -0,0 +1,101 @@
+package treeserve
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Extremes are the oldest and newest atime, mtime and ctime of the files and directories in a set
+// of aggregates, in seconds since the epoch, and the size of the largest file
+type Extremes struct {
+	AtimeMin    int64  `json:"atime_min"`
+	AtimeMax    int64  `json:"atime_max"`
+	MtimeMin    int64  `json:"mtime_min"`
+	MtimeMax    int64  `json:"mtime_max"`
+	CtimeMin    int64  `json:"ctime_min"`
+	CtimeMax    int64  `json:"ctime_max"`
+	MaxFileSize uint64 `json:"max_file_size"`
+}
+
+// extremesBytes is the length of the binary encoding of Extremes
+const extremesBytes = 7 * 8
+
+// NewExtremes returns a pointer to zero Extremes
+func NewExtremes() *Extremes {
+	return &Extremes{}
+}
+
+// newNodeExtremes makes the extremes of a single file or directory
+func newNodeExtremes(stats NodeStats) *Extremes {
+	e := &Extremes{
+		AtimeMin: stats.AccessTime, AtimeMax: stats.AccessTime,
+		MtimeMin: stats.ModificationTime, MtimeMax: stats.ModificationTime,
+		CtimeMin: stats.ChangeTime, CtimeMax: stats.ChangeTime,
+	}
+	if stats.FileType == 'f' {
+		e.MaxFileSize = stats.FileSize
+	}
+	return e
+}
+
+// mergeExtremes makes new extremes covering both a and b, either of which can be nil
+func mergeExtremes(a, b *Extremes) *Extremes {
+	if a == nil || b == nil {
+		if a == nil {
+			a = b
+		}
+		if a == nil {
+			return nil
+		}
+		e := *a
+		return &e
+	}
+	minInt := func(x, y int64) int64 {
+		if x < y {
+			return x
+		}
+		return y
+	}
+	maxInt := func(x, y int64) int64 {
+		if x > y {
+			return x
+		}
+		return y
+	}
+	e := &Extremes{
+		AtimeMin:    minInt(a.AtimeMin, b.AtimeMin),
+		AtimeMax:    maxInt(a.AtimeMax, b.AtimeMax),
+		MtimeMin:    minInt(a.MtimeMin, b.MtimeMin),
+		MtimeMax:    maxInt(a.MtimeMax, b.MtimeMax),
+		CtimeMin:    minInt(a.CtimeMin, b.CtimeMin),
+		CtimeMax:    maxInt(a.CtimeMax, b.CtimeMax),
+		MaxFileSize: a.MaxFileSize,
+	}
+	if b.MaxFileSize > e.MaxFileSize {
+		e.MaxFileSize = b.MaxFileSize
+	}
+	return e
+}
+
+// MarshalBinary returns the values in order as little endian 64 bit integers for LMDB storage
+func (e *Extremes) MarshalBinary() (data []byte, err error) {
+	data = make([]byte, extremesBytes)
+	b := data
+	for _, v := range []int64{e.AtimeMin, e.AtimeMax, e.MtimeMin, e.MtimeMax, e.CtimeMin, e.CtimeMax, int64(e.MaxFileSize)} {
+		binary.LittleEndian.PutUint64(b, uint64(v))
+		b = b[8:]
+	}
+	return
+}
+
+func (e *Extremes) UnmarshalBinary(data []byte) (err error) {
+	if len(data) != extremesBytes {
+		return fmt.Errorf("extremes are %d bytes, expected %d", len(data), extremesBytes)
+	}
+	for _, v := range []*int64{&e.AtimeMin, &e.AtimeMax, &e.MtimeMin, &e.MtimeMax, &e.CtimeMin, &e.CtimeMax} {
+		*v = int64(binary.LittleEndian.Uint64(data))
+		data = data[8:]
+	}
+	e.MaxFileSize = binary.LittleEndian.Uint64(data)
+	return
+}
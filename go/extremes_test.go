@@ -0,0 +1,47 @@
+package treeserve
+
+import "testing"
+
+func TestExtremes(t *testing.T) {
+	dir := newNodeExtremes(NodeStats{FileSize: 4096, AccessTime: 300, ModificationTime: 200, ChangeTime: 100, FileType: 'd'})
+	if dir.MaxFileSize != 0 {
+		t.Errorf("Expected a directory not to count as a file, got %+v", dir)
+	}
+	file := newNodeExtremes(NodeStats{FileSize: 10, AccessTime: 50, ModificationTime: 400, ChangeTime: 100, FileType: 'f'})
+	e := mergeExtremes(dir, file)
+	if *e != (Extremes{AtimeMin: 50, AtimeMax: 300, MtimeMin: 200, MtimeMax: 400, CtimeMin: 100, CtimeMax: 100, MaxFileSize: 10}) {
+		t.Errorf("Unexpected merged extremes %+v", e)
+	}
+	if e2 := mergeExtremes(nil, file); e2 == file || *e2 != *file {
+		t.Errorf("Expected a copy of %+v, got %+v", file, e2)
+	}
+
+	data, err := e.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to marshal extremes: %v", err)
+	}
+	e2 := NewExtremes()
+	err = e2.UnmarshalBinary(data)
+	if err != nil || *e2 != *e {
+		t.Errorf("Expected %+v back, got %+v %v", e, e2, err)
+	}
+
+	ts, cleanup := newReadyTestTree(t)
+	defer cleanup()
+
+	ft := getTestTree(t, ts, "path=/lustre/scratch&depth=0")
+	for _, c := range []struct {
+		group    string
+		expected Extremes
+	}{
+		{"*", Extremes{AtimeMin: 500, AtimeMax: 1500, MtimeMin: 500, MtimeMax: 1500, CtimeMin: 500, CtimeMax: 1500, MaxFileSize: 300}},
+		{"10", Extremes{AtimeMin: 500, AtimeMax: 1000, MtimeMin: 500, MtimeMax: 1000, CtimeMin: 500, CtimeMax: 1000, MaxFileSize: 200}},
+	} {
+		got := ft.Tree.Data.Extremes[c.group]["*"]["*"]
+		if got == nil || *got != c.expected {
+			t.Errorf("Expected extremes of group %s to be %+v, got %+v", c.group, c.expected, got)
+		}
+	}
+
+	verifyTestTree(t, ts, "the tree with extremes")
+}
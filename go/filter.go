@@ -0,0 +1,98 @@
+package treeserve
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// aggregateFilter selects the aggregates to output by group, user and tag. A nil set does not
+// filter on that category. "*" in a set selects the rollup over every group, user or tag, which
+// is otherwise left out when the category is filtered. Aggregates the principal of the request
+// cannot see are always left out.
+type aggregateFilter struct {
+	groups  map[string]bool // gids
+	users   map[string]bool // uids
+	tags    map[string]bool
+	visible *principal
+}
+
+// filterParameters gets the group, user and tag filters from a request. Each can be given more
+// than once or as a comma separated list, and groups and users as names or ids. It returns nil
+// if there is no filter.
+func (ts *TreeServe) filterParameters(r *http.Request, path string) (filter *aggregateFilter, apiErr *APIError) {
+	vals := r.URL.Query()
+	f := aggregateFilter{}
+	var unknown []string
+
+	f.groups, unknown = filterSet(vals["group"], func(name string) (string, bool) { return ts.names.groupID(path, name) })
+	if len(unknown) > 0 {
+		return nil, badRequest(path, "unknown group %s", strings.Join(unknown, ","))
+	}
+	f.users, unknown = filterSet(vals["user"], func(name string) (string, bool) { return ts.names.userID(path, name) })
+	if len(unknown) > 0 {
+		return nil, badRequest(path, "unknown user %s", strings.Join(unknown, ","))
+	}
+	f.tags, _ = filterSet(vals["tag"], nil)
+	if p := principalFor(r); p != nil && !p.all {
+		f.visible = p
+	}
+
+	if f.groups == nil && f.users == nil && f.tags == nil && f.visible == nil {
+		return
+	}
+	filter = &f
+	return
+}
+
+// filterSet makes the set of ids for the values of a query parameter. If nameToID is not nil
+// values are names or numeric ids, and the names it does not know are returned as unknown.
+func filterSet(values []string, nameToID func(name string) (id string, ok bool)) (set map[string]bool, unknown []string) {
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			v = strings.TrimSpace(v)
+			if v == "" {
+				continue
+			}
+			if set == nil {
+				set = make(map[string]bool)
+			}
+			if nameToID == nil || v == "*" {
+				set[v] = true
+				continue
+			}
+			if _, err := strconv.ParseUint(v, 10, 32); err == nil {
+				set[v] = true
+				continue
+			}
+			id, ok := nameToID(v)
+			if !ok {
+				unknown = append(unknown, v)
+				continue
+			}
+			set[id] = true
+		}
+	}
+	return
+}
+
+// matches is true if a set of aggregates of the directory at path passes the filter
+func (f *aggregateFilter) matches(path string, a Aggregates) bool {
+	if f == nil {
+		return true
+	}
+	return (f.groups == nil || f.groups[a.Group]) && (f.users == nil || f.users[a.User]) && (f.tags == nil || f.tags[a.Tag]) && f.visible.sees(path, a)
+}
+
+// apply returns the aggregates of the directory at path that pass the filter
+func (f *aggregateFilter) apply(path string, stats []Aggregates) (filtered []Aggregates) {
+	if f == nil {
+		return stats
+	}
+	for _, a := range stats {
+		if f.matches(path, a) {
+			filtered = append(filtered, a)
+		}
+	}
+	return
+}
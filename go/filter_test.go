@@ -0,0 +1,63 @@
+package treeserve
+
+import "testing"
+
+func TestFilterSet(t *testing.T) {
+	nameToID := func(name string) (id string, ok bool) {
+		id, ok = map[string]string{"hgi": "10", "other": "20"}[name]
+		return
+	}
+
+	set, unknown := filterSet([]string{"hgi,20", "*"}, nameToID)
+	if len(unknown) != 0 {
+		t.Errorf("Expected no unknown names, got %v", unknown)
+	}
+	for _, id := range []string{"10", "20", "*"} {
+		if !set[id] {
+			t.Errorf("Expected %s in set %v", id, set)
+		}
+	}
+
+	_, unknown = filterSet([]string{"nobody"}, nameToID)
+	if len(unknown) != 1 || unknown[0] != "nobody" {
+		t.Errorf("Expected nobody to be unknown, got %v", unknown)
+	}
+
+	set, _ = filterSet(nil, nameToID)
+	if set != nil {
+		t.Errorf("Expected no set without values, got %v", set)
+	}
+}
+
+func TestTreeFilter(t *testing.T) {
+	ts, cleanup := newReadyTestTree(t)
+	defer cleanup()
+
+	ts.names.sources = []*nameSource{{groups: &nameFile{names: newIDNames(map[string]string{"10": "hgi", "20": "other"})}}}
+
+	ft := getTestTree(t, ts, "path=/lustre/scratch&depth=1&group=hgi&tag=*")
+
+	// b belongs to the other group so is pruned
+	var paths []string
+	for _, child := range ft.Tree.ChildDirs {
+		paths = append(paths, child.Path)
+	}
+	if len(paths) != 1 || paths[0] != "/lustre/scratch/a" {
+		t.Errorf("Expected only /lustre/scratch/a, got %v", paths)
+	}
+	for g, users := range ft.Tree.Data.Count {
+		if g != "hgi" {
+			t.Errorf("Expected only group hgi, got %s", g)
+		}
+		for _, tags := range users {
+			for tag := range tags {
+				if tag != "*" {
+					t.Errorf("Expected only tag *, got %s", tag)
+				}
+			}
+		}
+	}
+	if ft.Tree.Data.Count["hgi"]["*"]["*"] != "3" {
+		t.Errorf("Expected count 3 for hgi, got %v", ft.Tree.Data.Count)
+	}
+}
@@ -0,0 +1,289 @@
+package treeserve
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Output formats for /tree. The flat formats have one row per directory and group, user and tag.
+const (
+	formatNested = "nested"
+	formatFlat   = "flat" // a JSON array unless the Accept header asks for one of the others
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+	formatTSV    = "tsv"
+)
+
+// Content types of the flat formats
+var formatContentTypes = map[string]string{
+	formatFlat:   "application/json; charset=utf-8",
+	formatNDJSON: "application/x-ndjson; charset=utf-8",
+	formatCSV:    "text/csv; charset=utf-8",
+	formatTSV:    "text/tab-separated-values; charset=utf-8",
+}
+
+// flatFlushEvery is how many rows are written between flushes to the client
+const flatFlushEvery = 1000
+
+// flatColumns are the columns of the flat formats, in order
+var flatColumns = []string{"path", "parent_path", "depth", "name", "group", "user", "tag", "count", "size", "atime", "mtime", "ctime"}
+
+// flatRow is one set of aggregates for one directory. Depth is the number of levels below the
+// requested path. The numbers are kept as text so they are not rounded.
+type flatRow struct {
+	Path       string      `json:"path"`
+	ParentPath string      `json:"parent_path"`
+	Depth      int         `json:"depth"`
+	Name       string      `json:"name"`
+	Group      string      `json:"group"`
+	User       string      `json:"user"`
+	Tag        string      `json:"tag"`
+	Count      json.Number `json:"count"`
+	Size       json.Number `json:"size"`
+	Atime      json.Number `json:"atime"`
+	Mtime      json.Number `json:"mtime"`
+	Ctime      json.Number `json:"ctime"`
+}
+
+func (row *flatRow) values() []string {
+	return []string{row.Path, row.ParentPath, strconv.Itoa(row.Depth), row.Name, row.Group, row.User, row.Tag,
+		row.Count.String(), row.Size.String(), row.Atime.String(), row.Mtime.String(), row.Ctime.String()}
+}
+
+// formatParameter gets the output format from the format parameter or, for format=flat or no
+// format, from the Accept header
+func formatParameter(r *http.Request, path string) (format string, apiErr *APIError) {
+	format = r.URL.Query().Get("format")
+	switch format {
+	case "", formatNested, formatFlat:
+	case formatNDJSON, formatCSV, formatTSV:
+		return
+	default:
+		return "", badRequest(path, "format must be nested, flat, ndjson, csv or tsv, not %q", format)
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/x-ndjson":
+			return formatNDJSON, nil
+		case "text/csv":
+			return formatCSV, nil
+		case "text/tab-separated-values":
+			return formatTSV, nil
+		}
+	}
+	if format == "" {
+		format = formatNested
+	}
+	return
+}
+
+// rowWriter writes flat rows in one of the formats
+type rowWriter interface {
+	writeRow(row *flatRow) error
+	close() error
+}
+
+type jsonArrayWriter struct {
+	w     *bufio.Writer
+	empty bool
+}
+
+func (jw *jsonArrayWriter) writeRow(row *flatRow) (err error) {
+	j, err := json.Marshal(row)
+	if err != nil {
+		return
+	}
+	if jw.empty {
+		jw.empty = false
+		err = jw.w.WriteByte('[')
+	} else {
+		err = jw.w.WriteByte(',')
+	}
+	if err != nil {
+		return
+	}
+	_, err = jw.w.Write(j)
+	return
+}
+
+func (jw *jsonArrayWriter) close() (err error) {
+	if jw.empty {
+		_, err = jw.w.WriteString("[]\n")
+	} else {
+		_, err = jw.w.WriteString("]\n")
+	}
+	return
+}
+
+type ndjsonWriter struct {
+	encoder *json.Encoder
+}
+
+func (nw *ndjsonWriter) writeRow(row *flatRow) error {
+	return nw.encoder.Encode(row)
+}
+
+func (nw *ndjsonWriter) close() error {
+	return nil
+}
+
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func (cw *csvWriter) writeRow(row *flatRow) error {
+	return cw.w.Write(row.values())
+}
+
+func (cw *csvWriter) close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+// newRowWriter makes a rowWriter for format writing to w
+func newRowWriter(format string, w *bufio.Writer) (rw rowWriter, err error) {
+	switch format {
+	case formatNDJSON:
+		rw = &ndjsonWriter{encoder: json.NewEncoder(w)}
+	case formatCSV, formatTSV:
+		c := csv.NewWriter(w)
+		if format == formatTSV {
+			c.Comma = '\t'
+		}
+		err = c.Write(flatColumns)
+		rw = &csvWriter{w: c}
+	default:
+		rw = &jsonArrayWriter{w: w, empty: true}
+	}
+	return
+}
+
+// flatVisitor writes rows for each directory as a tree is walked
+type flatVisitor struct {
+	ts      *TreeServe
+	rows    rowWriter
+	w       *bufio.Writer
+	limit   *limitedResponse
+	written int
+}
+
+func (fv *flatVisitor) enter(t *dirTree, parent *dirTree, level int) (err error) {
+	err = fv.limit.node()
+	if err != nil {
+		return
+	}
+	path := rowPath(t.Path)
+	parentPath := ""
+	if parent != nil {
+		parentPath = rowPath(parent.Path)
+	} else if path != "/" {
+		parentPath = filepath.Dir(path)
+	}
+
+	stats := make([]Aggregates, 0, len(t.stats))
+	for _, a := range t.stats {
+		if !a.Count.isZero() {
+			stats = append(stats, a)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Group != stats[j].Group {
+			return stats[i].Group < stats[j].Group
+		}
+		if stats[i].User != stats[j].User {
+			return stats[i].User < stats[j].User
+		}
+		return stats[i].tagKey() < stats[j].tagKey()
+	})
+
+	for _, a := range stats {
+		row := flatRow{
+			Path:       path,
+			ParentPath: parentPath,
+			Depth:      level,
+			Name:       t.Name,
+			Group:      fv.ts.lookupGID(path, a.Group),
+			User:       fv.ts.lookupUID(path, a.User),
+			Tag:        a.tagKey(),
+			Count:      json.Number(a.Count.Text(10)),
+			Size:       json.Number(a.Size.Text(10)),
+			Atime:      json.Number(convertstatsForOutput(a.AccessCost)),
+			Mtime:      json.Number(convertstatsForOutput(a.ModifyCost)),
+			Ctime:      json.Number(convertstatsForOutput(a.ChangeCost)),
+		}
+		err = fv.rows.writeRow(&row)
+		if err != nil {
+			return
+		}
+		fv.written++
+		if fv.written%flatFlushEvery == 0 {
+			err = fv.flush()
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// rowPath is the path to output for a directory, the root has an empty path in the tree
+func rowPath(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+func (fv *flatVisitor) leave(t *dirTree, level int) error {
+	return nil
+}
+
+func (fv *flatVisitor) flush() (err error) {
+	err = fv.w.Flush()
+	if err == nil {
+		fv.limit.flush()
+	}
+	return
+}
+
+// writeFlatTree streams the rows for the tree at nodeKey to w in format. An error or a limit
+// reached after the first rows have been sent can only be logged, so the response is cut short.
+func (ts *TreeServe) writeFlatTree(w http.ResponseWriter, nodeKey *Md5Key, path string, depth int, filter *aggregateFilter, arrangement *childArrangement, format string) *APIError {
+	w.Header().Set("Content-Type", formatContentTypes[format])
+	if format == formatCSV || format == formatTSV {
+		_, name := filepath.Split(path)
+		if name == "" {
+			name = "root"
+		}
+		w.Header().Set("Content-Disposition", "inline; filename=\""+name+"."+format+"\"")
+	}
+
+	limit := ts.newLimitedResponse(w)
+	bw := bufio.NewWriter(limit)
+	rows, err := newRowWriter(format, bw)
+	if err != nil {
+		return internalError(path, err)
+	}
+	fv := &flatVisitor{ts: ts, rows: rows, w: bw, limit: limit}
+
+	err = ts.walkTree(nodeKey, depth, filter, arrangement, fv)
+	if err == nil {
+		err = rows.close()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	return limit.finish(path, err)
+}
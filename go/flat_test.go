@@ -0,0 +1,90 @@
+package treeserve
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFlatTree(t *testing.T) {
+	ts, cleanup := newReadyTestTree(t)
+	defer cleanup()
+
+	get := func(query string, accept string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", apiPrefix+"/tree?path=/lustre&depth=3&"+query, nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		ts.apiHandler(ts.tree)(w, r)
+		return w
+	}
+
+	// every count in the nested tree is in a flat row
+	nestedCounts := make(map[string]string)
+	var addCounts func(d *dirTree)
+	addCounts = func(d *dirTree) {
+		for g, users := range d.Data.Count {
+			for u, tags := range users {
+				for tag, count := range tags {
+					nestedCounts[rowPath(d.Path)+"|"+g+"|"+u+"|"+tag] = count
+				}
+			}
+		}
+		for _, child := range d.ChildDirs {
+			addCounts(child)
+		}
+	}
+	var ft fullTree
+	err := json.Unmarshal(get("", "").Body.Bytes(), &ft)
+	if err != nil {
+		t.Fatalf("failed to unmarshal nested tree: %v", err)
+	}
+	addCounts(&ft.Tree)
+
+	w := get("", "application/x-ndjson")
+	if w.Header().Get("Content-Type") != formatContentTypes[formatNDJSON] {
+		t.Errorf("Expected ndjson from Accept header, got %s", w.Header().Get("Content-Type"))
+	}
+	flatCounts := make(map[string]string)
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var row flatRow
+		err = json.Unmarshal(scanner.Bytes(), &row)
+		if err != nil {
+			t.Fatalf("failed to unmarshal row %s: %v", scanner.Text(), err)
+		}
+		if row.Path == "/lustre/scratch/b/c" && (row.ParentPath != "/lustre/scratch/b" || row.Depth != 3) {
+			t.Errorf("Expected /lustre/scratch/b/c to have parent /lustre/scratch/b at depth 3, got %s %d", row.ParentPath, row.Depth)
+		}
+		flatCounts[row.Path+"|"+row.Group+"|"+row.User+"|"+row.Tag] = row.Count.String()
+	}
+	if len(flatCounts) != len(nestedCounts) {
+		t.Errorf("Expected %d flat rows, got %d", len(nestedCounts), len(flatCounts))
+	}
+	for k, count := range nestedCounts {
+		if flatCounts[k] != count {
+			t.Errorf("%s: expected count %s, got %s", k, count, flatCounts[k])
+		}
+	}
+
+	// the same rows as a JSON array and CSV
+	var rows []flatRow
+	err = json.Unmarshal(get("format=flat", "").Body.Bytes(), &rows)
+	if err != nil {
+		t.Fatalf("failed to unmarshal flat JSON: %v", err)
+	}
+	if len(rows) != len(flatCounts) {
+		t.Errorf("Expected %d rows in JSON array, got %d", len(flatCounts), len(rows))
+	}
+	records, err := csv.NewReader(bytes.NewReader(get("format=csv", "").Body.Bytes())).ReadAll()
+	if err != nil {
+		t.Fatalf("failed to read CSV: %v", err)
+	}
+	if len(records) != len(flatCounts)+1 || records[0][0] != "path" {
+		t.Errorf("Expected header and %d CSV rows, got %d", len(flatCounts), len(records))
+	}
+}
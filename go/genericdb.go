@@ -26,7 +26,7 @@ func (gdb *GenericDB) Add(key encoding.BinaryMarshaler, data BinaryMarshalUnmars
 			"err": err,
 		}).Error("could not marshal data")
 	}
-	err = ts.LMDBEnv.Update(func(txn *lmdb.Txn) (err error) {
+	err = ts.update(func(txn *lmdb.Txn) (err error) {
 		if !overwrite {
 			// check if node already exists
 			_, err = txn.Get(gdb.DBI, keyBytes)
@@ -41,7 +41,10 @@ func (gdb *GenericDB) Add(key encoding.BinaryMarshaler, data BinaryMarshalUnmars
 			//return  no it's OK here
 		}
 		err = txn.Put(gdb.DBI, keyBytes, dataBytes, 0)
-		if err != nil {
+		if lmdb.IsMapFull(err) {
+			// the map is grown and the transaction retried by ts.update
+			return
+		} else if err != nil {
 			log.WithFields(log.Fields{
 				"gdb":      gdb,
 				"keyBytes": keyBytes,
@@ -72,7 +75,7 @@ func (gdb *GenericDB) Update(key encoding.BinaryMarshaler, update UpdateData) (e
 	var existing BinaryMarshalUnmarshaler
 	var updated BinaryMarshalUnmarshaler
 
-	err = ts.LMDBEnv.Update(func(txn *lmdb.Txn) (err error) {
+	err = ts.update(func(txn *lmdb.Txn) (err error) {
 		existingBytes, err := txn.Get(gdb.DBI, keyBytes)
 		if lmdb.IsNotFound(err) {
 			if ts.Debug {
@@ -142,7 +145,9 @@ func (gdb *GenericDB) Update(key encoding.BinaryMarshaler, update UpdateData) (e
 			return
 		}
 		err = txn.Put(gdb.DBI, keyBytes, updatedBytes, 0)
-		if err != nil {
+		if lmdb.IsMapFull(err) {
+			return
+		} else if err != nil {
 			log.WithFields(log.Fields{
 				"keyBytes":     keyBytes,
 				"updatedBytes": updatedBytes,
@@ -162,6 +167,56 @@ func (gdb *GenericDB) Update(key encoding.BinaryMarshaler, update UpdateData) (e
 	return
 }
 
+// Replace adds data under key, overwriting what is there, and gets what was there before in the
+// same transaction, nil if there was nothing
+func (gdb *GenericDB) Replace(key encoding.BinaryMarshaler, data BinaryMarshalUnmarshaler) (previous BinaryMarshalUnmarshaler, err error) {
+	ts := gdb.TS
+	keyBytes, err := key.MarshalBinary()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("could not marshal key")
+		return
+	}
+	dataBytes, err := data.MarshalBinary()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("could not marshal data")
+		return
+	}
+	err = ts.update(func(txn *lmdb.Txn) (err error) {
+		previous = nil
+		previousBytes, err := txn.Get(gdb.DBI, keyBytes)
+		if err == nil {
+			previous = gdb.NewData()
+			err = previous.UnmarshalBinary(previousBytes)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"err":           err,
+					"previousBytes": previousBytes,
+				}).Error("failed to unmarshal data being replaced")
+				return
+			}
+		} else if !lmdb.IsNotFound(err) {
+			return
+		}
+		err = txn.Put(gdb.DBI, keyBytes, dataBytes, 0)
+		if lmdb.IsMapFull(err) {
+			// the map is grown and the transaction retried by ts.update
+			return
+		} else if err != nil {
+			log.WithFields(log.Fields{
+				"gdb":      gdb,
+				"keyBytes": keyBytes,
+				"err":      err,
+			}).Error("failed to replace entry in database")
+		}
+		return
+	})
+	return
+}
+
 func (gdb *GenericDB) Get(key encoding.BinaryMarshaler) (data BinaryMarshalUnmarshaler, err error) {
 	ts := gdb.TS
 	keyBytes, err := key.MarshalBinary()
@@ -173,7 +228,7 @@ func (gdb *GenericDB) Get(key encoding.BinaryMarshaler) (data BinaryMarshalUnmar
 	}
 	var dataBytes []byte
 	data = gdb.NewData()
-	err = ts.LMDBEnv.View(func(txn *lmdb.Txn) (err error) {
+	err = ts.view(func(txn *lmdb.Txn) (err error) {
 		dataBytes, err = txn.Get(gdb.DBI, keyBytes)
 		return
 	})
@@ -208,7 +263,7 @@ func (gdb *GenericDB) Exists(key encoding.BinaryMarshaler) (exists bool, err err
 		}).Error("could not marshal key")
 		return
 	}
-	err = ts.LMDBEnv.View(func(txn *lmdb.Txn) (err error) {
+	err = ts.view(func(txn *lmdb.Txn) (err error) {
 		_, err = txn.Get(gdb.DBI, keyBytes)
 		return
 	})
@@ -0,0 +1,122 @@
+package treeserve
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// histogramBuckets is how many buckets each histogram has. A value goes in the first bucket whose
+// bound it is under, or the last if it is under none.
+const histogramBuckets = 6
+
+const secondsInDay = 24 * 60 * 60
+
+// ageBucketBounds are the upper bounds in seconds of the atime age buckets
+var ageBucketBounds = [histogramBuckets - 1]int64{7 * secondsInDay, 30 * secondsInDay, 182 * secondsInDay, 365 * secondsInDay, 3 * 365 * secondsInDay}
+
+// sizeBucketBounds are the upper bounds in bytes of the file size buckets
+var sizeBucketBounds = [histogramBuckets - 1]uint64{4 << 10, 1 << 20, 64 << 20, 1 << 30, 16 << 30}
+
+// HistogramBuckets names the buckets of the histograms, in order
+type HistogramBuckets struct {
+	Atime []string `json:"atime"`
+	Size  []string `json:"size"`
+}
+
+var histogramBucketNames = HistogramBuckets{
+	Atime: []string{"<1w", "<1m", "<6m", "<1y", "<3y", ">=3y"},
+	Size:  []string{"<4KiB", "<1MiB", "<64MiB", "<1GiB", "<16GiB", ">=16GiB"},
+}
+
+// Histograms are the bytes and number of files and directories in each bucket of time since they
+// were last accessed and of size. Ages are from the cost reference time, so those accessed after
+// it are in the first bucket.
+type Histograms struct {
+	AtimeBytes [histogramBuckets]uint64 `json:"atime_bytes"`
+	AtimeCount [histogramBuckets]uint64 `json:"atime_count"`
+	SizeBytes  [histogramBuckets]uint64 `json:"size_bytes"`
+	SizeCount  [histogramBuckets]uint64 `json:"size_count"`
+}
+
+// NewHistograms returns a pointer to empty Histograms
+func NewHistograms() *Histograms {
+	return &Histograms{}
+}
+
+// ageBucket gets the index of the atime age bucket age seconds goes in
+func ageBucket(age int64) (a int) {
+	for a < len(ageBucketBounds) && age >= ageBucketBounds[a] {
+		a++
+	}
+	return
+}
+
+// sizeBucket gets the index of the size bucket size bytes goes in
+func sizeBucket(size uint64) (s int) {
+	for s < len(sizeBucketBounds) && size >= sizeBucketBounds[s] {
+		s++
+	}
+	return
+}
+
+// newNodeHistograms makes the histograms of a single file or directory
+func newNodeHistograms(size uint64, age int64) *Histograms {
+	h := NewHistograms()
+	a := ageBucket(age)
+	s := sizeBucket(size)
+	h.AtimeBytes[a] = size
+	h.AtimeCount[a] = 1
+	h.SizeBytes[s] = size
+	h.SizeCount[s] = 1
+	return h
+}
+
+// Add adds the buckets of x to h
+func (h *Histograms) Add(x *Histograms) {
+	if x == nil {
+		return
+	}
+	for i := 0; i < histogramBuckets; i++ {
+		h.AtimeBytes[i] += x.AtimeBytes[i]
+		h.AtimeCount[i] += x.AtimeCount[i]
+		h.SizeBytes[i] += x.SizeBytes[i]
+		h.SizeCount[i] += x.SizeCount[i]
+	}
+}
+
+// sumHistograms makes new histograms with the buckets of a and b, either of which can be nil
+func sumHistograms(a, b *Histograms) *Histograms {
+	if a == nil && b == nil {
+		return nil
+	}
+	h := NewHistograms()
+	h.Add(a)
+	h.Add(b)
+	return h
+}
+
+// MarshalBinary returns the buckets in order as little endian uint64s for LMDB storage
+func (h *Histograms) MarshalBinary() (data []byte, err error) {
+	data = make([]byte, 4*histogramBuckets*8)
+	b := data
+	for _, buckets := range [][histogramBuckets]uint64{h.AtimeBytes, h.AtimeCount, h.SizeBytes, h.SizeCount} {
+		for _, v := range buckets {
+			binary.LittleEndian.PutUint64(b, v)
+			b = b[8:]
+		}
+	}
+	return
+}
+
+func (h *Histograms) UnmarshalBinary(data []byte) (err error) {
+	if len(data) != 4*histogramBuckets*8 {
+		return fmt.Errorf("histograms are %d bytes, expected %d", len(data), 4*histogramBuckets*8)
+	}
+	for _, buckets := range []*[histogramBuckets]uint64{&h.AtimeBytes, &h.AtimeCount, &h.SizeBytes, &h.SizeCount} {
+		for i := range buckets {
+			buckets[i] = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		}
+	}
+	return
+}
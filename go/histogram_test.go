@@ -0,0 +1,72 @@
+package treeserve
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHistograms(t *testing.T) {
+	for _, c := range []struct {
+		size      uint64
+		age       int64
+		atime, sz int
+	}{
+		{100, 1000, 0, 0},
+		{100, -1000, 0, 0},
+		{4096, 7 * secondsInDay, 1, 1},
+		{2 << 30, 400 * secondsInDay, 4, 4},
+		{64 << 30, 10 * 365 * secondsInDay, 5, 5},
+	} {
+		h := newNodeHistograms(c.size, c.age)
+		if h.AtimeBytes[c.atime] != c.size || h.AtimeCount[c.atime] != 1 || h.SizeBytes[c.sz] != c.size || h.SizeCount[c.sz] != 1 {
+			t.Errorf("Expected size %d age %d in buckets %d and %d, got %+v", c.size, c.age, c.atime, c.sz, h)
+		}
+	}
+
+	h := sumHistograms(newNodeHistograms(1, 0), newNodeHistograms(1<<20, 200*secondsInDay))
+	data, err := h.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to marshal histograms: %v", err)
+	}
+	h2 := NewHistograms()
+	err = h2.UnmarshalBinary(data)
+	if err != nil || *h2 != *h {
+		t.Errorf("Expected %+v back, got %+v %v", h, h2, err)
+	}
+	if h2.UnmarshalBinary(data[1:]) == nil {
+		t.Errorf("Expected an error unmarshalling too few bytes")
+	}
+
+	ts, cleanup := newReadyTestTree(t)
+	defer cleanup()
+
+	ft := getTestTree(t, ts, "path=/lustre/scratch&depth=0")
+	all := ft.Tree.Data.Histograms["*"]["*"]["*"]
+	if all == nil {
+		t.Fatalf("Expected histograms in %+v", ft.Tree.Data)
+	}
+	// everything was accessed within a week of the cost reference time
+	var bytes uint64
+	for _, b := range all.AtimeBytes {
+		bytes += b
+	}
+	if strconv.FormatUint(bytes, 10) != ft.Tree.Data.Size["*"]["*"]["*"] || strconv.FormatUint(all.AtimeCount[0], 10) != ft.Tree.Data.Count["*"]["*"]["*"] {
+		t.Errorf("Expected the atime histogram to add up to the size and count, got %+v", all)
+	}
+	// three files and four directories
+	if all.SizeCount[0] != 3 || all.SizeCount[1] != 4 || all.SizeBytes[0] != 600 {
+		t.Errorf("Unexpected size histogram %+v", all)
+	}
+	// a file's histograms would only be of itself, so are not kept
+	file, err := ts.retrieveAggregates(ts.getPathKey("/lustre/scratch/a/x.bam"))
+	if err != nil || len(file) == 0 {
+		t.Fatalf("failed to get aggregates of a file: %v", err)
+	}
+	for _, a := range file {
+		if a.Histograms != nil || a.Extremes != nil {
+			t.Errorf("Expected no histograms or extremes for a file, got %+v %+v", a.Histograms, a.Extremes)
+		}
+	}
+
+	verifyTestTree(t, ts, "the tree with histograms")
+}
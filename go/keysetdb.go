@@ -55,7 +55,7 @@ func (ksdb *KeySetDB) AddKeyToKeySet(key encoding.BinaryMarshaler, setkey encodi
 			"setkeyBytes": setkeyBytes,
 		}).Debug("AddKeyToKeySet calling Update")
 	}
-	err = ts.LMDBEnv.Update(func(txn *lmdb.Txn) (err error) {
+	err = ts.update(func(txn *lmdb.Txn) (err error) {
 		err = txn.Put(ksdb.DBI, keyBytes, setkeyBytes, lmdb.NoDupData)
 		return
 	})
@@ -98,7 +98,7 @@ func (ksdb *KeySetDB) GetKeySet(key encoding.BinaryMarshaler) (keySetKeys []enco
 			"err": err,
 		}).Error("could not marshal key")
 	}
-	err = ts.LMDBEnv.View(func(txn *lmdb.Txn) (err error) {
+	err = ts.view(func(txn *lmdb.Txn) (err error) {
 		cur, err := txn.OpenCursor(ksdb.DBI)
 		if err != nil {
 			log.WithFields(log.Fields{
@@ -212,3 +212,43 @@ func (ksdb *KeySetDB) GetKeySet(key encoding.BinaryMarshaler) (keySetKeys []enco
 	})
 	return
 }
+
+// HasKeyInKeySet checks whether setkey is in the key set for key
+func (ksdb *KeySetDB) HasKeyInKeySet(key encoding.BinaryMarshaler, setkey encoding.BinaryMarshaler) (present bool, err error) {
+	ts := ksdb.TS
+	keyBytes, err := key.MarshalBinary()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("could not marshal key")
+		return
+	}
+	setkeyBytes, err := setkey.MarshalBinary()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("could not marshal setkey")
+		return
+	}
+	err = ts.view(func(txn *lmdb.Txn) (err error) {
+		cur, err := txn.OpenCursor(ksdb.DBI)
+		if err != nil {
+			return
+		}
+		defer cur.Close()
+		_, _, err = cur.Get(keyBytes, setkeyBytes, lmdb.GetBoth)
+		return
+	})
+	if err == nil {
+		present = true
+	} else if lmdb.IsNotFound(err) {
+		err = nil
+	} else {
+		log.WithFields(log.Fields{
+			"key":    key,
+			"setkey": setkey,
+			"err":    err,
+		}).Error("failed to check key set for setkey")
+	}
+	return
+}
@@ -0,0 +1,132 @@
+package treeserve
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Default limits on what a /tree request can ask for
+const (
+	defaultMaxTreeDepth     = 10
+	defaultMaxTreeNodes     = 100000
+	defaultMaxResponseBytes = 256 * 1024 * 1024
+)
+
+// limitCommitBytes is how much of a response is held back before it is sent, so that a request
+// that goes over a limit early on can still get an error status
+const limitCommitBytes = 1024 * 1024
+
+var errTooManyNodes = errors.New("response has too many nodes")
+var errResponseTooLarge = errors.New("response is too large")
+
+// checkDepth refuses a depth greater than MaxTreeDepth
+func (ts *TreeServe) checkDepth(path string, depth int) *APIError {
+	if ts.MaxTreeDepth > 0 && depth > ts.MaxTreeDepth {
+		return &APIError{Status: http.StatusUnprocessableEntity, Code: errorOverLimits, Path: path,
+			Message: fmt.Sprintf("depth %d is more than the maximum of %d", depth, ts.MaxTreeDepth)}
+	}
+	return nil
+}
+
+// limitedResponse counts the nodes and bytes written for a response and fails once either goes
+// over its limit. The first limitCommitBytes are buffered, so if the limit is reached before then
+// nothing has been sent and the client can be given a 413.
+type limitedResponse struct {
+	w         http.ResponseWriter
+	buf       bytes.Buffer
+	committed bool
+	bytes     int64
+	maxBytes  int64
+	nodes     int64
+	maxNodes  int64
+	err       error
+}
+
+func (ts *TreeServe) newLimitedResponse(w http.ResponseWriter) *limitedResponse {
+	return &limitedResponse{w: w, maxBytes: ts.MaxResponseBytes, maxNodes: ts.MaxTreeNodes}
+}
+
+func (lr *limitedResponse) Write(p []byte) (n int, err error) {
+	if lr.err != nil {
+		return 0, lr.err
+	}
+	lr.bytes += int64(len(p))
+	if lr.maxBytes > 0 && lr.bytes > lr.maxBytes {
+		lr.err = errResponseTooLarge
+		return 0, lr.err
+	}
+	if lr.committed {
+		return lr.w.Write(p)
+	}
+	n, err = lr.buf.Write(p)
+	if err == nil && lr.buf.Len() >= limitCommitBytes {
+		err = lr.commit()
+	}
+	return
+}
+
+// node counts one more node in the response
+func (lr *limitedResponse) node() error {
+	if lr.err != nil {
+		return lr.err
+	}
+	lr.nodes++
+	if lr.maxNodes > 0 && lr.nodes > lr.maxNodes {
+		lr.err = errTooManyNodes
+	}
+	return lr.err
+}
+
+// commit sends the status and what has been buffered
+func (lr *limitedResponse) commit() (err error) {
+	lr.committed = true
+	lr.w.WriteHeader(http.StatusOK)
+	_, err = lr.buf.WriteTo(lr.w)
+	return
+}
+
+// flush sends what has been written so far if the response has been committed
+func (lr *limitedResponse) flush() {
+	if !lr.committed {
+		return
+	}
+	if flusher, ok := lr.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// finish completes the response after err from writing it. If a limit was reached before anything
+// was sent the error to send instead is returned. If it was reached after, the status has gone so
+// the connection is dropped to stop the client taking a partial response as complete.
+func (lr *limitedResponse) finish(path string, err error) *APIError {
+	if err == nil {
+		if !lr.committed {
+			err = lr.commit()
+		}
+		LogError(err)
+		return nil
+	}
+	if err != errTooManyNodes && err != errResponseTooLarge {
+		if lr.committed {
+			LogError(err)
+			panic(http.ErrAbortHandler)
+		}
+		return internalError(path, err)
+	}
+
+	apiErr := &APIError{Status: http.StatusRequestEntityTooLarge, Code: errorTooLarge, Path: path}
+	if err == errTooManyNodes {
+		apiErr.Message = fmt.Sprintf("response would have more than the maximum of %d nodes, ask for less depth or use limit, collapse_below or filters", lr.maxNodes)
+	} else {
+		apiErr.Message = fmt.Sprintf("response would be more than the maximum of %d bytes, ask for less depth or use limit, collapse_below or filters", lr.maxBytes)
+	}
+	if lr.committed {
+		LogError(apiErr)
+		panic(http.ErrAbortHandler)
+	}
+	// headers for the response that was going to be sent
+	lr.w.Header().Del("Content-Disposition")
+	return apiErr
+}
@@ -0,0 +1,68 @@
+package treeserve
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTreeLimits(t *testing.T) {
+	ts, cleanup := newReadyTestTree(t)
+	defer cleanup()
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		ts.apiHandler(ts.tree)(w, httptest.NewRequest("GET", apiPrefix+"/tree?path=/lustre&"+query, nil))
+		return w
+	}
+
+	// the streamed output is what json.Marshal makes of the same tree
+	w := get("depth=3")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var ft fullTree
+	err := json.Unmarshal(w.Body.Bytes(), &ft)
+	if err != nil {
+		t.Fatalf("failed to unmarshal nested tree: %v", err)
+	}
+	if len(ft.Tree.ChildDirs) == 0 {
+		t.Errorf("Expected child_dirs in %s", w.Body.String())
+	}
+	j, err := json.Marshal(ft)
+	if err != nil {
+		t.Fatalf("failed to marshal nested tree: %v", err)
+	}
+	if !bytes.Equal(j, w.Body.Bytes()) {
+		t.Errorf("Streamed tree differs from json.Marshal:\n%s\n%s", w.Body.String(), j)
+	}
+
+	expectError := func(query string, status int, code string) {
+		w := get(query)
+		if w.Code != status {
+			t.Errorf("%s: expected %d, got %d", query, status, w.Code)
+		}
+		var body APIError
+		err := json.Unmarshal(w.Body.Bytes(), &body)
+		if err != nil || body.Code != code {
+			t.Errorf("%s: expected error code %s, got %s (%v)", query, code, w.Body.String(), err)
+		}
+	}
+
+	ts.MaxTreeDepth = 2
+	expectError("depth=3", http.StatusUnprocessableEntity, errorOverLimits)
+	ts.MaxTreeDepth = 0
+
+	ts.MaxTreeNodes = 2
+	expectError("depth=3", http.StatusRequestEntityTooLarge, errorTooLarge)
+	expectError("depth=3&format=csv", http.StatusRequestEntityTooLarge, errorTooLarge)
+	if w := get("depth=0"); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 for a single node, got %d", w.Code)
+	}
+	ts.MaxTreeNodes = 0
+
+	ts.MaxResponseBytes = 100
+	expectError("depth=1", http.StatusRequestEntityTooLarge, errorTooLarge)
+}
@@ -0,0 +1,151 @@
+package treeserve
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Defaults for the web server
+const defaultListenAddress = "127.0.0.1:8000"
+const defaultShutdownTimeout = 30 * time.Second
+const defaultListenSocketMode = 0600
+
+// listen opens the listener for the web server, on ListenSocket if it is set and otherwise on ListenAddress
+func (ts *TreeServe) listen() (listener net.Listener, err error) {
+	if ts.ListenSocket != "" {
+		// a socket left behind by a server that did not shut down cleanly stops us listening
+		if fileInfo, statErr := os.Lstat(ts.ListenSocket); statErr == nil && fileInfo.Mode()&os.ModeSocket != 0 {
+			os.Remove(ts.ListenSocket)
+		}
+		listener, err = net.Listen("unix", ts.ListenSocket)
+		if err == nil {
+			// the socket is made with the umask, which would leave who can connect to chance
+			err = os.Chmod(ts.ListenSocket, ts.ListenSocketMode)
+			if err != nil {
+				listener.Close()
+			}
+		}
+	} else {
+		listener, err = net.Listen("tcp", ts.ListenAddress)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":           err,
+			"ListenAddress": ts.ListenAddress,
+			"ListenSocket":  ts.ListenSocket,
+		}).Error("failed to listen")
+	}
+	return
+}
+
+// listenDescription describes where the web server is listening
+func (ts *TreeServe) listenDescription() string {
+	scheme := "http"
+	if ts.TLSCertFile != "" {
+		scheme = "https"
+	}
+	if ts.ListenSocket != "" {
+		return scheme + " on unix socket " + ts.ListenSocket
+	}
+	return scheme + " on " + ts.ListenAddress
+}
+
+// tlsConfig makes the TLS configuration for the web server, requiring clients to present a
+// certificate signed by one of the CAs in TLSClientCAFile if it is set. It is nil if TLS is not used.
+func (ts *TreeServe) tlsConfig() (config *tls.Config, err error) {
+	if ts.TLSCertFile == "" && ts.TLSKeyFile == "" {
+		if ts.TLSClientCAFile != "" {
+			err = fmt.Errorf("client certificate verification needs a TLS certificate and key")
+		}
+		return
+	}
+	if ts.TLSCertFile == "" || ts.TLSKeyFile == "" {
+		err = fmt.Errorf("TLS needs both a certificate and a key")
+		return
+	}
+
+	config = &tls.Config{MinVersion: tls.VersionTLS12}
+	if ts.TLSClientCAFile != "" {
+		caPEM, err := ioutil.ReadFile(ts.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in %s", ts.TLSClientCAFile)
+		}
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return
+}
+
+// serve handles requests with handler until StopWebserver is called or a SIGTERM or SIGINT is
+// received, then waits up to ShutdownTimeout for requests in progress to finish.
+func (ts *TreeServe) serve(handler http.Handler) (err error) {
+	tlsConfig, err := ts.tlsConfig()
+	if err != nil {
+		return
+	}
+	listener, err := ts.listen()
+	if err != nil {
+		return
+	}
+	if ts.ListenSocket != "" {
+		defer os.Remove(ts.ListenSocket)
+	}
+
+	server := &http.Server{Handler: handler, TLSConfig: tlsConfig}
+	// long running responses such as progress events stop when shutdown starts
+	server.RegisterOnShutdown(func() { close(ts.webserverClosing) })
+	shutdownDone := make(chan error, 1)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		defer signal.Stop(signals)
+		select {
+		case sig := <-signals:
+			log.WithFields(log.Fields{"signal": sig}).Info("shutting down web server")
+		case <-ts.stopWebserver:
+			log.Info("stopping web server")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), ts.ShutdownTimeout)
+		defer cancel()
+		shutdownDone <- server.Shutdown(ctx)
+	}()
+
+	log.WithFields(log.Fields{"listening": ts.listenDescription()}).Info("web server started")
+	if tlsConfig != nil {
+		err = server.ServeTLS(listener, ts.TLSCertFile, ts.TLSKeyFile)
+	} else {
+		err = server.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		return
+	}
+
+	// in-flight requests have finished once Shutdown returns
+	err = <-shutdownDone
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("web server did not shut down cleanly")
+		return
+	}
+	log.Info("web server shut down")
+	return
+}
+
+// StopWebserver shuts down the web server as if it had received a SIGTERM
+func (ts *TreeServe) StopWebserver() {
+	close(ts.stopWebserver)
+}
@@ -0,0 +1,83 @@
+package treeserve
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeUnixSocket(t *testing.T) {
+	socketDir, err := ioutil.TempDir("", "listen_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory for socket: %v", err)
+	}
+	defer os.RemoveAll(socketDir)
+
+	ts := NewTreeServe(socketDir+"/lmdb", 64*1024*1024, 2000, 1000, -1, 1000, -1, false)
+	ts.ListenSocket = socketDir + "/treeserve.sock"
+	ts.ListenSocketMode = 0660
+	served := make(chan error, 1)
+	go func() { served <- ts.serve(http.HandlerFunc(ts.hello)) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", ts.ListenSocket)
+		},
+	}}
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		resp, err = client.Get("http://treeserve/")
+		if err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("failed to get from unix socket: %v", err)
+	}
+	if fileInfo, err := os.Stat(ts.ListenSocket); err != nil || fileInfo.Mode().Perm() != 0660 {
+		t.Errorf("Expected socket permissions 0660, got %v %v", fileInfo, err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), ts.ListenSocket) {
+		t.Errorf("Expected hello to mention %s, got %s", ts.ListenSocket, body)
+	}
+
+	ts.StopWebserver()
+	select {
+	case err = <-served:
+		if err != nil {
+			t.Errorf("Expected clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("web server did not shut down")
+	}
+	if _, err = os.Stat(ts.ListenSocket); !os.IsNotExist(err) {
+		t.Errorf("Expected socket to be removed, got %v", err)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	ts := NewTreeServe("", 0, 0, 0, -1, 0, -1, false)
+	config, err := ts.tlsConfig()
+	if config != nil || err != nil {
+		t.Errorf("Expected no TLS without a certificate, got %v %v", config, err)
+	}
+
+	ts.TLSCertFile = "cert.pem"
+	if _, err = ts.tlsConfig(); err == nil {
+		t.Errorf("Expected error with a certificate but no key")
+	}
+
+	ts.TLSCertFile = ""
+	ts.TLSClientCAFile = "ca.pem"
+	if _, err = ts.tlsConfig(); err == nil {
+		t.Errorf("Expected error verifying client certificates without TLS")
+	}
+}
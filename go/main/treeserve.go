@@ -19,8 +19,12 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"os"
 	"runtime"
+	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -36,6 +40,8 @@ var userFile string
 var inputWorkers int
 var costReferenceTime int64
 var lmdbMapSize int64
+var lmdbMapGrowthFactor float64
+var lmdbMaxMapSize int64
 var nodesCreatedInfoEveryN int64
 var stopInputAfterNLines int64
 var nodesFinalizedInfoEveryN int64
@@ -43,6 +49,45 @@ var stopFinalizeAfterNNodes int64
 var finalizeWorkers int
 var maxProcs int
 var debug bool
+var buildOnly bool
+var rebuild bool
+var watchInterval time.Duration
+var migrateTo string
+var compactTo string
+var listenAddress string
+var listenSocket string
+var listenSocketMode string
+var tlsCertFile string
+var tlsKeyFile string
+var tlsClientCAFile string
+var shutdownTimeout time.Duration
+var maxTreeDepth int
+var maxTreeNodes int64
+var maxResponseBytes int64
+var responseCacheEntries int
+var responseCacheBytes int64
+var metricsPaths string
+var htpasswdFile string
+var tokenFile string
+var trustedProxyHeader string
+var trustedProxies string
+var trustListenSocket bool
+var authAdmins string
+var corsOrigin string
+var nameSources string
+var nameReloadInterval time.Duration
+var nameLookupOS bool
+var topK int
+var topByGroup bool
+var topExtensions int
+var dimensions string
+var rollups string
+var volumeDepth int
+var projectFile string
+var chargebackRates string
+var quotaFiles string
+var quotaWarnPercent float64
+var qualitySamples int
 var cpuProfilePath string
 var memProfilePath string
 var blockProfilePath string
@@ -52,9 +97,11 @@ func init() {
 	flag.StringVar(&groupFile, "groupFile", "/tmp/groups.dat", "Input file")
 	flag.StringVar(&userFile, "userFile", "/tmp/users.dat", "Input file")
 	flag.StringVar(&lmdbPath, "lmdbPath", "/tmp/treeserve_lmdb", "Path to LMDB environment")
-	flag.Int64Var(&lmdbMapSize, "lmdbMapSize", 200*1024*1024*1024, "LMDB map size (maximum)")
+	flag.Int64Var(&lmdbMapSize, "lmdbMapSize", 200*1024*1024*1024, "LMDB map size (initial)")
+	flag.Float64Var(&lmdbMapGrowthFactor, "lmdbMapGrowthFactor", 2, "Factor to grow the LMDB map size by when it becomes full")
+	flag.Int64Var(&lmdbMaxMapSize, "lmdbMaxMapSize", 4*1024*1024*1024*1024, "LMDB map size (maximum), the map will not be grown beyond this")
 	flag.IntVar(&inputWorkers, "inputWorkers", 2, "Number of parallel workers to use for processing lines of input data to build the tree")
-	flag.Int64Var(&costReferenceTime, "costReferenceTime", time.Now().Unix(), "The time to use for cost calculations in seconds since the epoch")
+	flag.Int64Var(&costReferenceTime, "costReferenceTime", time.Now().Unix(), "The time to use for cost calculations in seconds since the epoch, which migrating a tree from schema version 0 needs")
 	flag.Int64Var(&nodesCreatedInfoEveryN, "nodesCreatedInfoEveryN", 10000, "Number of node creations between info logs")
 	flag.Int64Var(&stopInputAfterNLines, "stopInputAfterNLines", -1, "Stop processing input after this number of lines (-1 to process all input)")
 	flag.Int64Var(&stopFinalizeAfterNNodes, "stopFinalizeAfterNNodes", -1, "Stop finalizing after this number of nodes (-1 to finalize all nodes)")
@@ -62,6 +109,45 @@ func init() {
 	flag.IntVar(&finalizeWorkers, "finalizeWorkers", 10, "Number of parallel workers to use for finalizing the tree")
 	flag.IntVar(&maxProcs, "maxProcs", runtime.GOMAXPROCS(0), "Maximum number of CPUs to use simultaneously (default: $GOMAXPROCS)")
 	flag.BoolVar(&debug, "debug", false, "Enable debug logging")
+	flag.BoolVar(&buildOnly, "buildOnly", false, "Build and publish a new tree then exit, leaving a running server to pick it up")
+	flag.BoolVar(&rebuild, "rebuild", false, "Build a new tree even if there is already one ready to serve")
+	flag.DurationVar(&watchInterval, "watchInterval", time.Minute, "How often to check for a newly published tree while serving (0 to disable)")
+	flag.StringVar(&migrateTo, "migrateTo", "", "Path to write the migrated LMDB environment to (default: migrate lmdbPath in place)")
+	flag.StringVar(&compactTo, "compactTo", "", "Path to write the compacted LMDB environment to (default: <lmdbPath>.compact)")
+	flag.StringVar(&listenAddress, "listen", "127.0.0.1:8000", "Address and port for the web server to listen on")
+	flag.StringVar(&listenSocket, "listenSocket", "", "Unix socket for the web server to listen on instead of -listen")
+	flag.StringVar(&listenSocketMode, "listenSocketMode", "0600", "Octal permissions of -listenSocket, eg. 0660 to let a proxy in the socket's group connect")
+	flag.StringVar(&tlsCertFile, "tlsCert", "", "TLS certificate file, serve https if given with -tlsKey")
+	flag.StringVar(&tlsKeyFile, "tlsKey", "", "TLS private key file")
+	flag.StringVar(&tlsClientCAFile, "tlsClientCA", "", "CA certificates file, require and verify client certificates signed by them")
+	flag.DurationVar(&shutdownTimeout, "shutdownTimeout", 30*time.Second, "How long to wait for requests in progress on SIGTERM")
+	flag.IntVar(&maxTreeDepth, "maxTreeDepth", 10, "Deepest /tree request allowed (0 for no limit)")
+	flag.Int64Var(&maxTreeNodes, "maxTreeNodes", 100000, "Most directories in a /tree response (0 for no limit)")
+	flag.Int64Var(&maxResponseBytes, "maxResponseBytes", 256*1024*1024, "Largest /tree response in bytes (0 for no limit)")
+	flag.IntVar(&responseCacheEntries, "responseCacheEntries", 100, "Most responses to cache (0 to turn off caching)")
+	flag.Int64Var(&responseCacheBytes, "responseCacheBytes", 64*1024*1024, "Most bytes of responses to cache")
+	flag.StringVar(&metricsPaths, "metricsPaths", "", "Comma separated paths to give usage by group for in /metrics")
+	flag.StringVar(&htpasswdFile, "htpasswdFile", "", "htpasswd file (bcrypt or SHA hashes) to authenticate users with basic auth")
+	flag.StringVar(&tokenFile, "tokenFile", "", "File of <user> <token> lines to authenticate bearer tokens")
+	flag.StringVar(&trustedProxyHeader, "trustedProxyHeader", "", "Header a reverse proxy puts the authenticated user in, eg. X-Remote-User")
+	flag.StringVar(&trustedProxies, "trustedProxies", "", "Comma separated CIDRs -trustedProxyHeader is accepted from")
+	flag.BoolVar(&trustListenSocket, "trustListenSocket", false, "Accept -trustedProxyHeader on -listenSocket, whose permissions must only let the proxy connect")
+	flag.StringVar(&authAdmins, "authAdmins", "", "Comma separated users who can see every group and user, /metrics and /admin/db")
+	flag.StringVar(&corsOrigin, "corsOrigin", "", "Access-Control-Allow-Origin for responses (default none)")
+	flag.StringVar(&nameSources, "nameSources", "", "Comma separated <path prefix>=<userFile>:<groupFile> to name the users and groups of volumes, before -userFile and -groupFile")
+	flag.DurationVar(&nameReloadInterval, "nameReloadInterval", time.Minute, "How often to reload user and group files that have changed (0 for only on SIGHUP)")
+	flag.BoolVar(&nameLookupOS, "nameLookupOS", true, "Look up users and groups that are not in the files with the system's user database")
+	flag.IntVar(&topK, "topK", 10, "Number of the largest files and directories to keep for each directory when finalizing (0 for none)")
+	flag.BoolVar(&topByGroup, "topByGroup", false, "Keep the largest files and directories of each group for each directory as well")
+	flag.IntVar(&topExtensions, "topExtensions", 20, "Number of file extensions to count for each directory when finalizing, the rest are counted together (0 for none)")
+	flag.StringVar(&dimensions, "dimensions", "user,group,tag", "Comma separated dimensions to break aggregates down by: user, group, tag, volume, project, filetype, sizeclass and ageclass")
+	flag.StringVar(&rollups, "rollups", "", "Comma separated combinations of dimensions joined by + to keep aggregates for, with * for the other dimensions (default every combination)")
+	flag.IntVar(&volumeDepth, "volumeDepth", 2, "Number of path components that make up the volume dimension")
+	flag.StringVar(&projectFile, "projectFile", "", "File of <path prefix or glob> <project> [<PI> [<cost centre>]] lines, enables the project dimension with a rollup of its own")
+	flag.StringVar(&chargebackRates, "chargebackRates", "", "Comma separated [<project or cost centre>=]<rate> prices per TiB year for /api/v2/chargeback (default 150 for all)")
+	flag.StringVar(&quotaFiles, "quotaFiles", "", "Comma separated <volume path>=<quota file> of lfs quota output or <group|user> <name or id> <byte limit> <inode limit> lines for /api/v2/quota")
+	flag.Float64Var(&quotaWarnPercent, "quotaWarnPercent", 90, "Percentage of a byte or inode quota used at which a group or user is warned")
+	flag.IntVar(&qualitySamples, "qualitySamples", 10, "Number of paths to keep as examples of each data quality problem found in the input")
 	flag.StringVar(&cpuProfilePath, "cpuProfilePath", "", "Write CPU profile to path")
 	flag.StringVar(&memProfilePath, "memProfilePath", "", "Write Memory profile to path")
 	flag.StringVar(&blockProfilePath, "blockProfilePath", "", "Write Block (contention) profile to path")
@@ -99,16 +185,145 @@ func main() {
 	log.WithFields(flag_fields).Debug("entered main()")
 
 	ts := treeserve.NewTreeServe(lmdbPath, lmdbMapSize, costReferenceTime, nodesCreatedInfoEveryN, stopInputAfterNLines, nodesFinalizedInfoEveryN, stopFinalizeAfterNNodes, debug)
+	ts.CostReferenceTimeGiven = flagSet("costReferenceTime")
+	ts.LMDBMapGrowthFactor = lmdbMapGrowthFactor
+	ts.LMDBMaxMapSize = lmdbMaxMapSize
+	ts.ListenAddress = listenAddress
+	ts.ListenSocket = listenSocket
+	mode, parseErr := strconv.ParseUint(listenSocketMode, 8, 32)
+	if parseErr != nil || mode > 0777 {
+		log.WithFields(log.Fields{"err": parseErr, "listenSocketMode": listenSocketMode}).Fatal("bad -listenSocketMode")
+	}
+	ts.ListenSocketMode = os.FileMode(mode)
+	ts.TLSCertFile = tlsCertFile
+	ts.TLSKeyFile = tlsKeyFile
+	ts.TLSClientCAFile = tlsClientCAFile
+	ts.ShutdownTimeout = shutdownTimeout
+	ts.MaxTreeDepth = maxTreeDepth
+	ts.MaxTreeNodes = maxTreeNodes
+	ts.MaxResponseBytes = maxResponseBytes
+	ts.ResponseCacheEntries = responseCacheEntries
+	ts.ResponseCacheBytes = responseCacheBytes
+	if metricsPaths != "" {
+		ts.MetricsPaths = strings.Split(metricsPaths, ",")
+	}
+	ts.HtpasswdFile = htpasswdFile
+	ts.TokenFile = tokenFile
+	ts.TrustedProxyHeader = trustedProxyHeader
+	if trustedProxies != "" {
+		ts.TrustedProxies = strings.Split(trustedProxies, ",")
+	}
+	ts.TrustListenSocket = trustListenSocket
+	if authAdmins != "" {
+		ts.AuthAdmins = strings.Split(authAdmins, ",")
+	}
+	ts.CORSOrigin = corsOrigin
+	sources, parseErr := treeserve.ParseNameSources(nameSources)
+	if parseErr != nil {
+		log.WithFields(log.Fields{"err": parseErr}).Fatal("bad -nameSources")
+	}
+	ts.NameSources = sources
+	ts.NameReloadInterval = nameReloadInterval
+	ts.NameLookupOS = nameLookupOS
+	ts.TopK = topK
+	ts.TopByGroup = topByGroup
+	ts.TopExtensions = topExtensions
+	ts.Dimensions, parseErr = treeserve.ParseDimensions(dimensions)
+	if parseErr != nil {
+		log.WithFields(log.Fields{"err": parseErr}).Fatal("bad -dimensions")
+	}
+	ts.Rollups, parseErr = treeserve.ParseRollups(rollups, ts.Dimensions)
+	if parseErr != nil {
+		log.WithFields(log.Fields{"err": parseErr}).Fatal("bad -rollups")
+	}
+	ts.VolumeDepth = volumeDepth
+	if projectFile != "" {
+		projects, parseErr := treeserve.LoadProjectFile(projectFile)
+		if parseErr != nil {
+			log.WithFields(log.Fields{"err": parseErr, "projectFile": projectFile}).Fatal("failed to load -projectFile")
+		}
+		ts.SetProjects(projects)
+	}
+	ts.ChargebackRates, parseErr = treeserve.ParseChargebackRates(chargebackRates)
+	if parseErr != nil {
+		log.WithFields(log.Fields{"err": parseErr}).Fatal("bad -chargebackRates")
+	}
+	ts.QuotaSources, parseErr = treeserve.ParseQuotaSources(quotaFiles)
+	if parseErr != nil {
+		log.WithFields(log.Fields{"err": parseErr}).Fatal("bad -quotaFiles")
+	}
+	ts.QuotaWarnPercent = quotaWarnPercent
+	ts.QualitySamples = qualitySamples
+
+	switch flag.Arg(0) {
+	case "":
+		// build and serve the tree
+	case "verify":
+		os.Exit(verify(ts))
+	case "migrate":
+		os.Exit(migrate(ts))
+	case "dbinfo":
+		os.Exit(dbinfo(ts))
+	case "compact":
+		os.Exit(compact(ts))
+	default:
+		log.WithFields(log.Fields{"command": flag.Arg(0)}).Fatal("unknown command")
+	}
+
+	// serve the existing tree if there is one, otherwise build a new one in the staging
+	// environment, which is published to lmdbPath when it is complete
+	if buildOnly || rebuild || !treeReady(ts) {
+		stagingPath := treeserve.StagingPath(lmdbPath)
+		ts.LMDBPath = stagingPath
+		// a build interrupted after it read all its input carries on from its last state, one
+		// interrupted before then is started again
+		if !rebuild && ts.CanResumeBuild(inputPath) {
+			log.WithFields(log.Fields{"stagingPath": stagingPath}).Info("resuming interrupted build")
+		} else {
+			err := treeserve.RemoveLMDB(stagingPath)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"stagingPath": stagingPath,
+					"err":         err,
+				}).Fatal("failed to remove previous staging environment")
+			}
+			err = treeserve.MakeStagingDir(lmdbPath)
+			if err != nil {
+				log.WithFields(log.Fields{"err": err}).Fatal("failed to create staging directory")
+			}
+		}
+	}
+
 	err := ts.OpenLMDB()
 	if err != nil {
 		log.WithFields(log.Fields{
-			"lmdbPath":    lmdbPath,
+			"lmdbPath":    ts.LMDBPath,
 			"lmdbMapSize": lmdbMapSize,
 			"ts":          ts,
 		}).Fatal("failed to open TreeServe LMDB")
 	}
 	defer ts.CloseLMDB()
 
+	// serve health checks and build progress while the tree is built, and the tree once it is ready
+	treeServing := make(chan struct{})
+	webserverDone := make(chan struct{})
+	if !buildOnly {
+		go func() {
+			err := ts.Webserver(groupFile, userFile)
+			if err != nil {
+				log.WithFields(log.Fields{"err": err}).Fatal("web server failed")
+			}
+			select {
+			case <-treeServing:
+				close(webserverDone)
+			default:
+				// a build that had read its input is resumed next time, any other is started again
+				log.Info("web server shut down before the tree was ready, stopping build")
+				os.Exit(1)
+			}
+		}()
+	}
+
 	//MainStateMachine:
 	for {
 		state, err := ts.GetState()
@@ -137,14 +352,34 @@ func main() {
 			log.Info("main state machine: finalize")
 			err = ts.Finalize("/", finalizeWorkers)
 			if err != nil {
-				nextState = "treeReady"
+				log.WithFields(log.Fields{"err": err}).Fatal("failed to finalize tree")
+			} else {
+				nextState = "finalized"
 			}
-			nextState = "treeReady"
 			//break MainStateMachine // for development only
+		case "finalized":
+			log.Info("main state machine: finalized")
+			// a build that is only published is not opened again, that is left to the servers
+			err = ts.PublishBuild(lmdbPath, !buildOnly)
+			if err != nil {
+				log.WithFields(log.Fields{"err": err}).Fatal("failed to publish tree")
+			}
+			if buildOnly {
+				log.Info("main state machine: tree published after " + time.Since(starttime).String())
+				return
+			}
+			// the published tree is already marked ready
+			continue
 		case "treeReady":
 			log.Info("main state machine: tree ready after " + time.Since(starttime).String())
 
-			ts.Webserver(groupFile, userFile)
+			if watchInterval > 0 {
+				go ts.WatchForNewBuild(watchInterval)
+			}
+			close(treeServing)
+			<-webserverDone
+			// shut down, LMDB is closed on return
+			return
 		case "failed":
 
 			log.WithFields(log.Fields{
@@ -166,3 +401,142 @@ func main() {
 
 	return
 }
+
+// treeReady checks whether there is already a finished tree at the serving path
+func treeReady(ts *treeserve.TreeServe) bool {
+	if _, err := os.Stat(ts.LMDBPath); err != nil {
+		return false
+	}
+	err := ts.OpenLMDB()
+	if treeserve.IsSchemaVersionError(err) {
+		// don't silently replace a tree that could be migrated
+		log.WithFields(log.Fields{"err": err}).Fatal("existing tree has a different schema version, migrate it or use -rebuild")
+	}
+	if err != nil {
+		return false
+	}
+	defer ts.CloseLMDB()
+	state, err := ts.GetState()
+	return err == nil && state == "treeReady"
+}
+
+// flagSet checks whether a flag was given on the command line
+func flagSet(name string) (set bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return
+}
+
+// verify checks the integrity of the tree at lmdbPath and prints a JSON report.
+// It returns the exit status, which is nonzero if any check failed.
+func verify(ts *treeserve.TreeServe) int {
+	err := ts.OpenLMDB()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to open TreeServe LMDB")
+		return 2
+	}
+	defer ts.CloseLMDB()
+
+	// only check against the input if it was given, the default may not be the input used
+	inputLines := int64(-1)
+	if flagSet("inputPath") {
+		inputLines, err = treeserve.CountInputLines(inputPath, stopInputAfterNLines)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":       err,
+				"inputPath": inputPath,
+			}).Error("failed to count input lines")
+			return 2
+		}
+	}
+
+	report, err := ts.Verify(inputLines)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to verify tree")
+		return 2
+	}
+	status := printJSON(report)
+	if status != 0 {
+		return status
+	}
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
+
+// migrate upgrades the tree at lmdbPath to the current schema version, in place or into migrateTo.
+// It returns the exit status.
+func migrate(ts *treeserve.TreeServe) int {
+	err := ts.Migrate(migrateTo)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"lmdbPath":  lmdbPath,
+			"migrateTo": migrateTo,
+		}).Error("failed to migrate TreeServe LMDB")
+		return 1
+	}
+	defer ts.CloseLMDB()
+	log.WithFields(log.Fields{
+		"LMDBPath":      ts.LMDBPath,
+		"SchemaVersion": treeserve.SchemaVersion,
+	}).Info("migrated TreeServe LMDB")
+	return 0
+}
+
+// dbinfo prints the storage used by each database in the tree at lmdbPath as JSON.
+// It returns the exit status.
+func dbinfo(ts *treeserve.TreeServe) int {
+	err := ts.OpenLMDB()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to open TreeServe LMDB")
+		return 1
+	}
+	defer ts.CloseLMDB()
+
+	info, err := ts.DBInfo()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to get database info")
+		return 1
+	}
+	return printJSON(info)
+}
+
+// compact writes a compacted copy of the tree at lmdbPath to compactTo and prints the sizes as JSON.
+// It returns the exit status.
+func compact(ts *treeserve.TreeServe) int {
+	if compactTo == "" {
+		compactTo = lmdbPath + ".compact"
+	}
+	err := ts.OpenLMDB()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to open TreeServe LMDB")
+		return 1
+	}
+	defer ts.CloseLMDB()
+
+	compactInfo, err := ts.Compact(compactTo)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"compactTo": compactTo,
+		}).Error("failed to compact TreeServe LMDB")
+		return 1
+	}
+	return printJSON(compactInfo)
+}
+
+// printJSON writes v to stdout as indented JSON, returning the exit status
+func printJSON(v interface{}) int {
+	j, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to marshal output")
+		return 2
+	}
+	os.Stdout.Write(append(j, '\n'))
+	return 0
+}
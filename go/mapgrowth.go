@@ -0,0 +1,133 @@
+package treeserve
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// Default settings for growing the LMDB map when a write finds it full
+const defaultLMDBMapGrowthFactor = 2.0
+const defaultLMDBMaxMapSize = 4 * 1024 * 1024 * 1024 * 1024 // 4 TiB
+
+// update runs a write transaction on the LMDB environment. If the transaction fails
+// because the map is full, writers are paused while the map is grown and the transaction is retried.
+func (ts *TreeServe) update(op lmdb.TxnOp) (err error) {
+	for {
+		ts.lmdbResizeLock.RLock()
+		mapSize := ts.LMDBMapSize
+		atomic.AddInt64(&ts.metrics.writeTxns, 1)
+		err = ts.LMDBEnv.Update(op)
+		ts.lmdbResizeLock.RUnlock()
+
+		if lmdb.IsMapFull(err) {
+			err = ts.growMapSize(mapSize)
+		} else if lmdb.IsMapResized(err) {
+			err = ts.adoptMapSize()
+		} else {
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// view runs a read transaction on the LMDB environment. It waits for any map resize in progress.
+func (ts *TreeServe) view(op lmdb.TxnOp) (err error) {
+	ts.lmdbResizeLock.RLock()
+	defer ts.lmdbResizeLock.RUnlock()
+	atomic.AddInt64(&ts.metrics.readTxns, 1)
+	err = ts.LMDBEnv.View(op)
+	return
+}
+
+// growMapSize increases the LMDB map size by LMDBMapGrowthFactor up to LMDBMaxMapSize.
+// failedSize is the map size in use when the write failed, so that if several writers
+// hit a full map at the same time it is only grown once.
+func (ts *TreeServe) growMapSize(failedSize int64) (err error) {
+	// no transactions can be active in this process while the map size is changed
+	ts.lmdbResizeLock.Lock()
+	defer ts.lmdbResizeLock.Unlock()
+
+	if ts.LMDBMapSize != failedSize {
+		// another writer has already grown the map
+		return
+	}
+
+	newSize, err := nextMapSize(ts.LMDBMapSize, ts.LMDBMapGrowthFactor, ts.LMDBMaxMapSize)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":                 err,
+			"LMDBMapSize":         ts.LMDBMapSize,
+			"LMDBMaxMapSize":      ts.LMDBMaxMapSize,
+			"LMDBMapGrowthFactor": ts.LMDBMapGrowthFactor,
+		}).Error("cannot grow LMDB map")
+		return
+	}
+
+	err = ts.LMDBEnv.SetMapSize(newSize)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":     err,
+			"newSize": newSize,
+		}).Error("failed to grow LMDB map")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"oldSize": ts.LMDBMapSize,
+		"newSize": newSize,
+	}).Info("LMDB map full, grew map size")
+
+	ts.LMDBMapSize = newSize
+	return
+}
+
+// adoptMapSize picks up a map size that has been increased by another process using the environment
+func (ts *TreeServe) adoptMapSize() (err error) {
+	ts.lmdbResizeLock.Lock()
+	defer ts.lmdbResizeLock.Unlock()
+
+	// a size of zero tells LMDB to use the size currently in the environment
+	err = ts.LMDBEnv.SetMapSize(0)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to adopt resized LMDB map")
+		return
+	}
+	info, err := ts.LMDBEnv.Info()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to get LMDB environment info")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"oldSize": ts.LMDBMapSize,
+		"newSize": info.MapSize,
+	}).Info("LMDB map resized by another process, adopted new size")
+
+	ts.LMDBMapSize = info.MapSize
+	return
+}
+
+// nextMapSize works out the size to grow the map to, returning an error if it is already at the limit
+func nextMapSize(current int64, factor float64, limit int64) (next int64, err error) {
+	if factor <= 1 {
+		err = fmt.Errorf("LMDB map growth factor must be greater than 1, not %v", factor)
+		return
+	}
+	if current >= limit {
+		err = fmt.Errorf("LMDB map size %d has reached the limit of %d", current, limit)
+		return
+	}
+	next = int64(float64(current) * factor)
+	if next <= current {
+		next = current + 1
+	}
+	if next > limit {
+		next = limit
+	}
+	return
+}
@@ -0,0 +1,71 @@
+package treeserve
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNextMapSize(t *testing.T) {
+	next, err := nextMapSize(100, 2, 1000)
+	if err != nil {
+		t.Error(err)
+	}
+	if next != 200 {
+		t.Errorf("Expected %d, got %d ", 200, next)
+	}
+
+	// capped at the limit
+	next, err = nextMapSize(600, 2, 1000)
+	if err != nil {
+		t.Error(err)
+	}
+	if next != 1000 {
+		t.Errorf("Expected %d, got %d ", 1000, next)
+	}
+
+	// already at the limit
+	_, err = nextMapSize(1000, 2, 1000)
+	if err == nil {
+		t.Errorf("Expected error growing map beyond limit")
+	}
+
+	// factor must grow the map
+	_, err = nextMapSize(100, 1, 1000)
+	if err == nil {
+		t.Errorf("Expected error with growth factor of 1")
+	}
+}
+
+func TestMapGrowth(t *testing.T) {
+	lmdbDir, err := ioutil.TempDir("", "mapgrowth_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory for LMDB: %v", err)
+	}
+	defer os.RemoveAll(lmdbDir)
+
+	initialSize := int64(1024 * 1024)
+	ts := NewTreeServe(lmdbDir+"/lmdb", initialSize, 1, 1000, -1, 1000, -1, false)
+	ts.LMDBMaxMapSize = 64 * 1024 * 1024
+	err = ts.OpenLMDB()
+	if err != nil {
+		t.Fatalf("failed to open LMDB: %v", err)
+	}
+	defer ts.CloseLMDB()
+
+	// write more than fits in the initial map
+	padding := strings.Repeat("x", 1000)
+	for i := 0; i < 2000; i++ {
+		name := "/lustre/" + strconv.Itoa(i) + padding
+		err = ts.TreeNodeDB.Add(ts.getPathKey(name), &TreeNode{Name: name}, true)
+		if err != nil {
+			t.Fatalf("failed to add tree node %d: %v", i, err)
+		}
+	}
+
+	if ts.LMDBMapSize <= initialSize {
+		t.Errorf("Expected map to grow beyond %d, got %d", initialSize, ts.LMDBMapSize)
+	}
+}
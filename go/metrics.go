@@ -0,0 +1,300 @@
+package treeserve
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics are written in the Prometheus text format without the client library, which would be
+// the only thing needing it.
+
+// requestDurationBuckets are the upper bounds in seconds of the request duration histogram
+var requestDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// labels formats label names and values given in pairs as {name="value",...}
+func labels(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		parts = append(parts, pairs[i]+`="`+value+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// counterVec is a counter for each set of labels
+type counterVec struct {
+	mu     sync.Mutex
+	values map[string]float64 // by formatted labels
+}
+
+func (c *counterVec) add(labels string, v float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]float64)
+	}
+	c.values[labels] += v
+}
+
+func (c *counterVec) write(w *bufio.Writer, name string, help string, metricType string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeFamily(w, name, help, metricType, c.values)
+}
+
+// histogramVec is a histogram for each set of labels
+type histogramVec struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  map[string][]uint64 // by formatted labels, not cumulative, the last is +Inf
+	sums    map[string]float64
+}
+
+func (h *histogramVec) observe(labels string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = make(map[string][]uint64)
+		h.sums = make(map[string]float64)
+	}
+	counts, ok := h.counts[labels]
+	if !ok {
+		counts = make([]uint64, len(h.buckets)+1)
+		h.counts[labels] = counts
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	counts[i]++
+	h.sums[labels] += v
+}
+
+func (h *histogramVec) write(w *bufio.Writer, name string, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, l := range sortedKeys(h.counts) {
+		counts := h.counts[l]
+		// the le label goes inside the existing braces
+		prefix := strings.TrimSuffix(l, "}")
+		if prefix != "{" {
+			prefix += ","
+		}
+		var total uint64
+		for i, bound := range h.buckets {
+			total += counts[i]
+			fmt.Fprintf(w, "%s_bucket%sle=\"%s\"} %d\n", name, prefix, strconv.FormatFloat(bound, 'g', -1, 64), total)
+		}
+		total += counts[len(h.buckets)]
+		fmt.Fprintf(w, "%s_bucket%sle=\"+Inf\"} %d\n", name, prefix, total)
+		fmt.Fprintf(w, "%s_sum%s %s\n", name, l, formatValue(h.sums[l]))
+		fmt.Fprintf(w, "%s_count%s %d\n", name, l, total)
+	}
+}
+
+func sortedKeys(m interface{}) (keys []string) {
+	switch m := m.(type) {
+	case map[string]float64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string][]uint64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// writeFamily writes a metric with a value for each set of labels
+func writeFamily(w *bufio.Writer, name string, help string, metricType string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+	for _, l := range sortedKeys(values) {
+		if l == "{}" {
+			fmt.Fprintf(w, "%s %s\n", name, formatValue(values[l]))
+		} else {
+			fmt.Fprintf(w, "%s%s %s\n", name, l, formatValue(values[l]))
+		}
+	}
+}
+
+// serverMetrics are counted as the server runs
+type serverMetrics struct {
+	requests         counterVec   // by route and status code
+	requestDurations histogramVec // by route
+	rejected         counterVec   // by APIError code
+	cache            counterVec   // by result
+	readTxns         int64
+	writeTxns        int64
+	phaseMu          sync.Mutex
+	phaseDurations   map[string]float64 // seconds taken by each build phase run by this process
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{requestDurations: histogramVec{buckets: requestDurationBuckets}, phaseDurations: make(map[string]float64)}
+}
+
+// phaseDone records how long a build phase took
+func (m *serverMetrics) phaseDone(phase string, d time.Duration) {
+	m.phaseMu.Lock()
+	defer m.phaseMu.Unlock()
+	m.phaseDurations[phase] = d.Seconds()
+}
+
+// statusRecorder keeps the status written to a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(p)
+}
+
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// instrument counts the requests handled by h for route and how long they take. Responses cut
+// off part way through are counted with the code "aborted".
+func (ts *TreeServe) instrument(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			code := strconv.Itoa(sr.status)
+			if p != nil {
+				code = "aborted"
+			} else if sr.status == 0 {
+				code = strconv.Itoa(http.StatusOK)
+			}
+			ts.metrics.requests.add(labels("route", route, "code", code), 1)
+			ts.metrics.requestDurations.observe(labels("route", route), time.Since(start).Seconds())
+			if p != nil {
+				panic(p)
+			}
+		}()
+		h(sr, r)
+	}
+}
+
+// metricsHandler serves the metrics in the Prometheus text format
+func (ts *TreeServe) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+	m := ts.metrics
+
+	m.requests.write(bw, "treeserve_http_requests_total", "HTTP requests by route and status code.", "counter")
+	m.requestDurations.write(bw, "treeserve_http_request_duration_seconds", "Time taken to handle HTTP requests by route.")
+	m.rejected.write(bw, "treeserve_api_rejected_requests_total", "API requests refused, by error code.", "counter")
+	m.cache.write(bw, "treeserve_response_cache_requests_total", "Cacheable API requests by whether they were answered from the cache (hit), by 304 Not Modified (not_modified) or not (miss).", "counter")
+
+	entries, bytes := ts.responseCache.size()
+	writeFamily(bw, "treeserve_response_cache_entries", "Responses in the cache.", "gauge", map[string]float64{"{}": float64(entries)})
+	writeFamily(bw, "treeserve_response_cache_bytes", "Bytes of responses in the cache.", "gauge", map[string]float64{"{}": float64(bytes)})
+
+	writeFamily(bw, "treeserve_lmdb_transactions_total", "LMDB transactions by type.", "counter", map[string]float64{
+		labels("type", "read"):  float64(atomic.LoadInt64(&m.readTxns)),
+		labels("type", "write"): float64(atomic.LoadInt64(&m.writeTxns)),
+	})
+
+	writeFamily(bw, "treeserve_nodes_created_total", "Nodes created from the input by this process.", "counter", map[string]float64{"{}": float64(atomic.LoadInt64(&ts.NodesCreated))})
+	writeFamily(bw, "treeserve_nodes_finalized_total", "Nodes finalized by this process.", "counter", map[string]float64{"{}": float64(atomic.LoadInt64(&ts.NodesFinalized))})
+	writeFamily(bw, "treeserve_input_lines_read_total", "Lines of input read by this process.", "counter", map[string]float64{"{}": float64(atomic.LoadInt64(&ts.progress.linesRead))})
+
+	m.phaseMu.Lock()
+	phases := make(map[string]float64, len(m.phaseDurations))
+	for phase, seconds := range m.phaseDurations {
+		phases[labels("phase", phase)] = seconds
+	}
+	m.phaseMu.Unlock()
+	writeFamily(bw, "treeserve_build_phase_duration_seconds", "Time taken by each build phase run by this process.", "gauge", phases)
+
+	// the rest needs the tree
+	ts.lmdbSwapLock.RLock()
+	defer ts.lmdbSwapLock.RUnlock()
+	state := ""
+	if ts.lmdbOpen {
+		var err error
+		state, err = ts.GetState()
+		if err != nil {
+			LogError(err)
+			return
+		}
+	}
+	ready := 0.0
+	if state == "treeReady" {
+		ready = 1
+	}
+	writeFamily(bw, "treeserve_tree_ready", "Whether the tree is ready to serve.", "gauge", map[string]float64{"{}": ready})
+	if ready == 0 {
+		return
+	}
+	writeFamily(bw, "treeserve_build_info", "The tree being served.", "gauge", map[string]float64{labels("build_id", ts.buildID, "version", Version): 1})
+	writeFamily(bw, "treeserve_scan_timestamp_seconds", "When the input of the tree being served was made.", "gauge", map[string]float64{"{}": float64(ts.scanDate.Unix())})
+	ts.writeUsageMetrics(bw)
+}
+
+// writeUsageMetrics writes the size, count and costs of each of MetricsPaths by group
+func (ts *TreeServe) writeUsageMetrics(w *bufio.Writer) {
+	if len(ts.MetricsPaths) == 0 {
+		return
+	}
+	size := make(map[string]float64)
+	count := make(map[string]float64)
+	cost := make(map[string]float64)
+	for _, path := range ts.MetricsPaths {
+		nodeKey, apiErr := ts.nodeKeyForPath(path)
+		if apiErr != nil {
+			continue
+		}
+		stats, err := ts.retrieveAggregates(nodeKey)
+		if err != nil {
+			LogError(err)
+			continue
+		}
+		for _, a := range stats {
+			// every user and tag, so each file is counted once per group
+			if a.User != "*" || a.Tag != "*" || a.Dimensions != "" {
+				continue
+			}
+			group := a.Group
+			if group != "*" {
+				group = ts.lookupGID(path, group)
+			}
+			l := labels("path", path, "group", group)
+			size[l] += a.Size.Float64()
+			count[l] += a.Count.Float64()
+			for kind, b := range map[string]*Bigint{"atime": a.AccessCost, "mtime": a.ModifyCost, "ctime": a.ChangeCost} {
+				cost[labels("path", path, "group", group, "kind", kind)] += costValue(b)
+			}
+		}
+	}
+	writeFamily(w, "treeserve_usage_bytes", "Size of the files under a path by group, * for all groups.", "gauge", size)
+	writeFamily(w, "treeserve_usage_files", "Number of files and directories under a path by group, * for all groups.", "gauge", count)
+	writeFamily(w, "treeserve_usage_cost", "Cost of the files under a path by group and the time it is from.", "gauge", cost)
+}
@@ -0,0 +1,82 @@
+package treeserve
+
+import (
+	"bufio"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLabels(t *testing.T) {
+	if l := labels("path", `/a "b"\c`, "group", "g"); l != `{path="/a \"b\"\\c",group="g"}` {
+		t.Errorf("Unexpected labels %s", l)
+	}
+	if l := labels(); l != "{}" {
+		t.Errorf("Expected empty labels, got %s", l)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ts, cleanup := newReadyTestTree(t)
+	defer cleanup()
+	ts.MetricsPaths = []string{"/lustre", "/nowhere"}
+
+	route := apiPrefix + "/tree"
+	tree := ts.instrument(route, ts.apiHandler(ts.cached(ts.tree)))
+	for _, query := range []string{"path=/lustre&depth=1", "depth=1&path=/lustre", "path=/nowhere"} {
+		tree(httptest.NewRecorder(), httptest.NewRequest("GET", route+"?"+query, nil))
+	}
+
+	w := httptest.NewRecorder()
+	ts.metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	values := make(map[string]float64)
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("bad metric line %s: %v", line, err)
+		}
+		values[line[:i]] = v
+	}
+
+	for metric, expected := range map[string]float64{
+		`treeserve_http_requests_total{route="/api/v2/tree",code="200"}`:                 2,
+		`treeserve_http_requests_total{route="/api/v2/tree",code="404"}`:                 1,
+		`treeserve_http_request_duration_seconds_count{route="/api/v2/tree"}`:            3,
+		`treeserve_http_request_duration_seconds_bucket{route="/api/v2/tree",le="+Inf"}`: 3,
+		`treeserve_api_rejected_requests_total{code="not_found"}`:                        1,
+		`treeserve_response_cache_requests_total{result="hit"}`:                          1,
+		`treeserve_response_cache_requests_total{result="miss"}`:                         2,
+		`treeserve_response_cache_entries`:                                               1,
+		`treeserve_tree_ready`:                                                           1,
+		`treeserve_build_info{build_id="` + ts.buildID + `",version="` + Version + `"}`:  1,
+		`treeserve_scan_timestamp_seconds`:                                               float64(ts.scanDate.Unix()),
+	} {
+		v, ok := values[metric]
+		if !ok {
+			t.Errorf("Expected metric %s in:\n%s", metric, w.Body.String())
+		} else if v != expected {
+			t.Errorf("%s: expected %v, got %v", metric, expected, v)
+		}
+	}
+	if values[`treeserve_lmdb_transactions_total{type="read"}`] == 0 {
+		t.Errorf("Expected read transactions to be counted")
+	}
+	if values[`treeserve_usage_bytes{path="/lustre",group="*"}`] == 0 || values[`treeserve_usage_files{path="/lustre",group="*"}`] == 0 {
+		t.Errorf("Expected usage for /lustre in:\n%s", w.Body.String())
+	}
+	if _, ok := values[`treeserve_usage_cost{path="/lustre",group="*",kind="atime"}`]; !ok {
+		t.Errorf("Expected atime cost for /lustre")
+	}
+	for metric := range values {
+		if strings.Contains(metric, "/nowhere") {
+			t.Errorf("Expected no usage for a path not in the tree, got %s", metric)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package treeserve
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"os/user"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// defaultNameReloadInterval is how often the user and group files are checked for changes
+const defaultNameReloadInterval = time.Minute
+
+// NameSource is a passwd and a group file in getent format to get user and group names from for
+// the paths under Prefix, or for every path if Prefix is ""
+type NameSource struct {
+	Prefix    string
+	UserFile  string
+	GroupFile string
+}
+
+// ParseNameSources parses a comma separated list of <prefix>=<userFile>:<groupFile>. Either
+// file can be left empty.
+func ParseNameSources(s string) (sources []NameSource, err error) {
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefixFiles := strings.SplitN(entry, "=", 2)
+		if len(prefixFiles) != 2 {
+			return nil, fmt.Errorf("name source %s is not <prefix>=<userFile>:<groupFile>", entry)
+		}
+		files := strings.SplitN(prefixFiles[1], ":", 2)
+		if len(files) != 2 {
+			return nil, fmt.Errorf("name source %s is not <prefix>=<userFile>:<groupFile>", entry)
+		}
+		sources = append(sources, NameSource{Prefix: strings.TrimSuffix(prefixFiles[0], "/"), UserFile: files[0], GroupFile: files[1]})
+	}
+	return
+}
+
+// idNames maps ids to names and back
+type idNames struct {
+	byID   map[string]string
+	byName map[string]string
+}
+
+func newIDNames(byID map[string]string) idNames {
+	n := idNames{byID: byID, byName: make(map[string]string, len(byID))}
+	for id, name := range byID {
+		n.byName[name] = id
+	}
+	return n
+}
+
+// nameFile is what was last read from a passwd or group file. For a passwd file memberOf has the
+// primary gid of each user, and for a group file the gids of the groups each user is listed in.
+type nameFile struct {
+	path     string
+	modTime  time.Time
+	size     int64
+	names    idNames
+	memberOf map[string][]string
+}
+
+// readNameFile reads a getent format passwd (name:x:uid:gid:...) or group (name:x:gid:members) file
+func readNameFile(path string, isGroup bool) (f *nameFile, err error) {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err, "path": path}).Error("failed to stat name file")
+		return
+	}
+	f = &nameFile{path: path, modTime: fileInfo.ModTime(), size: fileInfo.Size(), memberOf: make(map[string][]string)}
+	byID := make(map[string]string)
+	err = readLines(path, ":", func(fields []string) {
+		if len(fields) < 3 {
+			return
+		}
+		byID[fields[2]] = fields[0]
+		if len(fields) < 4 {
+			return
+		}
+		if !isGroup {
+			f.memberOf[fields[0]] = append(f.memberOf[fields[0]], fields[3])
+			return
+		}
+		for _, member := range strings.Split(fields[3], ",") {
+			if member = strings.TrimSpace(member); member != "" {
+				f.memberOf[member] = append(f.memberOf[member], fields[2])
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.names = newIDNames(byID)
+	return
+}
+
+// changed is true if the file at f.path is not the one f was read from
+func (f *nameFile) changed() bool {
+	fileInfo, err := os.Stat(f.path)
+	return err == nil && (!fileInfo.ModTime().Equal(f.modTime) || fileInfo.Size() != f.size)
+}
+
+// nameSource is a NameSource and what was read from its files
+type nameSource struct {
+	NameSource
+	users  *nameFile
+	groups *nameFile
+}
+
+// underPrefix is true if path is prefix or under it. Every path is under the prefix "".
+func underPrefix(path string, prefix string) bool {
+	path = strings.TrimSuffix(path, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// appliesTo is true if names from s are used for the tree at path, which is so if path is under
+// s.Prefix or the tree contains it
+func (s *nameSource) appliesTo(path string) bool {
+	path = strings.TrimSuffix(path, "/")
+	return underPrefix(path, s.Prefix) || path == "" || strings.HasPrefix(s.Prefix, path+"/")
+}
+
+// nameResolver turns uids and gids into user and group names and back. Ids are looked up in the
+// sources that apply to a path, the longest prefix first, then with os/user if useOS is set.
+type nameResolver struct {
+	mu         sync.RWMutex
+	sources    []*nameSource
+	useOS      bool
+	osNames    map[string]string // os/user results by kind and key, "" if not found
+	generation int64             // incremented when names change
+}
+
+// configure replaces the sources of names and reads their files
+func (nr *nameResolver) configure(sources []NameSource, useOS bool) {
+	ns := make([]*nameSource, 0, len(sources))
+	for _, s := range sources {
+		s.Prefix = strings.TrimSuffix(s.Prefix, "/")
+		ns = append(ns, &nameSource{NameSource: s})
+	}
+	sort.SliceStable(ns, func(i, j int) bool { return len(ns[i].Prefix) > len(ns[j].Prefix) })
+	nr.mu.Lock()
+	nr.sources = ns
+	nr.useOS = useOS
+	nr.mu.Unlock()
+	nr.reload(true)
+}
+
+// reload reads the files that have changed, or all of them if force is set. A file that cannot
+// be read keeps the names last read from it.
+func (nr *nameResolver) reload(force bool) (changed bool) {
+	nr.mu.RLock()
+	sources := nr.sources
+	nr.mu.RUnlock()
+
+	type update struct {
+		s      *nameSource
+		users  *nameFile
+		groups *nameFile
+	}
+	var updates []update
+	for _, s := range sources {
+		u := update{s: s, users: s.users, groups: s.groups}
+		if s.UserFile != "" && (force || s.users == nil || s.users.changed()) {
+			if f, err := readNameFile(s.UserFile, false); err == nil {
+				u.users = f
+			}
+		}
+		if s.GroupFile != "" && (force || s.groups == nil || s.groups.changed()) {
+			if f, err := readNameFile(s.GroupFile, true); err == nil {
+				u.groups = f
+			}
+		}
+		if u.users != s.users || u.groups != s.groups {
+			updates = append(updates, u)
+		}
+	}
+	if len(updates) == 0 && !force {
+		return
+	}
+
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+	for _, u := range updates {
+		u.s.users, u.s.groups = u.users, u.groups
+		log.WithFields(log.Fields{"prefix": u.s.Prefix, "userFile": u.s.UserFile, "groupFile": u.s.GroupFile}).Info("loaded user and group names")
+	}
+	nr.osNames = nil
+	nr.generation++
+	return true
+}
+
+// getGeneration identifies the names currently loaded, so that output made with older names can
+// be told apart
+func (nr *nameResolver) getGeneration() int64 {
+	nr.mu.RLock()
+	defer nr.mu.RUnlock()
+	return nr.generation
+}
+
+// lookup finds key in the names picked from each source that applies to path
+func (nr *nameResolver) lookup(path string, key string, pick func(s *nameSource) map[string]string) (value string, ok bool) {
+	nr.mu.RLock()
+	defer nr.mu.RUnlock()
+	for _, s := range nr.sources {
+		if !s.appliesTo(path) {
+			continue
+		}
+		if value, ok = pick(s)[key]; ok {
+			return
+		}
+	}
+	return
+}
+
+// lookupOS finds key with os/user, remembering the result until the names are next reloaded
+func (nr *nameResolver) lookupOS(kind string, key string) (value string, ok bool) {
+	nr.mu.Lock()
+	useOS := nr.useOS
+	value, cached := nr.osNames[kind+":"+key]
+	nr.mu.Unlock()
+	if !useOS {
+		return
+	}
+	if cached {
+		return value, value != ""
+	}
+
+	switch kind {
+	case "uid":
+		if u, err := user.LookupId(key); err == nil {
+			value = u.Username
+		}
+	case "gid":
+		if g, err := user.LookupGroupId(key); err == nil {
+			value = g.Name
+		}
+	case "user":
+		if u, err := user.Lookup(key); err == nil {
+			value = u.Uid
+		}
+	case "group":
+		if g, err := user.LookupGroup(key); err == nil {
+			value = g.Gid
+		}
+	}
+
+	nr.mu.Lock()
+	if nr.osNames == nil {
+		nr.osNames = make(map[string]string)
+	}
+	nr.osNames[kind+":"+key] = value
+	nr.mu.Unlock()
+	return value, value != ""
+}
+
+func usersOf(s *nameSource) idNames {
+	if s.users == nil {
+		return idNames{}
+	}
+	return s.users.names
+}
+
+func groupsOf(s *nameSource) idNames {
+	if s.groups == nil {
+		return idNames{}
+	}
+	return s.groups.names
+}
+
+// userName gets the name of the user with uid for the tree at path, the uid if it is not known
+func (nr *nameResolver) userName(path string, uid string) string {
+	if uid == "*" {
+		return uid
+	}
+	if name, ok := nr.lookup(path, uid, func(s *nameSource) map[string]string { return usersOf(s).byID }); ok {
+		return name
+	}
+	if name, ok := nr.lookupOS("uid", uid); ok {
+		return name
+	}
+	return uid
+}
+
+// groupName gets the name of the group with gid for the tree at path, the gid if it is not known
+func (nr *nameResolver) groupName(path string, gid string) string {
+	if gid == "*" {
+		return gid
+	}
+	if name, ok := nr.lookup(path, gid, func(s *nameSource) map[string]string { return groupsOf(s).byID }); ok {
+		return name
+	}
+	if name, ok := nr.lookupOS("gid", gid); ok {
+		return name
+	}
+	return gid
+}
+
+// userID gets the uid of the user called name for the tree at path
+func (nr *nameResolver) userID(path string, name string) (uid string, ok bool) {
+	if uid, ok = nr.lookup(path, name, func(s *nameSource) map[string]string { return usersOf(s).byName }); ok {
+		return
+	}
+	return nr.lookupOS("user", name)
+}
+
+// groupID gets the gid of the group called name for the tree at path
+func (nr *nameResolver) groupID(path string, name string) (gid string, ok bool) {
+	if gid, ok = nr.lookup(path, name, func(s *nameSource) map[string]string { return groupsOf(s).byName }); ok {
+		return
+	}
+	return nr.lookupOS("group", name)
+}
+
+// prefixes gets the distinct prefixes of the sources, the longest first, always ending with ""
+func (nr *nameResolver) prefixes() (prefixes []string) {
+	nr.mu.RLock()
+	defer nr.mu.RUnlock()
+	seen := map[string]bool{"": true}
+	for _, s := range nr.sources {
+		if !seen[s.Prefix] {
+			seen[s.Prefix] = true
+			prefixes = append(prefixes, s.Prefix)
+		}
+	}
+	return append(prefixes, "")
+}
+
+// memberships gets the uid user has and the gids of the groups they are in for the tree at path.
+// The uid and primary gid come from the passwd file, and the other gids from the group file, of
+// the source with the longest prefix path is under that has one. The same name can be a
+// different person on another volume, so other sources are not used.
+func (nr *nameResolver) memberships(path string, user string) (uids []string, gids []string) {
+	nr.mu.RLock()
+	defer nr.mu.RUnlock()
+	var users, groups *nameFile
+	for _, s := range nr.sources {
+		if !underPrefix(path, s.Prefix) {
+			continue
+		}
+		if users == nil && s.UserFile != "" {
+			users = s.users
+			if users == nil {
+				users = &nameFile{}
+			}
+		}
+		if groups == nil && s.GroupFile != "" {
+			groups = s.groups
+			if groups == nil {
+				groups = &nameFile{}
+			}
+		}
+	}
+	if users != nil {
+		if uid, ok := users.names.byName[user]; ok {
+			uids = append(uids, uid)
+		}
+		gids = append(gids, users.memberOf[user]...)
+	}
+	if groups != nil {
+		gids = append(gids, groups.memberOf[user]...)
+	}
+	return
+}
+
+// watchNames reloads the user and group files when they change, checking every NameReloadInterval,
+// and all of them on SIGHUP, until stop is closed
+func (ts *TreeServe) watchNames(stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	var tick <-chan time.Time
+	if ts.NameReloadInterval > 0 {
+		ticker := time.NewTicker(ts.NameReloadInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+			log.Info("reloading user and group names on SIGHUP")
+			ts.names.reload(true)
+		case <-tick:
+			ts.names.reload(false)
+		}
+	}
+}
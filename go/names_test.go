@@ -0,0 +1,139 @@
+package treeserve
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"testing"
+	"time"
+)
+
+func TestParseNameSources(t *testing.T) {
+	sources, err := ParseNameSources("/lustre/s115/=/etc/p115:/etc/g115, /lustre/s116=:/etc/g116")
+	if err != nil {
+		t.Fatalf("failed to parse name sources: %v", err)
+	}
+	if len(sources) != 2 || sources[0] != (NameSource{"/lustre/s115", "/etc/p115", "/etc/g115"}) || sources[1] != (NameSource{"/lustre/s116", "", "/etc/g116"}) {
+		t.Errorf("Unexpected name sources %v", sources)
+	}
+	for _, bad := range []string{"/lustre/s115", "/lustre/s115=/etc/p115"} {
+		if _, err := ParseNameSources(bad); err == nil {
+			t.Errorf("Expected an error for %s", bad)
+		}
+	}
+}
+
+func TestNameResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "names_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name string, content string) string {
+		err := ioutil.WriteFile(dir+"/"+name, []byte(content), 0600)
+		if err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+		return dir + "/" + name
+	}
+	passwd := write("passwd", "alice:x:1:10::/home/alice:/bin/bash\n")
+	group := write("group", "hgi:x:10:\nother:x:20:alice\n")
+	passwd115 := write("passwd115", "alan:x:1:10::/home/alan:/bin/bash\n")
+	passwd115b := write("passwd115b", "eve:x:5:10::/home/eve:/bin/bash\n")
+
+	nr := &nameResolver{}
+	nr.configure([]NameSource{
+		{UserFile: passwd, GroupFile: group},
+		{Prefix: "/lustre/s115", UserFile: passwd115},
+		{Prefix: "/lustre/s115/", UserFile: passwd115b},
+	}, false)
+
+	for _, c := range []struct{ path, uid, name string }{
+		{"/lustre/s115/a", "1", "alan"},
+		{"/lustre/s115", "5", "eve"},
+		{"/lustre", "1", "alan"}, // the tree contains s115
+		{"/lustre/s116", "1", "alice"},
+		{"/lustre/s116", "5", "5"},
+		{"/lustre/s116", "*", "*"},
+	} {
+		if name := nr.userName(c.path, c.uid); name != c.name {
+			t.Errorf("Expected uid %s at %s to be %s, got %s", c.uid, c.path, c.name, name)
+		}
+	}
+	if name := nr.groupName("/lustre/s115", "20"); name != "other" {
+		t.Errorf("Expected group 20 to be other, got %s", name)
+	}
+	if uid, ok := nr.userID("/lustre/s115", "alan"); !ok || uid != "1" {
+		t.Errorf("Expected alan to be uid 1, got %s %v", uid, ok)
+	}
+	if _, ok := nr.userID("/lustre/s116", "alan"); ok {
+		t.Errorf("Expected alan not to be known outside s115")
+	}
+	if gid, ok := nr.groupID("/", "other"); !ok || gid != "20" {
+		t.Errorf("Expected other to be gid 20, got %s %v", gid, ok)
+	}
+	uids, gids := nr.memberships("/lustre/s116", "alice")
+	if len(uids) != 1 || uids[0] != "1" || len(gids) != 2 {
+		t.Errorf("Unexpected memberships of alice %v %v", uids, gids)
+	}
+	// s115 has its own passwd file but uses the groups of every path
+	uids, gids = nr.memberships("/lustre/s115/a", "alice")
+	if len(uids) != 0 || len(gids) != 1 || gids[0] != "20" {
+		t.Errorf("Unexpected memberships of alice in s115 %v %v", uids, gids)
+	}
+	if uids, gids = nr.memberships("/lustre/s116", "alan"); len(uids) != 0 || len(gids) != 0 {
+		t.Errorf("Expected alan to have no ids outside s115, got %v %v", uids, gids)
+	}
+
+	// uid 1 is alan in s115 and alice everywhere else, so each only sees their own files
+	auth := &authenticator{names: nr}
+	files := Aggregates{Group: "*", User: "1"}
+	alan, alice := auth.principal("alan"), auth.principal("alice")
+	if !alan.sees("/lustre/s115/a", files) || alan.sees("/lustre/s116", files) || alan.sees("/lustre", files) {
+		t.Errorf("Expected alan to only see uid 1 in s115")
+	}
+	if alice.sees("/lustre/s115/a", files) || !alice.sees("/lustre/s116", files) {
+		t.Errorf("Expected alice to see uid 1 everywhere but s115")
+	}
+	if alan.cacheKey() == alice.cacheKey() {
+		t.Errorf("Expected alan and alice to have different cache keys, got %s", alan.cacheKey())
+	}
+
+	// changed files are reloaded
+	generation := nr.getGeneration()
+	if nr.reload(false) {
+		t.Errorf("Expected nothing to reload")
+	}
+	write("passwd", "albert:x:1:10::/home/albert:/bin/bash\n")
+	later := time.Now().Add(time.Minute)
+	err = os.Chtimes(passwd, later, later)
+	if err != nil {
+		t.Fatalf("failed to change mtime: %v", err)
+	}
+	if !nr.reload(false) || nr.getGeneration() == generation {
+		t.Errorf("Expected the changed passwd file to be reloaded")
+	}
+	if name := nr.userName("/lustre/s116", "1"); name != "albert" {
+		t.Errorf("Expected uid 1 to be albert after reloading, got %s", name)
+	}
+
+	// a file that has gone keeps the names last read from it
+	os.Remove(group)
+	nr.reload(true)
+	if name := nr.groupName("", "10"); name != "hgi" {
+		t.Errorf("Expected gid 10 to still be hgi, got %s", name)
+	}
+
+	// ids not in the files are looked up with os/user
+	current, err := user.Current()
+	if err == nil {
+		nr.configure(nil, true)
+		if name := nr.userName("", current.Uid); name != current.Username {
+			t.Errorf("Expected uid %s to be %s from os/user, got %s", current.Uid, current.Username, name)
+		}
+		if uid, ok := nr.userID("", current.Username); !ok || uid != current.Uid {
+			t.Errorf("Expected %s to be uid %s from os/user, got %s", current.Username, current.Uid, uid)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package treeserve
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// nestedVisitor writes the nested /tree JSON as the tree is walked. The output is the same as
+// json.Marshal of a fullTree.
+type nestedVisitor struct {
+	ts       *TreeServe
+	w        *bufio.Writer
+	limit    *limitedResponse
+	siblings []int // how many children have been written at each level on the way down
+}
+
+func (nv *nestedVisitor) enter(t *dirTree, parent *dirTree, level int) (err error) {
+	err = nv.limit.node()
+	if err != nil {
+		return
+	}
+	if level > 0 {
+		if nv.siblings[level-1] > 0 {
+			nv.w.WriteByte(',')
+		}
+		nv.siblings[level-1]++
+	}
+	nv.w.WriteByte('{')
+	if len(t.ChildDirs) > 0 {
+		nv.w.WriteString(`"child_dirs":[`)
+		nv.siblings = append(nv.siblings[:level], 0)
+	}
+	return
+}
+
+func (nv *nestedVisitor) leave(t *dirTree, level int) (err error) {
+	if len(t.ChildDirs) > 0 {
+		nv.w.WriteString("],")
+	}
+	if t.TotalChildDirs > 0 {
+		nv.w.WriteString(`"total_child_dirs":` + strconv.Itoa(t.TotalChildDirs) + ",")
+	}
+
+	data, err := nv.ts.organiseAggregates(t.Path, t.stats)
+	LogError(err)
+	j, err := json.Marshal(data)
+	if err != nil {
+		return
+	}
+	nv.w.WriteString(`"data":`)
+	nv.w.Write(j)
+
+	j, err = json.Marshal(t.Name)
+	if err != nil {
+		return
+	}
+	nv.w.WriteString(`,"name":`)
+	nv.w.Write(j)
+
+	j, err = json.Marshal(t.Path)
+	if err != nil {
+		return
+	}
+	nv.w.WriteString(`,"path":`)
+	nv.w.Write(j)
+	_, err = nv.w.WriteString("}")
+	return
+}
+
+// writeNestedTree streams the nested JSON for the tree at nodeKey to w
+func (ts *TreeServe) writeNestedTree(w http.ResponseWriter, nodeKey *Md5Key, path string, depth int, filter *aggregateFilter, arrangement *childArrangement) *APIError {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	limit := ts.newLimitedResponse(w)
+	bw := bufio.NewWriter(limit)
+	nv := &nestedVisitor{ts: ts, w: bw, limit: limit}
+
+	date, err := json.Marshal(ts.scanDate.String())
+	if err == nil {
+		bw.WriteString(`{"date":`)
+		bw.Write(date)
+		bw.WriteString(`,"tree":`)
+		err = ts.walkTree(nodeKey, depth, filter, arrangement, nv)
+	}
+	if err == nil {
+		bw.WriteString("}")
+		err = bw.Flush()
+	}
+	return limit.finish(path, err)
+}
@@ -0,0 +1,213 @@
+package treeserve
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressEventInterval is how often progress is sent to clients following it as server-sent events
+const progressEventInterval = time.Second
+
+// buildProgress is what has been done in the current phase of a build. The counts are updated
+// atomically by the workers and read by the web server.
+type buildProgress struct {
+	mu         sync.Mutex
+	phaseStart time.Time
+	inputBytes int64 // compressed bytes of input read so far
+	inputSize  int64
+	linesRead  int64
+	totalNodes int64 // nodes to finalize
+}
+
+// startPhase records when a phase of the build started
+func (bp *buildProgress) startPhase() {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.phaseStart = time.Now()
+}
+
+func (bp *buildProgress) started() time.Time {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	return bp.phaseStart
+}
+
+// countingReader counts the bytes read from r into n
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err error) {
+	n, err = cr.r.Read(p)
+	atomic.AddInt64(cr.n, int64(n))
+	return
+}
+
+// Progress is a snapshot of how far a build has got
+type Progress struct {
+	Phase                   string     `json:"phase"`
+	PhaseStarted            *time.Time `json:"phase_started,omitempty"`
+	ElapsedSeconds          float64    `json:"elapsed_seconds"`
+	NodesCreated            int64      `json:"nodes_created"`
+	NodesFinalized          int64      `json:"nodes_finalized"`
+	LinesRead               int64      `json:"lines_read"`
+	LinesPerSecond          float64    `json:"lines_per_second"`
+	NodesFinalizedPerSecond float64    `json:"nodes_finalized_per_second"`
+	FractionDone            float64    `json:"fraction_done"`         // of the current phase
+	ETASeconds              *float64   `json:"eta_seconds,omitempty"` // until the current phase is done
+	ETA                     *time.Time `json:"eta,omitempty"`
+}
+
+// GetProgress reports the state of the tree and how far the current phase of building it has got.
+// Input progress is estimated from how much of the input file has been read, and finalize progress
+// from how many of the nodes have been finalized.
+func (ts *TreeServe) GetProgress() (p Progress, err error) {
+	p.Phase, err = ts.GetState()
+	if err != nil {
+		return
+	}
+	bp := &ts.progress
+	p.NodesCreated = atomic.LoadInt64(&ts.NodesCreated)
+	p.NodesFinalized = atomic.LoadInt64(&ts.NodesFinalized)
+	p.LinesRead = atomic.LoadInt64(&bp.linesRead)
+
+	if p.Phase == "treeReady" {
+		p.FractionDone = 1
+		return
+	}
+	started := bp.started()
+	if started.IsZero() {
+		return
+	}
+	p.PhaseStarted = &started
+	elapsed := time.Since(started).Seconds()
+	p.ElapsedSeconds = elapsed
+
+	switch p.Phase {
+	case "inputProcessing":
+		if elapsed > 0 {
+			p.LinesPerSecond = float64(p.LinesRead) / elapsed
+		}
+		if size := atomic.LoadInt64(&bp.inputSize); size > 0 {
+			p.FractionDone = float64(atomic.LoadInt64(&bp.inputBytes)) / float64(size)
+		}
+	case "finalize":
+		if elapsed > 0 {
+			p.NodesFinalizedPerSecond = float64(p.NodesFinalized) / elapsed
+		}
+		if total := atomic.LoadInt64(&bp.totalNodes); total > 0 {
+			p.FractionDone = float64(p.NodesFinalized) / float64(total)
+		}
+	default:
+		return
+	}
+	if p.FractionDone > 1 {
+		p.FractionDone = 1
+	}
+	if p.FractionDone > 0 {
+		eta := elapsed * (1 - p.FractionDone) / p.FractionDone
+		at := time.Now().Add(time.Duration(eta * float64(time.Second)))
+		p.ETASeconds = &eta
+		p.ETA = &at
+	}
+	return
+}
+
+// errNoBuildOpen is the error for requests while a server has no build open, because it could
+// neither open a new one nor go back to the one it was serving
+var errNoBuildOpen = errors.New("no build is open, switching to a new build failed")
+
+// healthz handles liveness checks, it succeeds whenever the server is running
+func (ts *TreeServe) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, []byte(`{"status":"ok"}`))
+}
+
+// readyz handles readiness checks, it only succeeds once the tree is ready to serve
+func (ts *TreeServe) readyz(w http.ResponseWriter, r *http.Request) {
+	if apiErr := ts.checkReady(w); apiErr != nil {
+		writeAPIError(w, apiErr)
+		return
+	}
+	writeJSON(w, []byte(`{"status":"ready"}`))
+}
+
+// progressHandler handles requests for the progress of a build. A client accepting text/event-stream
+// is sent the progress every progressEventInterval until the tree is ready.
+func (ts *TreeServe) progressHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot := func() (p Progress, err error) {
+		ts.lmdbSwapLock.RLock()
+		defer ts.lmdbSwapLock.RUnlock()
+		if !ts.lmdbOpen {
+			return p, errNoBuildOpen
+		}
+		return ts.GetProgress()
+	}
+
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		p, err := snapshot()
+		if err == errNoBuildOpen {
+			writeAPIError(w, notReady("%s", err))
+			return
+		}
+		if err != nil {
+			writeAPIError(w, internalError("", err))
+			return
+		}
+		j, err := json.Marshal(p)
+		if err != nil {
+			writeAPIError(w, internalError("", err))
+			return
+		}
+		writeJSON(w, j)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, &APIError{Status: http.StatusNotAcceptable, Code: errorBadRequest, Message: "server-sent events are not supported on this connection"})
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	ticker := time.NewTicker(progressEventInterval)
+	defer ticker.Stop()
+	for {
+		// the lock is only held for each snapshot so that the build can be published meanwhile
+		p, err := snapshot()
+		if err != nil {
+			LogError(err)
+			return
+		}
+		j, err := json.Marshal(p)
+		if err != nil {
+			LogError(err)
+			return
+		}
+		_, err = fmt.Fprintf(w, "event: progress\ndata: %s\n\n", j)
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+		if p.Phase == "treeReady" {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ts.webserverClosing:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package treeserve
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProgress(t *testing.T) {
+	lmdbDir, err := ioutil.TempDir("", "progress_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory for LMDB: %v", err)
+	}
+	defer os.RemoveAll(lmdbDir)
+
+	ts := NewTreeServe(lmdbDir+"/lmdb", 64*1024*1024, 2000, 1000, -1, 1000, -1, false)
+	err = ts.OpenLMDB()
+	if err != nil {
+		t.Fatalf("failed to open LMDB: %v", err)
+	}
+	defer ts.CloseLMDB()
+
+	get := func(h http.HandlerFunc, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	// a quarter of the way through the input
+	err = ts.SetState("inputProcessing")
+	if err != nil {
+		t.Fatalf("failed to set state: %v", err)
+	}
+	ts.progress.startPhase()
+	atomic.StoreInt64(&ts.progress.inputSize, 400)
+	atomic.StoreInt64(&ts.progress.inputBytes, 100)
+	atomic.StoreInt64(&ts.progress.linesRead, 10)
+
+	if w := get(ts.healthz, "/healthz"); w.Code != http.StatusOK {
+		t.Errorf("Expected healthz to succeed while building, got %d", w.Code)
+	}
+	if w := get(ts.readyz, "/readyz"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected readyz to fail while building, got %d", w.Code)
+	}
+
+	w := get(ts.progressHandler, "/progress")
+	var p Progress
+	err = json.Unmarshal(w.Body.Bytes(), &p)
+	if err != nil {
+		t.Fatalf("failed to unmarshal progress %s: %v", w.Body.String(), err)
+	}
+	if p.Phase != "inputProcessing" || p.LinesRead != 10 || p.FractionDone != 0.25 {
+		t.Errorf("Expected a quarter of the input read, got %+v", p)
+	}
+	if p.PhaseStarted == nil || p.ETASeconds == nil || p.ETA == nil || p.LinesPerSecond <= 0 {
+		t.Errorf("Expected a rate and an ETA, got %s", w.Body.String())
+	}
+
+	// half of the nodes finalized
+	err = ts.SetState("finalize")
+	if err != nil {
+		t.Fatalf("failed to set state: %v", err)
+	}
+	ts.progress.startPhase()
+	atomic.StoreInt64(&ts.progress.totalNodes, 8)
+	atomic.StoreInt64(&ts.NodesFinalized, 4)
+	p, err = ts.GetProgress()
+	if err != nil {
+		t.Fatalf("failed to get progress: %v", err)
+	}
+	if p.FractionDone != 0.5 || p.ETASeconds == nil {
+		t.Errorf("Expected half the nodes finalized, got %+v", p)
+	}
+
+	// events are sent until the tree is ready
+	server := httptest.NewServer(http.HandlerFunc(ts.progressHandler))
+	defer server.Close()
+	r, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatalf("failed to make request: %v", err)
+	}
+	r.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatalf("failed to get progress events: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Expected text/event-stream, got %s", resp.Header.Get("Content-Type"))
+	}
+	var phases []string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if !strings.HasPrefix(scanner.Text(), "data: ") {
+			continue
+		}
+		err = json.Unmarshal([]byte(strings.TrimPrefix(scanner.Text(), "data: ")), &p)
+		if err != nil {
+			t.Fatalf("failed to unmarshal event %s: %v", scanner.Text(), err)
+		}
+		phases = append(phases, p.Phase)
+		if len(phases) == 1 {
+			err = ts.SetState("treeReady")
+			if err != nil {
+				t.Fatalf("failed to set state: %v", err)
+			}
+		}
+	}
+	if len(phases) != 2 || phases[0] != "finalize" || phases[1] != "treeReady" {
+		t.Errorf("Expected finalize then treeReady events, got %v", phases)
+	}
+
+	if w := get(ts.readyz, "/readyz"); w.Code != http.StatusOK {
+		t.Errorf("Expected readyz to succeed once ready, got %d", w.Code)
+	}
+}
@@ -0,0 +1,172 @@
+package treeserve
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// noProject is the project of paths not matched by any pattern in the project file
+const noProject = "(none)"
+
+// Project is who the contents of the directories matching Pattern, a path prefix or a glob, are
+// billed to
+type Project struct {
+	Pattern    string `json:"pattern"`
+	Project    string `json:"project"`
+	PI         string `json:"pi,omitempty"`
+	CostCentre string `json:"cost_centre,omitempty"`
+}
+
+// isGlob is true if the pattern of p has any of the special characters of path.Match
+func (p Project) isGlob() bool {
+	return strings.ContainsAny(p.Pattern, "*?[")
+}
+
+// match gets how specific the match of p to filePath is, the number of path components of the
+// pattern plus one, or 0 if it does not match. A glob matches the path components under it too.
+func (p Project) match(filePath string) int {
+	if !p.isGlob() {
+		if filePath == p.Pattern || strings.HasPrefix(filePath, p.Pattern+"/") || p.Pattern == "" {
+			return strings.Count(p.Pattern, "/") + 1
+		}
+		return 0
+	}
+	n := strings.Count(p.Pattern, "/")
+	parts := strings.SplitN(filePath, "/", n+2)
+	if len(parts) <= n {
+		return 0
+	}
+	if ok, _ := path.Match(p.Pattern, strings.Join(parts[:n+1], "/")); ok {
+		return n + 1
+	}
+	return 0
+}
+
+// LoadProjectFile reads a file of <path prefix or glob> <project> [<PI> [<cost centre>]] lines,
+// separated by tabs or, in lines without tabs, spaces. Blank lines and those starting with # are
+// ignored. A project can be on more than one line, but always with the same PI and cost centre.
+func LoadProjectFile(projectFile string) (projects []Project, err error) {
+	f, err := os.Open(projectFile)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err, "projectFile": projectFile}).Error("failed to open project file")
+		return
+	}
+	defer f.Close()
+	seen := make(map[string]Project)
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var fields []string
+		if strings.Contains(line, "\t") {
+			for _, field := range strings.Split(line, "\t") {
+				fields = append(fields, strings.TrimSpace(field))
+			}
+		} else {
+			fields = strings.Fields(line)
+		}
+		if len(fields) < 2 || len(fields) > 4 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("%s line %d is not <path prefix or glob> <project> [<PI> [<cost centre>]]", projectFile, lineNumber)
+		}
+		p := Project{Pattern: strings.TrimSuffix(fields[0], "/"), Project: fields[1]}
+		if len(fields) > 2 {
+			p.PI = fields[2]
+		}
+		if len(fields) > 3 {
+			p.CostCentre = fields[3]
+		}
+		if !strings.HasPrefix(fields[0], "/") {
+			return nil, fmt.Errorf("%s line %d: %s is not an absolute path", projectFile, lineNumber, fields[0])
+		}
+		if _, err = path.Match(p.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s line %d: bad glob %s: %v", projectFile, lineNumber, p.Pattern, err)
+		}
+		if previous, ok := seen[p.Project]; ok && (previous.PI != p.PI || previous.CostCentre != p.CostCentre) {
+			return nil, fmt.Errorf("%s line %d: project %s has a different PI or cost centre than before", projectFile, lineNumber, p.Project)
+		}
+		seen[p.Project] = p
+		projects = append(projects, p)
+	}
+	err = scanner.Err()
+	return
+}
+
+// SetProjects sets the projects the project dimension is worked out from, and enables it with
+// its own rollup, which the chargeback report needs. If the project dimension was not asked for,
+// it is only kept on its own, not in every combination with the other dimensions.
+func (ts *TreeServe) SetProjects(projects []Project) {
+	ts.Projects = projects
+	enabled := false
+	for _, d := range ts.Dimensions {
+		enabled = enabled || d == dimensionProject
+	}
+	if !enabled {
+		if ts.Rollups == nil {
+			ts.Rollups = ts.rollupCombinations()[1:]
+		}
+		ts.Dimensions, _ = ParseDimensions(strings.Join(append(append([]string{}, ts.Dimensions...), dimensionProject), ","))
+	}
+	if ts.Rollups == nil {
+		// every combination of the dimensions asked for, which includes project alone
+		return
+	}
+	for _, c := range ts.Rollups {
+		if len(c) == 1 && c[0] == dimensionProject {
+			return
+		}
+	}
+	ts.Rollups = append(ts.Rollups, []string{dimensionProject})
+}
+
+// projectOf gets the project of the most specific pattern in ts.Projects that matches filePath,
+// the first in the file if there is more than one
+func (ts *TreeServe) projectOf(filePath string) (project string) {
+	project = noProject
+	best := 0
+	for _, p := range ts.Projects {
+		if m := p.match(filePath); m > best {
+			project = p.Project
+			best = m
+		}
+	}
+	return
+}
+
+// saveProjects saves the projects the tree is built with, for the chargeback report
+func (ts *TreeServe) saveProjects() (err error) {
+	j, err := json.Marshal(ts.Projects)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to marshal projects")
+		return
+	}
+	return ts.SetMetadata("projects", string(j))
+}
+
+// getProjects gets the PI and cost centre of each project the tree was built with
+func (ts *TreeServe) getProjects() (projects map[string]Project, err error) {
+	projects = make(map[string]Project)
+	j, err := ts.GetMetadata("projects")
+	if err != nil || j == "" {
+		return
+	}
+	var saved []Project
+	err = json.Unmarshal([]byte(j), &saved)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to parse projects saved in tree")
+		return
+	}
+	for _, p := range saved {
+		projects[p.Project] = p
+	}
+	return
+}
@@ -0,0 +1,152 @@
+package treeserve
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Version of treeserve, set at build time with -ldflags "-X github.com/wtsi-hgi/treeserve/go.Version=..."
+var Version = "dev"
+
+// CostModel describes how the costs in a tree are calculated
+type CostModel struct {
+	PerTiBYear    float64 `json:"per_tib_year"`
+	SecondsInYear int64   `json:"seconds_in_year"`
+	Description   string  `json:"description"`
+}
+
+// costModel is the model used for the costs output
+var costModel = CostModel{
+	PerTiBYear:    costPerTibYear,
+	SecondsInYear: secondsInYear,
+	Description:   "size in TiB times years from the file's atime, mtime or ctime to the cost reference time, times the cost per TiB year",
+}
+
+// BuildInfo records what a tree was built from and how. It is filled in as the build goes
+// through the states and saved in the tree.
+type BuildInfo struct {
+	BuildID           string            `json:"build_id"`
+	InputPath         string            `json:"input_path,omitempty"`
+	InputSize         int64             `json:"input_size,omitempty"`
+	InputModTime      time.Time         `json:"input_mtime"`
+	ScanDate          time.Time         `json:"scan_date"` // when the input was made, taken to be its mtime
+	InputLines        int64             `json:"input_lines"`
+	InputTruncated    bool              `json:"input_truncated,omitempty"` // stopped early by StopInputAfterNLines
+	NodesCreated      int64             `json:"nodes_created"`
+	CostReferenceTime int64             `json:"cost_reference_time"`
+	TagRules          []TagRule         `json:"tag_rules"`
+	Dimensions        []string          `json:"dimensions,omitempty"` // what aggregates are broken down by
+	Rollups           []string          `json:"rollups,omitempty"`    // combinations of dimensions kept besides all "*"
+	CostModel         CostModel         `json:"cost_model"`
+	HistogramBuckets  *HistogramBuckets `json:"histogram_buckets,omitempty"`
+	DataQuality       map[string]int64  `json:"data_quality,omitempty"` // how many of each problem /api/v2/quality has samples of
+	BuildStart        time.Time         `json:"build_start"`
+	BuildEnd          time.Time         `json:"build_end"`
+	Version           string            `json:"version"`
+	GoVersion         string            `json:"go_version"`
+}
+
+// GetBuildInfo gets the build info saved in the tree. Trees built before it was saved only have
+// what can be found from elsewhere.
+func (ts *TreeServe) GetBuildInfo() (info *BuildInfo, err error) {
+	info = &BuildInfo{}
+	j, err := ts.GetMetadata("buildInfo")
+	if err != nil {
+		return
+	}
+	if j != "" {
+		err = json.Unmarshal([]byte(j), info)
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("failed to parse build info saved in tree")
+			return
+		}
+	}
+	info.BuildID = ts.buildID
+	info.CostReferenceTime = ts.CostReferenceTime
+	// every tree that can be opened has the histograms of this version
+	info.HistogramBuckets = &histogramBucketNames
+	return
+}
+
+// updateBuildInfo changes the saved build info with update
+func (ts *TreeServe) updateBuildInfo(update func(info *BuildInfo)) (err error) {
+	info, err := ts.GetBuildInfo()
+	if err != nil {
+		return
+	}
+	update(info)
+	j, err := json.Marshal(info)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to marshal build info")
+		return
+	}
+	err = ts.SetMetadata("buildInfo", string(j))
+	return
+}
+
+// startBuildInfo records the input and how this build works when input processing starts
+func (ts *TreeServe) startBuildInfo(inputPath string) (err error) {
+	fileInfo, err := os.Stat(inputPath)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"inputPath": inputPath,
+		}).Error("failed to stat input")
+		return
+	}
+	absPath, err := filepath.Abs(inputPath)
+	if err != nil {
+		absPath = inputPath
+	}
+	return ts.updateBuildInfo(func(info *BuildInfo) {
+		*info = BuildInfo{
+			InputPath:    absPath,
+			InputSize:    fileInfo.Size(),
+			InputModTime: fileInfo.ModTime().UTC(),
+			ScanDate:     fileInfo.ModTime().UTC(),
+			TagRules:     TagRules,
+			CostModel:    costModel,
+			BuildStart:   time.Now().UTC(),
+			Version:      Version,
+			GoVersion:    runtime.Version(),
+		}
+	})
+}
+
+// loadScanDate gets the date of the scan the tree being served was built from. Trees built before
+// it was saved use the cost reference time, which is the closest there is.
+func (ts *TreeServe) loadScanDate() {
+	ts.scanDate = time.Unix(ts.CostReferenceTime, 0).UTC()
+	info, err := ts.GetBuildInfo()
+	LogError(err)
+	if err == nil && !info.ScanDate.IsZero() {
+		ts.scanDate = info.ScanDate
+	}
+}
+
+// apiInfo is the response for /api/v2/info
+type apiInfo struct {
+	Build         *BuildInfo `json:"build"`
+	SchemaVersion int        `json:"schema_version"`
+	ServerVersion string     `json:"server_version"`
+}
+
+// info handles requests for the provenance of the tree being served
+func (ts *TreeServe) info(w http.ResponseWriter, r *http.Request) *APIError {
+	build, err := ts.GetBuildInfo()
+	if err != nil {
+		return internalError("", err)
+	}
+	j, err := json.Marshal(apiInfo{Build: build, SchemaVersion: SchemaVersion, ServerVersion: Version})
+	if err != nil {
+		return internalError("", err)
+	}
+	writeJSON(w, j)
+	return nil
+}
@@ -0,0 +1,103 @@
+package treeserve
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildInfo(t *testing.T) {
+	lmdbDir, err := ioutil.TempDir("", "provenance_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory for LMDB: %v", err)
+	}
+	defer os.RemoveAll(lmdbDir)
+
+	inputPath := lmdbDir + "/input.dat.gz"
+	f, err := os.Create(inputPath)
+	if err != nil {
+		t.Fatalf("failed to create input: %v", err)
+	}
+	gz := gzip.NewWriter(f)
+	gz.Write([]byte(strings.Join(testTreeLines, "\n") + "\n"))
+	gz.Close()
+	f.Close()
+	scanDate := time.Date(2017, 3, 1, 4, 5, 6, 0, time.UTC)
+	err = os.Chtimes(inputPath, scanDate, scanDate)
+	if err != nil {
+		t.Fatalf("failed to set input mtime: %v", err)
+	}
+	inputInfo, err := os.Stat(inputPath)
+	if err != nil {
+		t.Fatalf("failed to stat input: %v", err)
+	}
+
+	servingPath := lmdbDir + "/lmdb"
+	err = MakeStagingDir(servingPath)
+	if err != nil {
+		t.Fatalf("failed to create staging directory: %v", err)
+	}
+	ts := NewTreeServe(StagingPath(servingPath), 64*1024*1024, 2000, 1000, -1, 1000, -1, false)
+	err = ts.OpenLMDB()
+	if err != nil {
+		t.Fatalf("failed to open LMDB: %v", err)
+	}
+	defer ts.CloseLMDB()
+	before := time.Now().UTC()
+	err = ts.ProcessInput(inputPath, 2)
+	if err != nil {
+		t.Fatalf("failed to process input: %v", err)
+	}
+	err = ts.Finalize("/", 2)
+	if err != nil {
+		t.Fatalf("failed to finalize: %v", err)
+	}
+	err = ts.PublishBuild(servingPath, true)
+	if err != nil {
+		t.Fatalf("failed to publish build: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	ts.apiHandler(ts.info)(w, httptest.NewRequest("GET", apiPrefix+"/info", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var info apiInfo
+	err = json.Unmarshal(w.Body.Bytes(), &info)
+	if err != nil {
+		t.Fatalf("failed to unmarshal info: %v", err)
+	}
+	build := info.Build
+	if build.BuildID == "" || build.BuildID != ts.buildID {
+		t.Errorf("Expected build id %s, got %s", ts.buildID, build.BuildID)
+	}
+	if build.InputPath != inputPath || build.InputSize != inputInfo.Size() {
+		t.Errorf("Expected input %s of %d bytes, got %s of %d", inputPath, inputInfo.Size(), build.InputPath, build.InputSize)
+	}
+	if !build.ScanDate.Equal(scanDate) || !build.InputModTime.Equal(scanDate) {
+		t.Errorf("Expected scan date %v, got %v", scanDate, build.ScanDate)
+	}
+	if build.InputLines != int64(len(testTreeLines)) || build.InputTruncated {
+		t.Errorf("Expected %d lines, got %d", len(testTreeLines), build.InputLines)
+	}
+	if build.CostReferenceTime != 2000 || build.CostModel.PerTiBYear != costPerTibYear || len(build.TagRules) != len(TagRules) {
+		t.Errorf("Expected cost reference time, cost model and tag rules, got %+v", build)
+	}
+	if build.BuildStart.Before(before.Truncate(time.Second)) || build.BuildEnd.Before(build.BuildStart) {
+		t.Errorf("Expected build to start after %v and end after it started, got %v to %v", before, build.BuildStart, build.BuildEnd)
+	}
+	if build.Version != Version || info.ServerVersion != Version || info.SchemaVersion != SchemaVersion {
+		t.Errorf("Expected versions, got %+v", info)
+	}
+
+	// /tree gives the scan date, not the time of the request
+	if ft := getTestTree(t, ts, "path=/lustre&depth=0"); ft.Date != scanDate.String() {
+		t.Errorf("Expected date %s, got %s", scanDate.String(), ft.Date)
+	}
+}
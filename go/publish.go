@@ -0,0 +1,386 @@
+package treeserve
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Builds are written to a staging directory next to the serving environment, and only published
+// once they have been synced to disk and validated, so the serving environment is never left half
+// built by a crash. Each published build keeps its own directory, and so its own LMDB lock file,
+// and the serving path is a link to the environment in it that is swapped to publish the next
+// one. A server still using the previous build never opens the next one with its lock file.
+const buildsSuffix = ".builds"
+
+// stagingDir is the directory in the builds directory that a build is written to
+const stagingDir = "staging"
+
+// buildsPath returns the directory the builds published to lmdbPath are kept in
+func buildsPath(lmdbPath string) string {
+	return lmdbPath + buildsSuffix
+}
+
+// StagingPath returns the path of the environment a build is written to before it is published
+func StagingPath(lmdbPath string) string {
+	return filepath.Join(buildsPath(lmdbPath), stagingDir, filepath.Base(lmdbPath))
+}
+
+// MakeStagingDir creates the directory of the staging environment for lmdbPath if it is not there
+func MakeStagingDir(lmdbPath string) (err error) {
+	dir := filepath.Dir(StagingPath(lmdbPath))
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+			"dir": dir,
+		}).Error("failed to create staging directory")
+	}
+	return
+}
+
+// CanResumeBuild checks whether the build at LMDBPath, which is not open, was interrupted after
+// it had read all of inputPath as it is now, so that it can carry on from its state instead of
+// being started again. Anything before a state is on disk once it is set.
+func (ts *TreeServe) CanResumeBuild(inputPath string) bool {
+	if _, err := os.Stat(ts.LMDBPath); err != nil {
+		return false
+	}
+	err := ts.OpenLMDB()
+	if err != nil {
+		return false
+	}
+	defer ts.CloseLMDB()
+	state, err := ts.GetState()
+	if err != nil || (state != "inputProcessed" && state != "finalize" && state != "finalized") {
+		return false
+	}
+	info, err := ts.GetBuildInfo()
+	if err != nil {
+		return false
+	}
+	fileInfo, err := os.Stat(inputPath)
+	if err != nil {
+		return false
+	}
+	absPath, err := filepath.Abs(inputPath)
+	if err != nil {
+		absPath = inputPath
+	}
+	return info.InputPath == absPath && info.InputSize == fileInfo.Size() && info.InputModTime.Equal(fileInfo.ModTime().UTC())
+}
+
+// lockPath returns the path of the lock file LMDB keeps alongside an environment opened with NoSubdir
+func lockPath(lmdbPath string) string {
+	return lmdbPath + "-lock"
+}
+
+// RemoveLMDB deletes an LMDB environment and its lock file, such as one left by an incomplete build
+func RemoveLMDB(lmdbPath string) (err error) {
+	for _, p := range []string{lmdbPath, lockPath(lmdbPath)} {
+		err = os.Remove(p)
+		if err != nil && !os.IsNotExist(err) {
+			log.WithFields(log.Fields{
+				"err":  err,
+				"path": p,
+			}).Error("failed to remove LMDB file")
+			return
+		}
+		err = nil
+	}
+	return
+}
+
+// ValidateBuild checks that a finished build is complete enough to serve
+func (ts *TreeServe) ValidateBuild() (err error) {
+	rootKey := ts.getPathKey("/")
+	haveRoot, err := ts.TreeNodeDB.HasKey(rootKey)
+	if err != nil {
+		return
+	}
+	if !haveRoot {
+		err = fmt.Errorf("build has no root node")
+		return
+	}
+
+	rootStats, err := ts.StatMappingsDB.GetKeySet(rootKey)
+	if err != nil {
+		return
+	}
+	if len(rootStats) == 0 {
+		if ts.StopFinalizeAfterNNodes < 0 {
+			err = fmt.Errorf("build has no aggregate stats for the root node")
+			return
+		}
+		log.Warn("finalize was stopped early, root node has no aggregate stats")
+	}
+
+	// every stat mapping saved for a node has one of each aggregate value
+	statMappingStat, err := ts.StatMappingDB.Stat()
+	if err != nil {
+		return
+	}
+	for _, db := range []*DBCommon{&ts.StatMappingsDB.DBCommon, &ts.AggregateSizeDB.DBCommon, &ts.AggregateCountDB.DBCommon,
+		&ts.AggregateCreateCostDB.DBCommon, &ts.AggregateModifyCostDB.DBCommon, &ts.AggregateAccessCostDB.DBCommon} {
+		dbStat, err := db.Stat()
+		if err != nil {
+			return err
+		}
+		if dbStat.Entries != statMappingStat.Entries {
+			return fmt.Errorf("%s database has %d entries but %s has %d", db.Name, dbStat.Entries, ts.StatMappingDB.Name, statMappingStat.Entries)
+		}
+	}
+	return
+}
+
+// PublishBuild syncs and validates the environment that has just been built in the staging
+// directory for servingPath, marks it ready, moves the directory to one of its own and switches
+// the link at servingPath to it. Builds before the one it replaces are removed. If reopen is true
+// the environment is opened again through servingPath, otherwise it is left closed.
+func (ts *TreeServe) PublishBuild(servingPath string, reopen bool) (err error) {
+	if ts.LMDBPath != StagingPath(servingPath) {
+		err = fmt.Errorf("build at %s is not in the staging directory for %s", ts.LMDBPath, servingPath)
+		return
+	}
+	err = ts.ValidateBuild()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":      err,
+			"LMDBPath": ts.LMDBPath,
+		}).Error("build failed validation, not publishing")
+		return
+	}
+
+	buildID, err := newBuildID()
+	if err != nil {
+		return
+	}
+	err = ts.SetMetadata("buildID", buildID)
+	if err != nil {
+		return
+	}
+	ts.buildID = buildID
+	err = ts.updateBuildInfo(func(info *BuildInfo) {
+		info.BuildEnd = time.Now().UTC()
+	})
+	if err != nil {
+		return
+	}
+
+	// this syncs the build to disk
+	err = ts.SetState("treeReady")
+	if err != nil {
+		return
+	}
+
+	// the web server may be using the environment to report progress
+	ts.lmdbSwapLock.Lock()
+	defer ts.lmdbSwapLock.Unlock()
+
+	stagingPath := ts.LMDBPath
+	ts.CloseLMDB()
+
+	builds := buildsPath(servingPath)
+	buildDir := filepath.Join(builds, buildID)
+	err = os.Rename(filepath.Dir(stagingPath), buildDir)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":         err,
+			"stagingPath": stagingPath,
+			"buildDir":    buildDir,
+		}).Error("failed to move build out of staging")
+		return
+	}
+	buildPath := filepath.Join(buildDir, filepath.Base(stagingPath))
+	err = os.Remove(lockPath(buildPath))
+	if err != nil && !os.IsNotExist(err) {
+		log.WithFields(log.Fields{
+			"err":       err,
+			"buildPath": buildPath,
+		}).Error("failed to remove staging lock file")
+		return
+	}
+	err = syncDir(builds)
+	if err != nil {
+		return
+	}
+
+	replaced, _ := filepath.EvalSymlinks(servingPath)
+	err = swapLink(filepath.Join(filepath.Base(builds), buildID, filepath.Base(stagingPath)), servingPath)
+	if err != nil {
+		return
+	}
+	err = syncDir(filepath.Dir(servingPath))
+	if err != nil {
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"buildPath":   buildPath,
+		"servingPath": servingPath,
+	}).Info("published build")
+
+	// servers may still be serving the build that was replaced, or go back to it if they can't
+	// open this one, but they will have switched from any before it
+	removeOldBuilds(builds, buildDir, filepath.Dir(replaced))
+
+	ts.LMDBPath = servingPath
+	if reopen {
+		err = ts.OpenLMDB()
+	}
+	return
+}
+
+// swapLink atomically replaces whatever is at path with a link to target
+func swapLink(target string, path string) (err error) {
+	tmp := path + ".link"
+	os.Remove(tmp)
+	err = os.Symlink(target, tmp)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"target": target,
+			"path":   path,
+		}).Error("failed to link build into place")
+	}
+	return
+}
+
+// removeOldBuilds deletes the directories of the builds in builds other than those in keep and
+// the staging directory. A failure is only logged, as the builds will be tried again next time.
+func removeOldBuilds(builds string, keep ...string) {
+	entries, err := ioutil.ReadDir(builds)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":    err,
+			"builds": builds,
+		}).Warn("failed to list old builds to remove")
+		return
+	}
+Entries:
+	for _, entry := range entries {
+		dir := filepath.Join(builds, entry.Name())
+		if entry.Name() == stagingDir {
+			continue
+		}
+		for _, k := range keep {
+			if dir == k {
+				continue Entries
+			}
+		}
+		err = os.RemoveAll(dir)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+				"dir": dir,
+			}).Warn("failed to remove old build")
+		}
+	}
+}
+
+// syncDir makes a rename within a directory durable
+func syncDir(dir string) (err error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+			"dir": dir,
+		}).Error("failed to open directory to sync")
+		return
+	}
+	defer d.Close()
+	err = d.Sync()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+			"dir": dir,
+		}).Error("failed to sync directory")
+	}
+	return
+}
+
+// WatchForNewBuild checks every interval whether a new build has been published at LMDBPath
+// and switches to it between requests.
+func (ts *TreeServe) WatchForNewBuild(interval time.Duration) {
+	for range time.Tick(interval) {
+		fileInfo, err := os.Stat(ts.LMDBPath)
+		if err != nil {
+			// may be mid-rename, try again next time
+			log.WithFields(log.Fields{
+				"err":      err,
+				"LMDBPath": ts.LMDBPath,
+			}).Debug("could not stat LMDB environment")
+			continue
+		}
+		if os.SameFile(fileInfo, ts.lmdbFileInfo) || (ts.failedBuildInfo != nil && os.SameFile(fileInfo, ts.failedBuildInfo)) {
+			continue
+		}
+		log.WithFields(log.Fields{"LMDBPath": ts.LMDBPath}).Info("new build found, switching to it")
+		err = ts.reopenLMDB()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":      err,
+				"LMDBPath": ts.LMDBPath,
+			}).Error("failed to switch to new build, still serving the previous one")
+		}
+	}
+}
+
+// reopenLMDB closes the environment and opens whatever is now at LMDBPath. It waits for
+// requests in progress to finish, and holds up new ones until the new environment is open.
+// Requests are the only other users of the environment while serving, so the resize lock is
+// not needed, and OpenLMDB takes it to read the tree's metadata. If the new build can't be
+// opened or is not ready, the previous one is opened again from its own directory. A build
+// that can't be opened is not tried again, one that is not ready is tried again next time.
+func (ts *TreeServe) reopenLMDB() (err error) {
+	ts.lmdbSwapLock.Lock()
+	defer ts.lmdbSwapLock.Unlock()
+
+	servingPath, previous := ts.LMDBPath, ts.lmdbOpenPath
+	ts.CloseLMDB()
+	err = ts.OpenLMDB()
+	if err != nil {
+		ts.failedBuildInfo, _ = os.Stat(servingPath)
+	} else {
+		var state string
+		state, err = ts.GetState()
+		if err == nil && state != "treeReady" {
+			err = fmt.Errorf("new build is in state %q, not treeReady", state)
+		}
+		if err != nil {
+			ts.CloseLMDB()
+		}
+	}
+	if err == nil {
+		ts.failedBuildInfo = nil
+		return
+	}
+
+	ts.LMDBPath = previous
+	previousErr := ts.OpenLMDB()
+	ts.LMDBPath = servingPath
+	if previousErr != nil {
+		log.WithFields(log.Fields{
+			"err":      previousErr,
+			"LMDBPath": previous,
+		}).Error("failed to open the previous build again")
+	}
+	return
+}
+
+// holdLMDB stops the environment being switched while a request is being handled
+func (ts *TreeServe) holdLMDB(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ts.lmdbSwapLock.RLock()
+		defer ts.lmdbSwapLock.RUnlock()
+		h(w, r)
+	}
+}
@@ -0,0 +1,364 @@
+package treeserve
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testLine makes an input line in the mpistat format
+func testLine(path string, size uint64, uid, gid int, time int64, fileType string) string {
+	t := strconv.FormatInt(time, 10)
+	return strings.Join([]string{base64.StdEncoding.EncodeToString([]byte(path)), strconv.FormatUint(size, 10),
+		strconv.Itoa(uid), strconv.Itoa(gid), t, t, t, fileType, "1", "1", "1"}, "\t")
+}
+
+// testTreeLines is a small tree with two groups' directories under /lustre/scratch
+var testTreeLines = []string{
+	testLine("/", 4096, 0, 0, 1000, "d"),
+	testLine("/lustre", 4096, 0, 0, 1000, "d"),
+	testLine("/lustre/scratch", 4096, 0, 0, 1000, "d"),
+	testLine("/lustre/scratch/a", 4096, 1, 10, 1000, "d"),
+	testLine("/lustre/scratch/a/x.bam", 100, 1, 10, 1000, "f"),
+	testLine("/lustre/scratch/a/y.txt", 200, 1, 10, 500, "f"),
+	testLine("/lustre/scratch/b", 4096, 2, 20, 1000, "d"),
+	testLine("/lustre/scratch/b/c", 4096, 2, 20, 1000, "d"),
+	testLine("/lustre/scratch/b/c/z.cram", 300, 2, 20, 1500, "f"),
+}
+
+// buildTestTree builds and finalizes a tree from lines in a new environment at lmdbPath
+func buildTestTree(t *testing.T, lmdbPath string, lines []string) (ts *TreeServe) {
+	err := os.MkdirAll(filepath.Dir(lmdbPath), 0700)
+	if err != nil {
+		t.Fatalf("failed to create directory for LMDB: %v", err)
+	}
+	ts = NewTreeServe(lmdbPath, 64*1024*1024, 2000, 1000, -1, 1000, -1, false)
+	err = ts.OpenLMDB()
+	if err != nil {
+		t.Fatalf("failed to open LMDB: %v", err)
+	}
+	for _, line := range lines {
+		err = ts.processLine(line)
+		if err != nil {
+			t.Fatalf("failed to process line %s: %v", line, err)
+		}
+	}
+	err = ts.Finalize("/", 2)
+	if err != nil {
+		t.Fatalf("failed to finalize: %v", err)
+	}
+	return
+}
+
+// newReadyTestTree builds a tree from lines, or testTreeLines if there are none, in a new
+// temporary directory and makes it ready to serve. Other files for the test can be kept in the
+// directory of ts.LMDBPath. cleanup closes the tree and removes the directory.
+func newReadyTestTree(t *testing.T, lines ...string) (ts *TreeServe, cleanup func()) {
+	dir, err := ioutil.TempDir("", "treeserve_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	if len(lines) == 0 {
+		lines = testTreeLines
+	}
+	ts = buildTestTree(t, dir+"/lmdb", lines)
+	cleanup = func() {
+		ts.CloseLMDB()
+		os.RemoveAll(dir)
+	}
+	err = ts.SetState("treeReady")
+	if err != nil {
+		cleanup()
+		t.Fatalf("failed to set state: %v", err)
+	}
+	return
+}
+
+// getTestTree gets the nested /tree response of ts to query
+func getTestTree(t *testing.T, ts *TreeServe, query string) (ft fullTree) {
+	w := httptest.NewRecorder()
+	ts.apiHandler(ts.tree)(w, httptest.NewRequest("GET", apiPrefix+"/tree?"+query, nil))
+	err := json.Unmarshal(w.Body.Bytes(), &ft)
+	if err != nil {
+		t.Fatalf("failed to unmarshal tree %s: %v", w.Body.String(), err)
+	}
+	return
+}
+
+func TestPublishBuild(t *testing.T) {
+	lmdbDir, err := ioutil.TempDir("", "publish_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory for LMDB: %v", err)
+	}
+	defer os.RemoveAll(lmdbDir)
+
+	servingPath := lmdbDir + "/lmdb"
+	ts := buildTestTree(t, StagingPath(servingPath), testTreeLines)
+	defer ts.CloseLMDB()
+
+	err = ts.PublishBuild(servingPath, true)
+	if err != nil {
+		t.Fatalf("failed to publish build: %v", err)
+	}
+
+	if _, err = os.Stat(filepath.Dir(StagingPath(servingPath))); !os.IsNotExist(err) {
+		t.Errorf("Expected staging directory to be gone, got %v", err)
+	}
+	if ts.LMDBPath != servingPath {
+		t.Errorf("Expected %s, got %s", servingPath, ts.LMDBPath)
+	}
+	// the build is served through a link to its own directory, which has its own lock file
+	if fileInfo, err := os.Lstat(servingPath); err != nil || fileInfo.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Expected %s to be a link to the build, got %v", servingPath, err)
+	}
+	if filepath.Dir(filepath.Dir(ts.lmdbOpenPath)) != buildsPath(servingPath) {
+		t.Errorf("Expected the build to be opened in a directory of %s, got %s", buildsPath(servingPath), ts.lmdbOpenPath)
+	}
+	state, err := ts.GetState()
+	if err != nil {
+		t.Error(err)
+	}
+	if state != "treeReady" {
+		t.Errorf("Expected state %s, got %s", "treeReady", state)
+	}
+
+	// switching to a new build while serving
+	reopened := make(chan error, 1)
+	go func() { reopened <- ts.reopenLMDB() }()
+	select {
+	case err = <-reopened:
+		if err != nil {
+			t.Errorf("failed to reopen LMDB: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("reopening LMDB did not finish")
+	}
+
+	// a server that can open neither a new build nor the one it was serving is not ready, and
+	// doesn't use the closed environment
+	err = ioutil.WriteFile(lmdbDir+"/junk", []byte("not an LMDB environment"), 0600)
+	if err != nil {
+		t.Fatalf("failed to write junk build: %v", err)
+	}
+	err = swapLink("junk", servingPath)
+	if err != nil {
+		t.Fatalf("failed to link junk build: %v", err)
+	}
+	// stands in for a previous build that can no longer be opened
+	ts.lmdbOpenPath = lmdbDir
+	if ts.reopenLMDB() == nil {
+		t.Fatalf("Expected switching to a junk build to fail")
+	}
+	for path, h := range map[string]http.HandlerFunc{"/readyz": ts.holdLMDB(ts.readyz), apiPrefix + "/tree": ts.apiHandler(ts.tree)} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", path, nil))
+		var apiErr APIError
+		if w.Code != http.StatusServiceUnavailable || json.Unmarshal(w.Body.Bytes(), &apiErr) != nil || apiErr.Code != errorNotReady {
+			t.Errorf("Expected %s to be not_ready with no build open, got %d %s", path, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestWatchForNewBuild(t *testing.T) {
+	lmdbDir, err := ioutil.TempDir("", "publish_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory for LMDB: %v", err)
+	}
+	defer os.RemoveAll(lmdbDir)
+
+	servingPath := lmdbDir + "/lmdb"
+	ts := buildTestTree(t, StagingPath(servingPath), testTreeLines)
+	// the watcher can't be stopped, so keep it from switching while the environment is removed
+	defer func() {
+		ts.lmdbSwapLock.Lock()
+		ts.CloseLMDB()
+	}()
+	err = ts.PublishBuild(servingPath, true)
+	if err != nil {
+		t.Fatalf("failed to publish build: %v", err)
+	}
+	go ts.WatchForNewBuild(10 * time.Millisecond)
+
+	newPath := "/lustre/scratch/a/new.bam"
+	build := buildTestTree(t, StagingPath(servingPath), append(append([]string{}, testTreeLines...), testLine(newPath, 400, 1, 10, 1000, "f")))
+	// a request in progress while the build is published holds up the switch until it is done.
+	// The build is published the way -buildOnly does, without opening it again.
+	ts.lmdbSwapLock.RLock()
+	err = build.PublishBuild(servingPath, false)
+	ts.lmdbSwapLock.RUnlock()
+	if err != nil {
+		t.Fatalf("failed to publish new build: %v", err)
+	}
+
+	// look the way a request would, while the server switches builds
+	waitFor := func(what string, done func() bool) {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			var ok bool
+			ts.holdLMDB(func(w http.ResponseWriter, r *http.Request) {
+				ok = done()
+			})(nil, nil)
+			if ok {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("server did not %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	has := func(path string) bool {
+		found, _ := ts.TreeNodeDB.HasKey(ts.getPathKey(path))
+		return found
+	}
+	waitFor("switch to the new build", func() bool { return has(newPath) })
+
+	// a build that was never made ready is not served, and doesn't stop the server
+	badPath := "/lustre/scratch/a/bad.bam"
+	bad := buildTestTree(t, StagingPath(servingPath), append(append([]string{}, testTreeLines...), testLine(badPath, 400, 1, 10, 1000, "f")))
+	bad.CloseLMDB()
+	ts.lmdbSwapLock.RLock()
+	err = os.Rename(filepath.Dir(StagingPath(servingPath)), buildsPath(servingPath)+"/bad")
+	if err == nil {
+		err = swapLink(filepath.Base(buildsPath(servingPath))+"/bad/lmdb", servingPath)
+	}
+	ts.lmdbSwapLock.RUnlock()
+	if err != nil {
+		t.Fatalf("failed to move bad build into place: %v", err)
+	}
+	if ts.reopenLMDB() == nil {
+		t.Errorf("Expected switching to a build that is not ready to fail")
+	}
+	if !has(newPath) || has(badPath) {
+		t.Errorf("Expected the previous build to still be served")
+	}
+
+	// it is tried again, so is switched to once it is ready
+	ts.lmdbSwapLock.RLock()
+	bad.LMDBPath = servingPath
+	err = bad.OpenLMDB()
+	if err == nil {
+		err = bad.SetState("treeReady")
+		bad.CloseLMDB()
+	}
+	ts.lmdbSwapLock.RUnlock()
+	if err != nil {
+		t.Fatalf("failed to make the bad build ready: %v", err)
+	}
+	waitFor("switch to the build once it is ready", func() bool { return has(badPath) })
+
+	// and the next build is switched to, with the builds before the one it replaced removed
+	nextPath := "/lustre/scratch/a/next.bam"
+	build = buildTestTree(t, StagingPath(servingPath), append(append([]string{}, testTreeLines...), testLine(nextPath, 400, 1, 10, 1000, "f")))
+	ts.lmdbSwapLock.RLock()
+	err = build.PublishBuild(servingPath, false)
+	ts.lmdbSwapLock.RUnlock()
+	if err != nil {
+		t.Fatalf("failed to publish next build: %v", err)
+	}
+	waitFor("switch to the next build", func() bool { return has(nextPath) && ts.failedBuildInfo == nil })
+	builds, err := ioutil.ReadDir(buildsPath(servingPath))
+	if err != nil || len(builds) != 2 {
+		t.Errorf("Expected the next build and the one it replaced to be kept, got %v %v", builds, err)
+	}
+}
+
+func TestCanResumeBuild(t *testing.T) {
+	lmdbDir, err := ioutil.TempDir("", "publish_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory for LMDB: %v", err)
+	}
+	defer os.RemoveAll(lmdbDir)
+
+	inputPath := lmdbDir + "/input.dat.gz"
+	f, err := os.Create(inputPath)
+	if err != nil {
+		t.Fatalf("failed to create input: %v", err)
+	}
+	gz := gzip.NewWriter(f)
+	gz.Write([]byte(strings.Join(testTreeLines, "\n") + "\n"))
+	gz.Close()
+	f.Close()
+
+	servingPath := lmdbDir + "/lmdb"
+	err = MakeStagingDir(servingPath)
+	if err != nil {
+		t.Fatalf("failed to create staging directory: %v", err)
+	}
+	ts := NewTreeServe(StagingPath(servingPath), 64*1024*1024, 2000, 1000, -1, 1000, -1, false)
+	if ts.CanResumeBuild(inputPath) {
+		t.Errorf("Expected no build to resume before one is started")
+	}
+	setState := func(state string) {
+		err := ts.OpenLMDB()
+		if err != nil {
+			t.Fatalf("failed to open LMDB: %v", err)
+		}
+		defer ts.CloseLMDB()
+		err = ts.SetState(state)
+		if err != nil {
+			t.Fatalf("failed to set state: %v", err)
+		}
+	}
+
+	// a build interrupted while reading its input is started again
+	err = ts.OpenLMDB()
+	if err != nil {
+		t.Fatalf("failed to open LMDB: %v", err)
+	}
+	err = ts.ProcessInput(inputPath, 2)
+	ts.CloseLMDB()
+	if err != nil {
+		t.Fatalf("failed to process input: %v", err)
+	}
+	setState("inputProcessing")
+	if ts.CanResumeBuild(inputPath) {
+		t.Errorf("Expected a build that had not read all its input not to be resumed")
+	}
+
+	// once it has read it, it carries on from there
+	for _, state := range []string{"inputProcessed", "finalize", "finalized"} {
+		setState(state)
+		if !ts.CanResumeBuild(inputPath) {
+			t.Errorf("Expected a build in state %s to be resumed", state)
+		}
+	}
+
+	// unless the input has changed since
+	later := time.Now().Add(time.Hour)
+	err = os.Chtimes(inputPath, later, later)
+	if err != nil {
+		t.Fatalf("failed to set input mtime: %v", err)
+	}
+	if ts.CanResumeBuild(inputPath) {
+		t.Errorf("Expected a build of input that has changed not to be resumed")
+	}
+}
+
+func TestValidateBuildEmpty(t *testing.T) {
+	lmdbDir, err := ioutil.TempDir("", "publish_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory for LMDB: %v", err)
+	}
+	defer os.RemoveAll(lmdbDir)
+
+	ts := NewTreeServe(lmdbDir+"/lmdb", 64*1024*1024, 2000, 1000, -1, 1000, -1, false)
+	err = ts.OpenLMDB()
+	if err != nil {
+		t.Fatalf("failed to open LMDB: %v", err)
+	}
+	defer ts.CloseLMDB()
+
+	if ts.ValidateBuild() == nil {
+		t.Errorf("Expected an empty environment to fail validation")
+	}
+}
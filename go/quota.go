@@ -0,0 +1,450 @@
+package treeserve
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// defaultQuotaWarnPercent is how much of a limit can be used before a group or user is warned
+const defaultQuotaWarnPercent = 90.0
+
+// defaultQuotaTopDirs is how many of the directories using the most of a quota are given
+const defaultQuotaTopDirs = 5
+
+// the kinds of quota
+const (
+	quotaGroup = "group"
+	quotaUser  = "user"
+)
+
+// QuotaSource is a file of the quotas of the groups and users of a volume
+type QuotaSource struct {
+	Volume string
+	File   string
+}
+
+// ParseQuotaSources parses a comma separated list of <volume path>=<quota file>
+func ParseQuotaSources(s string) (sources []QuotaSource, err error) {
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		volumeFile := strings.SplitN(entry, "=", 2)
+		if len(volumeFile) != 2 || !filepath.IsAbs(volumeFile[0]) || volumeFile[1] == "" {
+			return nil, fmt.Errorf("quota file %s is not <volume path>=<quota file>", entry)
+		}
+		sources = append(sources, QuotaSource{Volume: filepath.Clean(volumeFile[0]), File: volumeFile[1]})
+	}
+	return
+}
+
+// quotaEntry is the limits of a group or user, identified by ID or, if it is not known, by Name.
+// A limit of 0 is no limit.
+type quotaEntry struct {
+	Kind       string
+	ID         string
+	Name       string
+	ByteLimit  uint64
+	InodeLimit uint64
+}
+
+// lfsQuotaHeader starts the output of lfs quota for a group, user or project
+var lfsQuotaHeader = regexp.MustCompile(`^Disk quotas for (usr|user|grp|group|prj|project) (\S+) \((uid|gid|prjid) (\d+)\)`)
+
+// parseQuantity parses a number, which can have a K, M, G, T or P suffix for powers of 1024, in
+// units of unit. lfs marks values over their quota with a *, which is ignored.
+func parseQuantity(s string, unit uint64) (n uint64, err error) {
+	s = strings.TrimSuffix(s, "*")
+	multiplier := unit
+	if i := strings.IndexAny(strings.ToUpper(s), "KMGTP"); i >= 0 && i == len(s)-1 {
+		multiplier = 1 << (10 * uint(strings.Index("KMGTP", strings.ToUpper(s[i:]))+1))
+		s = s[:i]
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("%q is not a quantity", s)
+	}
+	return uint64(f * float64(multiplier)), nil
+}
+
+// readQuotaFile reads the output of lfs quota -u or -g for any number of users and groups, or
+// lines of <group|user> <name or id> <byte limit> <inode limit>. Byte limits from lfs are in KiB
+// and the hard limit is used if there is one, otherwise the soft one. Those with no limits are
+// left out, as are project quotas from lfs quota -p, since the tree has no project ids to match
+// them with.
+func readQuotaFile(path string) (entries []quotaEntry, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err, "path": path}).Error("failed to open quota file")
+		return
+	}
+	defer f.Close()
+
+	var lfs *quotaEntry // the lfs output being read
+	var fields []string // of the lfs output after the header
+	sawLFS := false     // lfs output has other lines, eg. of errors, which are ignored
+	add := func(e quotaEntry) {
+		if e.ByteLimit > 0 || e.InodeLimit > 0 {
+			entries = append(entries, e)
+		}
+	}
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if m := lfsQuotaHeader.FindStringSubmatch(line); m != nil {
+			fields = nil
+			sawLFS = true
+			switch m[3] {
+			case "uid":
+				lfs = &quotaEntry{Kind: quotaUser, ID: m[4], Name: m[2]}
+			case "gid":
+				lfs = &quotaEntry{Kind: quotaGroup, ID: m[4], Name: m[2]}
+			default:
+				lfs = nil
+			}
+			continue
+		}
+		if lfs != nil {
+			if strings.HasPrefix(line, "Filesystem") {
+				continue
+			}
+			// the filesystem can be on a line of its own when its name is long
+			fields = append(fields, strings.Fields(line)...)
+			if len(fields) < 9 {
+				continue
+			}
+			// kbytes quota limit grace files quota limit grace
+			var values [5]uint64
+			for i, field := range []string{fields[2], fields[3], fields[5], fields[6], fields[7]} {
+				unit := uint64(1024)
+				if i > 1 {
+					unit = 1
+				}
+				values[i], err = parseQuantity(field, unit)
+				if err != nil {
+					return nil, fmt.Errorf("%s line %d: %v", path, lineNumber, err)
+				}
+			}
+			lfs.ByteLimit = values[1]
+			if lfs.ByteLimit == 0 {
+				lfs.ByteLimit = values[0]
+			}
+			lfs.InodeLimit = values[4]
+			if lfs.InodeLimit == 0 {
+				lfs.InodeLimit = values[3]
+			}
+			add(*lfs)
+			lfs = nil
+			continue
+		}
+		if line == "" || strings.HasPrefix(line, "#") || sawLFS {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) != 4 || (f[0] != quotaGroup && f[0] != quotaUser) {
+			return nil, fmt.Errorf("%s line %d is not <group|user> <name or id> <byte limit> <inode limit>", path, lineNumber)
+		}
+		e := quotaEntry{Kind: f[0], Name: f[1]}
+		if _, parseErr := strconv.ParseUint(f[1], 10, 64); parseErr == nil {
+			e.ID = f[1]
+			e.Name = ""
+		}
+		e.ByteLimit, err = parseQuantity(f[2], 1)
+		if err == nil {
+			e.InodeLimit, err = parseQuantity(f[3], 1)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", path, lineNumber, err)
+		}
+		add(e)
+	}
+	err = scanner.Err()
+	return
+}
+
+// quotaFile is what was last read from the quota file of a volume
+type quotaFile struct {
+	QuotaSource
+	modTime time.Time
+	size    int64
+	entries []quotaEntry
+}
+
+// quotaFiles are the quota files read so far, which are read again when they change
+type quotaFiles struct {
+	mu    sync.Mutex
+	files map[string]*quotaFile
+}
+
+// get gets the quotas of the volume of s, reading its file if it has changed
+func (qf *quotaFiles) get(s QuotaSource) (entries []quotaEntry, err error) {
+	qf.mu.Lock()
+	defer qf.mu.Unlock()
+	if qf.files == nil {
+		qf.files = make(map[string]*quotaFile)
+	}
+	fileInfo, err := os.Stat(s.File)
+	if err != nil {
+		return
+	}
+	f, ok := qf.files[s.Volume]
+	if ok && f.QuotaSource == s && fileInfo.ModTime().Equal(f.modTime) && fileInfo.Size() == f.size {
+		return f.entries, nil
+	}
+	entries, err = readQuotaFile(s.File)
+	if err != nil {
+		return
+	}
+	qf.files[s.Volume] = &quotaFile{QuotaSource: s, modTime: fileInfo.ModTime(), size: fileInfo.Size(), entries: entries}
+	log.WithFields(log.Fields{"volume": s.Volume, "file": s.File, "entries": len(entries)}).Info("read quota file")
+	return
+}
+
+// quotaDir is the usage of a group or user in a directory
+type quotaDir struct {
+	Path  string `json:"path"`
+	Size  uint64 `json:"size"`
+	Count uint64 `json:"count"`
+}
+
+// quotaRow is the usage of a group or user of a volume against their limits. The percentages are
+// left out for limits that are not set.
+type quotaRow struct {
+	Kind         string     `json:"kind"`
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	Bytes        uint64     `json:"bytes"`
+	ByteLimit    uint64     `json:"byte_limit"`
+	BytePercent  *float64   `json:"byte_percent,omitempty"`
+	Inodes       uint64     `json:"inodes"`
+	InodeLimit   uint64     `json:"inode_limit"`
+	InodePercent *float64   `json:"inode_percent,omitempty"`
+	Warning      bool       `json:"warning"` // over the warning threshold of either limit
+	Over         bool       `json:"over"`    // at or over either limit
+	TopDirs      []quotaDir `json:"top_dirs"`
+}
+
+// percent gets the larger of the percentages of the limits used
+func (row *quotaRow) percent() (p float64) {
+	for _, x := range []*float64{row.BytePercent, row.InodePercent} {
+		if x != nil && *x > p {
+			p = *x
+		}
+	}
+	return
+}
+
+// quotaVolume is the quotas of a volume
+type quotaVolume struct {
+	Path      string      `json:"path"`
+	QuotaFile string      `json:"quota_file"`
+	Quotas    []*quotaRow `json:"quotas"`
+}
+
+// quotaResponse is the body of a /api/v2/quota response
+type quotaResponse struct {
+	Date        string         `json:"date"` // when the input the tree was built from was made
+	WarnPercent float64        `json:"warn_percent"`
+	Volumes     []*quotaVolume `json:"volumes"`
+}
+
+// usageKey identifies the usage of a group or user in the aggregates of a directory
+func usageKey(kind, id string) string {
+	return kind + ":" + id
+}
+
+// quotaUsage gets the count and size of every group and user from the aggregates with "*" for
+// everything else
+func quotaUsage(stats []Aggregates) (usage map[string]Aggregates) {
+	usage = make(map[string]Aggregates)
+	for _, a := range stats {
+		if a.Tag != "*" || a.Dimensions != "" || (a.Group == "*") == (a.User == "*") {
+			continue
+		}
+		if a.Group != "*" {
+			usage[usageKey(quotaGroup, a.Group)] = a
+		} else {
+			usage[usageKey(quotaUser, a.User)] = a
+		}
+	}
+	return
+}
+
+// volumeQuotas works out the usage against each of the quotas of the volume of s, and the top
+// directories under it of each
+func (ts *TreeServe) volumeQuotas(s QuotaSource, p *principal, warn float64, topDirs int, kind string) (volume *quotaVolume, err error) {
+	volume = &quotaVolume{Path: s.Volume, QuotaFile: s.File, Quotas: []*quotaRow{}}
+	entries, err := ts.quotaFiles.get(s)
+	if err != nil {
+		return
+	}
+	usage := make(map[string]Aggregates)
+	var dirs []string
+	dirUsage := make(map[string]map[string]Aggregates)
+	if nodeKey, apiErr := ts.nodeKeyForPath(s.Volume); apiErr == nil {
+		var stats []Aggregates
+		stats, err = ts.retrieveAggregates(nodeKey)
+		if err != nil {
+			return
+		}
+		usage = quotaUsage(stats)
+		var childKeys []*Md5Key
+		if topDirs > 0 {
+			childKeys, err = ts.children(nodeKey)
+			if err != nil {
+				return
+			}
+		}
+		for _, childKey := range childKeys {
+			child, err := ts.GetTreeNode(childKey)
+			if err != nil {
+				return volume, err
+			}
+			if child.Stats.FileType == 'f' {
+				continue
+			}
+			stats, err = ts.retrieveAggregates(childKey)
+			if err != nil {
+				return volume, err
+			}
+			dirs = append(dirs, child.Name)
+			dirUsage[child.Name] = quotaUsage(stats)
+		}
+	}
+
+	for _, e := range entries {
+		if kind != "" && e.Kind != kind {
+			continue
+		}
+		id, ok := e.ID, true
+		if id == "" {
+			if e.Kind == quotaGroup {
+				id, ok = ts.names.groupID(s.Volume, e.Name)
+			} else {
+				id, ok = ts.names.userID(s.Volume, e.Name)
+			}
+		}
+		a := Aggregates{Group: "*", User: "*"}
+		if e.Kind == quotaGroup {
+			a.Group = id
+		} else {
+			a.User = id
+		}
+		if !p.sees(s.Volume, a) {
+			continue
+		}
+		row := &quotaRow{Kind: e.Kind, ID: id, Name: e.Name, ByteLimit: e.ByteLimit, InodeLimit: e.InodeLimit, TopDirs: []quotaDir{}}
+		if ok {
+			if e.Kind == quotaGroup {
+				row.Name = ts.lookupGID(s.Volume, id)
+			} else {
+				row.Name = ts.lookupUID(s.Volume, id)
+			}
+		}
+		key := usageKey(e.Kind, id)
+		if u, ok := usage[key]; ok {
+			row.Bytes = u.Size.Uint64()
+			row.Inodes = u.Count.Uint64()
+		}
+		for _, l := range []struct {
+			used, limit uint64
+			percent     **float64
+		}{{row.Bytes, row.ByteLimit, &row.BytePercent}, {row.Inodes, row.InodeLimit, &row.InodePercent}} {
+			if l.limit == 0 {
+				continue
+			}
+			percent := 100 * float64(l.used) / float64(l.limit)
+			*l.percent = &percent
+			row.Warning = row.Warning || percent >= warn
+			row.Over = row.Over || l.used >= l.limit
+		}
+		for _, dir := range dirs {
+			if u, ok := dirUsage[dir][key]; ok && !u.Count.isZero() {
+				row.TopDirs = append(row.TopDirs, quotaDir{Path: dir, Size: u.Size.Uint64(), Count: u.Count.Uint64()})
+			}
+		}
+		sort.Slice(row.TopDirs, func(i, j int) bool {
+			if row.TopDirs[i].Size != row.TopDirs[j].Size {
+				return row.TopDirs[i].Size > row.TopDirs[j].Size
+			}
+			return row.TopDirs[i].Path < row.TopDirs[j].Path
+		})
+		if len(row.TopDirs) > topDirs {
+			row.TopDirs = row.TopDirs[:topDirs]
+		}
+		volume.Quotas = append(volume.Quotas, row)
+	}
+	sort.SliceStable(volume.Quotas, func(i, j int) bool {
+		return volume.Quotas[i].percent() > volume.Quotas[j].percent()
+	})
+	return
+}
+
+// quota handles requests of the form <url>/api/v2/quota?path=/lustre/scratch115, for the usage of
+// the groups and users of the volumes with quota files against their limits, most used first.
+// Without path every volume is given. Users who can only see some groups and users only get those
+// quotas. The quota files are read again when they change, so responses are not cached.
+func (ts *TreeServe) quota(w http.ResponseWriter, r *http.Request) *APIError {
+	vals := r.URL.Query()
+	path := ""
+	if vals.Get("path") != "" {
+		path = filepath.Clean(vals.Get("path"))
+	}
+	warn := ts.QuotaWarnPercent
+	if v := vals.Get("warn"); v != "" {
+		var err error
+		warn, err = strconv.ParseFloat(v, 64)
+		if err != nil || warn < 0 {
+			return badRequest(path, "warn must be a percentage, not %q", v)
+		}
+	}
+	topDirs := defaultQuotaTopDirs
+	if v := vals.Get("top"); v != "" {
+		var err error
+		topDirs, err = strconv.Atoi(v)
+		if err != nil || topDirs < 0 {
+			return badRequest(path, "top must be a whole number, not %q", v)
+		}
+	}
+	kind := vals.Get("kind")
+	if kind != "" && kind != quotaGroup && kind != quotaUser {
+		return badRequest(path, "kind must be %s or %s, not %q", quotaGroup, quotaUser, kind)
+	}
+
+	response := quotaResponse{Date: ts.scanDate.String(), WarnPercent: warn, Volumes: []*quotaVolume{}}
+	for _, s := range ts.QuotaSources {
+		if path != "" && s.Volume != path {
+			continue
+		}
+		volume, err := ts.volumeQuotas(s, principalFor(r), warn, topDirs, kind)
+		if err != nil {
+			return internalError(path, err)
+		}
+		response.Volumes = append(response.Volumes, volume)
+	}
+	if path != "" && len(response.Volumes) == 0 {
+		return notFound(path, "there is no quota file for %s", path)
+	}
+
+	j, err := json.Marshal(response)
+	if err != nil {
+		return internalError(path, err)
+	}
+	writeJSON(w, j)
+	return nil
+}
@@ -0,0 +1,128 @@
+package treeserve
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testLFSQuota = `Disk quotas for group grp10 (gid 10):
+     Filesystem  kbytes   quota   limit   grace   files   quota   limit   grace
+/lustre/scratch
+                      5       0      5k       -       3       0       4       -
+Disk quotas for group grp30 (gid 30):
+     Filesystem  kbytes   quota   limit   grace   files   quota   limit   grace
+/lustre/scratch       0       0       0       -       0       0       0       -
+Disk quotas for prj 10 (prjid 10):
+     Filesystem  kbytes   quota   limit   grace   files   quota   limit   grace
+/lustre/scratch      12       0     20k       -       1       0      10       -
+Some errors happened when getting quota info.
+`
+
+func TestQuota(t *testing.T) {
+	for s, expected := range map[string]uint64{"10": 10240, "1.5K": 1536, "2m": 2 << 20, "7*": 7168} {
+		if n, err := parseQuantity(s, 1024); err != nil || n != expected {
+			t.Errorf("Expected %s to be %d, got %d %v", s, expected, n, err)
+		}
+	}
+	if _, err := ParseQuotaSources("lustre=quota.txt"); err == nil {
+		t.Errorf("Expected an error for a volume that is not absolute")
+	}
+
+	ts, cleanup := newReadyTestTree(t)
+	defer cleanup()
+	dir := filepath.Dir(ts.LMDBPath)
+	lfsFile := dir + "/scratch.quota"
+	simpleFile := dir + "/lustre.quota"
+	err := ioutil.WriteFile(lfsFile, []byte(testLFSQuota), 0644)
+	if err == nil {
+		err = ioutil.WriteFile(simpleFile, []byte("# kind id bytes inodes\ngroup 20 8492 100\nuser 1 1M 10\n"), 0644)
+	}
+	if err != nil {
+		t.Fatalf("failed to write quota files: %v", err)
+	}
+	entries, err := readQuotaFile(lfsFile)
+	if err != nil || len(entries) != 1 || entries[0] != (quotaEntry{Kind: "group", ID: "10", Name: "grp10", ByteLimit: 5120, InodeLimit: 4}) {
+		t.Errorf("Unexpected lfs quota entries %+v %v", entries, err)
+	}
+
+	ts.QuotaSources, err = ParseQuotaSources("/lustre/scratch/=" + lfsFile + "," + "/lustre=" + simpleFile)
+	if err != nil {
+		t.Fatalf("failed to parse quota sources: %v", err)
+	}
+
+	get := func(query string, p *principal) (response quotaResponse, code int) {
+		r := httptest.NewRequest("GET", apiPrefix+"/quota?"+query, nil)
+		if p != nil {
+			r = r.WithContext(context.WithValue(r.Context(), principalContextKey{}, p))
+		}
+		w := httptest.NewRecorder()
+		ts.apiHandler(ts.quota)(w, r)
+		if w.Code == 200 {
+			err := json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatalf("failed to unmarshal %s: %v", w.Body.String(), err)
+			}
+		}
+		return response, w.Code
+	}
+
+	response, code := get("", nil)
+	if code != 200 || len(response.Volumes) != 2 || response.WarnPercent != defaultQuotaWarnPercent {
+		t.Fatalf("Unexpected quotas of every volume %d %+v", code, response)
+	}
+
+	response, _ = get("path=/lustre/scratch", nil)
+	if len(response.Volumes) != 1 || len(response.Volumes[0].Quotas) != 1 {
+		t.Fatalf("Expected one quota for /lustre/scratch, got %+v", response)
+	}
+	row := response.Volumes[0].Quotas[0]
+	if row.ID != "10" || row.Bytes != 4396 || row.ByteLimit != 5120 || row.Inodes != 3 || row.InodeLimit != 4 || row.Warning || row.Over ||
+		row.BytePercent == nil || *row.BytePercent < 85 || *row.BytePercent > 86 || len(row.TopDirs) != 1 || row.TopDirs[0] != (quotaDir{"/lustre/scratch/a", 4396, 3}) {
+		t.Errorf("Unexpected quota of group 10 %+v", row)
+	}
+	response, _ = get("path=/lustre/scratch&warn=80", nil)
+	if row = response.Volumes[0].Quotas[0]; !row.Warning || row.Over {
+		t.Errorf("Expected a warning over 80%%, got %+v", row)
+	}
+
+	response, _ = get("path=/lustre", nil)
+	quotas := response.Volumes[0].Quotas
+	if len(quotas) != 2 || quotas[0].Kind != "group" || quotas[0].ID != "20" || !quotas[0].Over || !quotas[0].Warning ||
+		quotas[1].Kind != "user" || quotas[1].Bytes != 4396 || quotas[1].Warning || len(quotas[1].TopDirs) != 1 || quotas[1].TopDirs[0].Path != "/lustre/scratch" {
+		t.Errorf("Unexpected quotas of /lustre %+v %+v", quotas[0], quotas[1])
+	}
+	response, _ = get("path=/lustre&kind=user&top=0", nil)
+	if quotas = response.Volumes[0].Quotas; len(quotas) != 1 || quotas[0].Kind != "user" || len(quotas[0].TopDirs) != 0 {
+		t.Errorf("Expected only the user quota without directories, got %+v", quotas)
+	}
+	response, _ = get("path=/lustre", &principal{user: "u1", scopes: []idScope{{uids: map[string]bool{"1": true}, gids: map[string]bool{"10": true}}}})
+	if quotas = response.Volumes[0].Quotas; len(quotas) != 1 || quotas[0].ID != "1" {
+		t.Errorf("Expected only the quota of user 1 to be visible, got %+v", quotas)
+	}
+
+	for query, expected := range map[string]int{"path=/nfs": 404, "warn=lots": 400, "top=-1": 400, "kind=project": 400} {
+		if _, code = get(query, nil); code != expected {
+			t.Errorf("Expected %d for %s, got %d", expected, query, code)
+		}
+	}
+
+	// quota files are read again when they change
+	err = ioutil.WriteFile(simpleFile, []byte("group 20 1T 0\n"), 0644)
+	if err == nil {
+		later := time.Now().Add(time.Minute)
+		err = os.Chtimes(simpleFile, later, later)
+	}
+	if err != nil {
+		t.Fatalf("failed to change quota file: %v", err)
+	}
+	response, _ = get("path=/lustre", nil)
+	if quotas = response.Volumes[0].Quotas; len(quotas) != 1 || quotas[0].ByteLimit != 1<<40 || quotas[0].InodePercent != nil || quotas[0].Over {
+		t.Errorf("Expected the changed quota file to be read, got %+v", quotas)
+	}
+}
@@ -3,7 +3,6 @@ package treeserve
 import (
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"sort"
 )
@@ -18,33 +17,30 @@ type DatabaseEntries struct {
 }
 
 // tree handles requests of the form <url>/api/v2?maxdepth=1&path=/lustre/scratch115/projects
-// and returns the data or a 404 error
-func (ts *TreeServe) raw(w http.ResponseWriter, r *http.Request) {
+// and returns the data or an APIError
+func (ts *TreeServe) raw(w http.ResponseWriter, r *http.Request) *APIError {
 
-	path, _ := queryParameters(r)
+	path, _, apiErr := queryParameters(r)
+	if apiErr != nil {
+		return apiErr
+	}
 
-	j, err := ts.databaseEntries(path)
+	_, apiErr = ts.visibleNodeKey(r, path)
+	if apiErr != nil {
+		return apiErr
+	}
 
+	j, err := ts.databaseEntries(path, principalFor(r))
 	if err != nil {
-
-		LogError(err)
-
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(http.StatusNotFound)
-		io.WriteString(w, "Could not retrieve raw data for node")
-
-	} else {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8") // normal header
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.WriteHeader(http.StatusOK)
-
-		io.WriteString(w, string(j))
+		return internalError(path, err)
 	}
 
+	writeJSON(w, j)
+	return nil
 }
 
-// show what's in the LMBD database for a node
-func (ts *TreeServe) databaseEntries(path string) (j []byte, err error) {
+// show what's in the LMBD database for a node, leaving out the children and mappings p cannot see
+func (ts *TreeServe) databaseEntries(path string, p *principal) (j []byte, err error) {
 	data := DatabaseEntries{}
 
 	logInfo(fmt.Sprintf("databaseEntries for "))
@@ -58,14 +54,14 @@ func (ts *TreeServe) databaseEntries(path string) (j []byte, err error) {
 	}
 	data.Node = *temp
 
-	temp2, err := ts.databaseChildren(path)
+	temp2, err := ts.databaseChildren(path, p)
 	if err != nil {
 		LogError(err)
 		return
 	}
 	data.Children = temp2
 
-	temp3, err := ts.databaseStatMappings(path)
+	temp3, err := ts.databaseStatMappings(path, p)
 	if err != nil {
 		LogError(err)
 		return
@@ -89,7 +85,7 @@ func (ts *TreeServe) databaseEntries(path string) (j []byte, err error) {
 
 }
 
-func (ts *TreeServe) databaseChildren(path string) (s []string, err error) {
+func (ts *TreeServe) databaseChildren(path string, p *principal) (s []string, err error) {
 	key := ts.getPathKey(path)
 	temp, err := ts.children(key)
 
@@ -102,7 +98,15 @@ func (ts *TreeServe) databaseChildren(path string) (s []string, err error) {
 		x, err := ts.GetTreeNode(temp[i])
 		if err != nil {
 			LogError(err)
-
+			return nil, err
+		}
+		visible, err := ts.visible(p, x.Name, temp[i])
+		if err != nil {
+			LogError(err)
+			return nil, err
+		}
+		if !visible {
+			continue
 		}
 		s = append(s, x.Name)
 
@@ -111,7 +115,7 @@ func (ts *TreeServe) databaseChildren(path string) (s []string, err error) {
 	return
 }
 
-func (ts *TreeServe) databaseStatMappings(path string) (s []string, err error) {
+func (ts *TreeServe) databaseStatMappings(path string, p *principal) (s []string, err error) {
 	key := ts.getPathKey(path)
 	temp, err := ts.retrieveAggregates(key)
 
@@ -121,9 +125,15 @@ func (ts *TreeServe) databaseStatMappings(path string) (s []string, err error) {
 	}
 
 	for i := range temp {
+		if !p.sees(path, temp[i]) {
+			continue
+		}
 		nextMapping := "Group: " + temp[i].Group
 		nextMapping += "  User: " + temp[i].User
 		nextMapping += "  Tag: " + temp[i].Tag
+		if temp[i].Dimensions != "" {
+			nextMapping += "  Dimensions: " + temp[i].Dimensions
+		}
 		nextMapping += "  :: Count: " + temp[i].Count.Text(10)
 		nextMapping += "  Size: " + temp[i].Size.Text(10)
 		s = append(s, nextMapping)
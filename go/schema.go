@@ -0,0 +1,266 @@
+package treeserve
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// SchemaVersion is the version of the layout of the LMDB environment written by this program.
+// It must be increased whenever the databases or the encoding of TreeNode, NodeStats, StatMapping
+// or the aggregates change, and a migration step registered to upgrade from the previous version.
+const SchemaVersion = 6
+
+// schemaVersionKey is the key the schema version is stored under in the TreeServe database.
+// Environments written before versioning was introduced do not have it and are version 0.
+const schemaVersionKey = "schemaVersion"
+
+// SchemaVersionError is returned when opening an environment written with a different schema version
+type SchemaVersionError struct {
+	LMDBPath string
+	Found    int
+	Expected int
+}
+
+func (e *SchemaVersionError) Error() string {
+	if e.Found < e.Expected {
+		return fmt.Sprintf("LMDB environment %s has schema version %d but version %d is needed, run treeserve migrate", e.LMDBPath, e.Found, e.Expected)
+	}
+	return fmt.Sprintf("LMDB environment %s has schema version %d which is newer than version %d supported by this program", e.LMDBPath, e.Found, e.Expected)
+}
+
+// IsSchemaVersionError is true if err was caused by opening an environment with a different schema version
+func IsSchemaVersionError(err error) bool {
+	_, ok := err.(*SchemaVersionError)
+	return ok
+}
+
+// MigrationStep upgrades an environment from one schema version to the next
+type MigrationStep func(ts *TreeServe) error
+
+type migration struct {
+	description string
+	step        MigrationStep
+}
+
+// migrations holds the registered steps keyed by the version they upgrade from
+var migrations = make(map[int]migration)
+
+// RegisterMigration adds the step that upgrades an environment from schema version from to from+1.
+// A step that is interrupted will be run again, so it must be safe to repeat.
+func RegisterMigration(from int, description string, step MigrationStep) {
+	if _, ok := migrations[from]; ok {
+		log.WithFields(log.Fields{"from": from}).Fatal("migration from schema version registered twice")
+	}
+	migrations[from] = migration{description: description, step: step}
+}
+
+func init() {
+	// version 1 added the schema version and the cost reference time to the TreeServe database,
+	// the time an old tree's costs were calculated from is not known so the caller must give it
+	RegisterMigration(0, "record schema version and cost reference time", saveCostReferenceTime)
+	// version 2 added the Top database
+	RegisterMigration(1, "keep top files and directories", refinalizeOnce)
+	// version 3 added the AggregateHistograms database
+	RegisterMigration(2, "keep atime age and size histograms", refinalizeOnce)
+	// version 4 added the AggregateExtremes database
+	RegisterMigration(3, "keep oldest and newest times and largest file", refinalizeOnce)
+	// version 5 added the Extensions database
+	RegisterMigration(4, "keep file extension census", refinalizeOnce)
+	// version 6 added Dimensions to StatMapping
+	RegisterMigration(5, "break aggregates down by configurable dimensions", refinalizeOnce)
+}
+
+// saveCostReferenceTime saves the cost reference time given for a tree that does not have one, so
+// that refinalizing it later in the migration keeps its costs
+func saveCostReferenceTime(ts *TreeServe) (err error) {
+	costReferenceTime, err := ts.GetMetadata("costReferenceTime")
+	if err != nil || costReferenceTime != "" {
+		return
+	}
+	return ts.SetMetadata("costReferenceTime", strconv.FormatInt(ts.CostReferenceTime, 10))
+}
+
+// refinalizeOnce refinalizes a tree unless an earlier step of the same migration already has,
+// which filled in every aggregation database this version has
+func refinalizeOnce(ts *TreeServe) (err error) {
+	if ts.migrationRefinalized {
+		return
+	}
+	err = refinalize(ts)
+	if err == nil {
+		ts.migrationRefinalized = true
+	}
+	return
+}
+
+// refinalize finalizes a tree again, so that aggregation databases added since it was built are
+// filled in, with the cost reference time it was first finalized with. A tree that has not been
+// finalized yet is left for the build to finish.
+func refinalize(ts *TreeServe) (err error) {
+	state, err := ts.GetState()
+	if err != nil || (state != "finalized" && state != "treeReady") {
+		return
+	}
+	costReferenceTime, err := ts.GetMetadata("costReferenceTime")
+	if err != nil {
+		return
+	}
+	if costReferenceTime != "" {
+		ts.CostReferenceTime, err = strconv.ParseInt(costReferenceTime, 10, 64)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":               err,
+				"costReferenceTime": costReferenceTime,
+			}).Error("failed to parse cost reference time saved in tree")
+			return
+		}
+	}
+	return ts.Finalize("/", runtime.GOMAXPROCS(0))
+}
+
+// GetSchemaVersion gets the schema version of the open environment
+func (ts *TreeServe) GetSchemaVersion() (version int, err error) {
+	value, err := ts.GetMetadata(schemaVersionKey)
+	if err != nil || value == "" {
+		return
+	}
+	version, err = strconv.Atoi(value)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":   err,
+			"value": value,
+		}).Error("failed to parse schema version")
+	}
+	return
+}
+
+func (ts *TreeServe) setSchemaVersion(version int) (err error) {
+	err = ts.SetMetadata(schemaVersionKey, strconv.Itoa(version))
+	return
+}
+
+// checkSchemaVersion records the current schema version in a new environment, or checks that an
+// existing one matches it
+func (ts *TreeServe) checkSchemaVersion() (err error) {
+	value, err := ts.GetMetadata(schemaVersionKey)
+	if err != nil {
+		return
+	}
+	if value == "" {
+		treeNodeStat, err := ts.TreeNodeDB.Stat()
+		if err != nil {
+			return err
+		}
+		state, err := ts.GetState()
+		if err != nil {
+			return err
+		}
+		if treeNodeStat.Entries == 0 && state == "" {
+			return ts.setSchemaVersion(SchemaVersion)
+		}
+	}
+
+	version, err := ts.GetSchemaVersion()
+	if err != nil {
+		return
+	}
+	if version != SchemaVersion {
+		err = &SchemaVersionError{LMDBPath: ts.LMDBPath, Found: version, Expected: SchemaVersion}
+		log.WithFields(log.Fields{"err": err}).Error("refusing to open LMDB environment")
+	}
+	return
+}
+
+// Migrate upgrades the environment at LMDBPath to SchemaVersion by running the registered migration
+// steps in turn. If outputPath is empty the environment is upgraded in place, otherwise it is
+// copied to outputPath first and only the copy is upgraded. The upgraded environment is left open.
+func (ts *TreeServe) Migrate(outputPath string) (err error) {
+	ts.migrationRefinalized = false
+	err = ts.openLMDB()
+	if err != nil {
+		return
+	}
+
+	version, err := ts.GetSchemaVersion()
+	if err != nil {
+		ts.CloseLMDB()
+		return
+	}
+	if version > SchemaVersion {
+		ts.CloseLMDB()
+		err = &SchemaVersionError{LMDBPath: ts.LMDBPath, Found: version, Expected: SchemaVersion}
+		return
+	}
+	// check every step is available before changing anything
+	for v := version; v < SchemaVersion; v++ {
+		if _, ok := migrations[v]; !ok {
+			ts.CloseLMDB()
+			err = fmt.Errorf("no migration registered from schema version %d", v)
+			return
+		}
+	}
+	// a tree from before the cost reference time was saved would otherwise have its costs
+	// recalculated from whenever it happens to be migrated
+	if version == 0 && !ts.CostReferenceTimeGiven {
+		ts.CloseLMDB()
+		err = fmt.Errorf("LMDB environment %s has schema version 0 and no saved cost reference time, give the time its costs were calculated from with -costReferenceTime to migrate it", ts.LMDBPath)
+		return
+	}
+
+	if outputPath != "" && outputPath != ts.LMDBPath {
+		if _, err = os.Stat(outputPath); err == nil {
+			ts.CloseLMDB()
+			err = fmt.Errorf("migration output %s already exists", outputPath)
+			return
+		}
+		err = ts.LMDBEnv.Copy(outputPath)
+		ts.CloseLMDB()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":        err,
+				"LMDBPath":   ts.LMDBPath,
+				"outputPath": outputPath,
+			}).Error("failed to copy LMDB environment for migration")
+			return
+		}
+		ts.LMDBPath = outputPath
+		err = ts.openLMDB()
+		if err != nil {
+			return
+		}
+	}
+
+	for ; version < SchemaVersion; version++ {
+		m := migrations[version]
+		log.WithFields(log.Fields{
+			"from":        version,
+			"to":          version + 1,
+			"description": m.description,
+			"LMDBPath":    ts.LMDBPath,
+		}).Info("migrating LMDB environment")
+
+		err = m.step(ts)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":  err,
+				"from": version,
+			}).Error("migration step failed")
+			return
+		}
+		err = ts.setSchemaVersion(version + 1)
+		if err != nil {
+			return
+		}
+		// each version must be on disk before the next step starts
+		err = ts.LMDBEnv.Sync(true)
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("failed to sync migrated LMDB environment")
+			return
+		}
+	}
+	return
+}
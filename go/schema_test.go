@@ -0,0 +1,115 @@
+package treeserve
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestSchemaVersion(t *testing.T) {
+	lmdbDir, err := ioutil.TempDir("", "schema_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory for LMDB: %v", err)
+	}
+	defer os.RemoveAll(lmdbDir)
+
+	lmdbPath := lmdbDir + "/lmdb"
+	ts := buildTestTree(t, lmdbPath, testTreeLines)
+	version, err := ts.GetSchemaVersion()
+	if err != nil {
+		t.Error(err)
+	}
+	if version != SchemaVersion {
+		t.Errorf("Expected new environment to have schema version %d, got %d", SchemaVersion, version)
+	}
+
+	// pretend the tree was written before versioning
+	err = ts.SetState("treeReady")
+	if err != nil {
+		t.Fatalf("failed to set state: %v", err)
+	}
+	err = ts.setSchemaVersion(0)
+	if err != nil {
+		t.Fatalf("failed to set schema version: %v", err)
+	}
+	err = ts.SetMetadata("costReferenceTime", "")
+	if err != nil {
+		t.Fatalf("failed to clear cost reference time: %v", err)
+	}
+	ts.CloseLMDB()
+
+	ts = NewTreeServe(lmdbPath, 64*1024*1024, 2000, 1000, -1, 1000, -1, false)
+	err = ts.OpenLMDB()
+	if !IsSchemaVersionError(err) {
+		t.Fatalf("Expected schema version error opening old environment, got %v", err)
+	}
+
+	// the time the costs of a version 0 tree were calculated from must be given
+	migratedPath := lmdbDir + "/migrated"
+	if ts.Migrate(migratedPath) == nil {
+		t.Fatalf("Expected error migrating version 0 without a cost reference time")
+	}
+	if _, err = os.Stat(migratedPath); !os.IsNotExist(err) {
+		t.Errorf("Expected a failed migration not to write %s, got %v", migratedPath, err)
+	}
+	ts.CostReferenceTimeGiven = true
+
+	// migrating into a new environment leaves the old one alone
+	err = ts.Migrate(migratedPath)
+	if err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	ts.CloseLMDB()
+	ts = NewTreeServe(migratedPath, 64*1024*1024, 1000, 1000, -1, 1000, -1, false)
+	err = ts.OpenLMDB()
+	if err != nil {
+		t.Fatalf("failed to open migrated environment: %v", err)
+	}
+	if ts.CostReferenceTime != 2000 {
+		t.Errorf("Expected the given cost reference time to be saved, got %d", ts.CostReferenceTime)
+	}
+	verifyTestTree(t, ts, "migrated tree")
+	ts.CloseLMDB()
+
+	// and in place
+	ts = NewTreeServe(lmdbPath, 64*1024*1024, 2000, 1000, -1, 1000, -1, false)
+	if !IsSchemaVersionError(ts.OpenLMDB()) {
+		t.Errorf("Expected original environment to be unchanged")
+	}
+	ts.CostReferenceTimeGiven = true
+	err = ts.Migrate("")
+	if err != nil {
+		t.Fatalf("failed to migrate in place: %v", err)
+	}
+	// the steps that each need the tree refinalized share one Finalize
+	err = ts.resetAggregationDatabases()
+	if err != nil {
+		t.Fatalf("failed to reset aggregation databases: %v", err)
+	}
+	err = refinalizeOnce(ts)
+	if err != nil {
+		t.Fatalf("failed to refinalize: %v", err)
+	}
+	if stat, err := ts.AggregateSizeDB.Stat(); err != nil || stat.Entries != 0 {
+		t.Errorf("Expected a migration to only refinalize the tree once")
+	}
+	ts.CloseLMDB()
+	err = ts.OpenLMDB()
+	if err != nil {
+		t.Fatalf("failed to open environment migrated in place: %v", err)
+	}
+
+	// a newer version than this program knows is refused
+	err = ts.setSchemaVersion(SchemaVersion + 1)
+	if err != nil {
+		t.Fatalf("failed to set schema version: %v", err)
+	}
+	ts.CloseLMDB()
+	if !IsSchemaVersionError(ts.OpenLMDB()) {
+		t.Errorf("Expected schema version error opening newer environment")
+	}
+	if ts.Migrate("") == nil {
+		t.Errorf("Expected error migrating newer environment")
+		ts.CloseLMDB()
+	}
+}
@@ -14,10 +14,34 @@ func NewStatMapping() *StatMapping {
 
 func (sm *StatMapping) GetKey() (statMappingKey Md5Key) {
 	statMappingKey = Md5Key{}
-	statMappingKey.Sum([]byte(strings.Join([]string{sm.User, sm.Group, sm.Tag}, "|")))
+	parts := []string{sm.User, sm.Group, sm.Tag}
+	// mappings with only user, group and tag keep the keys they had before other dimensions
+	if sm.Dimensions != "" {
+		parts = append(parts, sm.Dimensions)
+	}
+	statMappingKey.Sum([]byte(strings.Join(parts, "|")))
 	return
 }
 
+// with returns a copy of sm with dimension set to value. Dimensions other than user, group and
+// tag are added to the end of Dimensions, so they must be set in order.
+func (sm StatMapping) with(dimension, value string) StatMapping {
+	switch dimension {
+	case dimensionUser:
+		sm.User = value
+	case dimensionGroup:
+		sm.Group = value
+	case dimensionTag:
+		sm.Tag = value
+	default:
+		if sm.Dimensions != "" {
+			sm.Dimensions += dimensionSeparator
+		}
+		sm.Dimensions += dimension + "=" + value
+	}
+	return sm
+}
+
 func (sm *StatMapping) MarshalBinary() (data []byte, err error) {
 	data, err = sm.Marshal(nil)
 	if err != nil {
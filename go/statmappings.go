@@ -42,7 +42,7 @@ func (statMappings *StatMappings) Contains(s *StatMapping) (ok bool) {
 
 	ok = false
 	for _, v := range statMappings.m {
-		if s.Group == v.Group && s.User == v.User && s.Tag == v.Tag {
+		if s.Group == v.Group && s.User == v.User && s.Tag == v.Tag && s.Dimensions == v.Dimensions {
 			ok = true
 			return
 		}
@@ -0,0 +1,376 @@
+package treeserve
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/bmatsuo/lmdb-go/lmdb"
+)
+
+// defaultTopK is how many of the largest files and directories are kept for each directory
+const defaultTopK = 10
+
+// Orderings of the top lists, the by parameter of /api/v2/top
+const (
+	topBySize       = "size"     // files by size
+	topByDirSize    = "dir_size" // directories by the size of everything under them
+	topByAccessCost = "acost"    // files by the cost since they were last accessed
+)
+
+var topOrderings = []string{topBySize, topByDirSize, topByAccessCost}
+
+// topEntry is a file or directory in a top list. For a directory in a group's list Gid is the
+// group and Size and Count are of that group's files.
+type topEntry struct {
+	Path             string `json:"path"`
+	Size             uint64 `json:"size"`
+	Count            uint64 `json:"count,omitempty"` // of a directory, the files and directories under it and itself
+	Uid              uint64 `json:"uid"`
+	Gid              uint64 `json:"gid"`
+	AccessTime       int64  `json:"atime,omitempty"`
+	ModificationTime int64  `json:"mtime,omitempty"`
+}
+
+func (e *topEntry) isDir() bool {
+	return e.Count > 0
+}
+
+// topLists are the top files and directories under a directory, in order with the largest first
+type topLists struct {
+	Size       []*topEntry `json:"size,omitempty"`
+	DirSize    []*topEntry `json:"dir_size,omitempty"`
+	AccessCost []*topEntry `json:"acost,omitempty"`
+}
+
+func (l *topLists) list(by string) *[]*topEntry {
+	switch by {
+	case topByDirSize:
+		return &l.DirSize
+	case topByAccessCost:
+		return &l.AccessCost
+	}
+	return &l.Size
+}
+
+// add puts e in the list ordered by by if it is in the top k
+func (l *topLists) add(by string, e *topEntry, k int, costReferenceTime int64) {
+	list := l.list(by)
+	*list = insertTop(*list, e, k, topValue(by, costReferenceTime))
+}
+
+// merge adds the entries of other to l
+func (l *topLists) merge(other *topLists, k int, costReferenceTime int64) {
+	for _, by := range topOrderings {
+		for _, e := range *other.list(by) {
+			l.add(by, e, k, costReferenceTime)
+		}
+	}
+}
+
+// topValue gets the value entries are ordered by
+func topValue(by string, costReferenceTime int64) func(e *topEntry) float64 {
+	if by == topByAccessCost {
+		return func(e *topEntry) float64 { return float64(e.Size) * float64(costReferenceTime-e.AccessTime) }
+	}
+	return func(e *topEntry) float64 { return float64(e.Size) }
+}
+
+// insertTop inserts e into list, which is in order of value largest first, keeping at most k.
+// Equal values are in order of path so the lists do not depend on the order nodes finish in.
+func insertTop(list []*topEntry, e *topEntry, k int, value func(e *topEntry) float64) []*topEntry {
+	v := value(e)
+	i := sort.Search(len(list), func(i int) bool {
+		vi := value(list[i])
+		return vi < v || (vi == v && list[i].Path > e.Path)
+	})
+	if i >= k {
+		return list
+	}
+	list = append(list, nil)
+	copy(list[i+1:], list[i:])
+	list[i] = e
+	if len(list) > k {
+		list = list[:k]
+	}
+	return list
+}
+
+// TopN is kept for each directory by Finalize: the top K files and directories under it and, if
+// the tree was built with TopByGroup, those of each group
+type TopN struct {
+	K      int                  `json:"k"`
+	All    topLists             `json:"all"`
+	Groups map[string]*topLists `json:"groups,omitempty"`
+}
+
+func (ts *TreeServe) newTopN() *TopN {
+	return &TopN{K: ts.TopK}
+}
+
+// MarshalBinary encodes tn as JSON for LMDB storage
+func (tn *TopN) MarshalBinary() (data []byte, err error) {
+	data, err = json.Marshal(tn)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to marshal top lists")
+	}
+	return
+}
+
+func (tn *TopN) UnmarshalBinary(data []byte) (err error) {
+	err = json.Unmarshal(data, tn)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to unmarshal top lists")
+	}
+	return
+}
+
+func (tn *TopN) groupLists(gid string) *topLists {
+	if tn.Groups == nil {
+		tn.Groups = make(map[string]*topLists)
+	}
+	l, ok := tn.Groups[gid]
+	if !ok {
+		l = &topLists{}
+		tn.Groups[gid] = l
+	}
+	return l
+}
+
+// merge adds the entries of the lists in other to tn
+func (tn *TopN) merge(other *TopN, costReferenceTime int64) {
+	if other == nil {
+		return
+	}
+	tn.All.merge(&other.All, tn.K, costReferenceTime)
+	for gid, l := range other.Groups {
+		tn.groupLists(gid).merge(l, tn.K, costReferenceTime)
+	}
+}
+
+// addToTopN adds a node to the lists its parent keeps: a file by its size and access cost, a
+// directory by the size of everything under it from its aggregate stats
+func (ts *TreeServe) addToTopN(tn *TopN, treeNode *TreeNode, isDir bool, aggregateStats []*AggregateStats) {
+	if tn.K <= 0 {
+		return
+	}
+	stats := treeNode.Stats
+	if !isDir {
+		if stats.FileType != 'f' {
+			return
+		}
+		e := &topEntry{Path: treeNode.Name, Size: stats.FileSize, Uid: stats.Uid, Gid: stats.Gid,
+			AccessTime: stats.AccessTime, ModificationTime: stats.ModificationTime}
+		for _, by := range []string{topBySize, topByAccessCost} {
+			tn.All.add(by, e, tn.K, ts.CostReferenceTime)
+			if ts.TopByGroup {
+				tn.groupLists(strconv.FormatUint(stats.Gid, 10)).add(by, e, tn.K, ts.CostReferenceTime)
+			}
+		}
+		return
+	}
+	for _, a := range aggregateStats {
+		for _, m := range a.StatMappings.Values() {
+			if m.User != "*" || m.Tag != "*" || m.Dimensions != "" || a.Count.isZero() {
+				continue
+			}
+			e := &topEntry{Path: treeNode.Name, Size: a.Size.Uint64(), Count: a.Count.Uint64(), Uid: stats.Uid, Gid: stats.Gid}
+			if m.Group == "*" {
+				tn.All.add(topByDirSize, e, tn.K, ts.CostReferenceTime)
+			} else if ts.TopByGroup {
+				gid, err := strconv.ParseUint(m.Group, 10, 64)
+				if err != nil {
+					LogError(err)
+					continue
+				}
+				e.Gid = gid
+				tn.groupLists(m.Group).add(topByDirSize, e, tn.K, ts.CostReferenceTime)
+			}
+		}
+	}
+}
+
+// saveTopN saves the lists for the directory at node
+func (ts *TreeServe) saveTopN(node *Md5Key, tn *TopN) (err error) {
+	if tn.K <= 0 {
+		return
+	}
+	err = ts.TopDB.Add(node, tn, true)
+	if err != nil {
+		LogError(err)
+	}
+	return
+}
+
+// getTopN gets the lists saved for the directory at nodeKey, which are empty if it has nothing under it
+func (ts *TreeServe) getTopN(nodeKey *Md5Key) (tn *TopN, err error) {
+	data, err := ts.TopDB.Get(nodeKey)
+	if lmdb.IsNotFound(err) {
+		return &TopN{}, nil
+	}
+	if err != nil {
+		return
+	}
+	tn = data.(*TopN)
+	return
+}
+
+// selectTop gets the first k entries ordered by by of the lists in tn for the groups in the set, or
+// all groups if it is nil, that p can see. Without lists for each group only the files of the
+// overall lists are left, so there may be fewer than k.
+func (tn *TopN) selectTop(by string, k int, groups map[string]bool, p *principal, costReferenceTime int64) (entries []*topEntry) {
+	restricted := p != nil && !p.all
+	if groups == nil && !restricted {
+		entries = *tn.All.list(by)
+		if len(entries) > k {
+			entries = entries[:k]
+		}
+		return
+	}
+
+	// p sees the entries of a group's lists through the group, and files through the user too,
+	// with the ids they have where the entry is
+	allowed := func(e *topEntry, byUser bool) bool {
+		g, u := strconv.FormatUint(e.Gid, 10), strconv.FormatUint(e.Uid, 10)
+		if groups != nil && !groups[g] {
+			return false
+		}
+		if !restricted {
+			return true
+		}
+		ids := p.idsAt(e.Path)
+		return ids.gids[g] || (byUser && ids.uids[u])
+	}
+	value := topValue(by, costReferenceTime)
+	// a file is in its group's lists and the overall ones, a directory in the lists of each group
+	seen := make(map[string]bool)
+	add := func(e *topEntry) {
+		key := e.Path + "\x00" + strconv.FormatUint(e.Gid, 10)
+		if !seen[key] {
+			seen[key] = true
+			entries = insertTop(entries, e, k, value)
+		}
+	}
+	gids := make([]string, 0, len(tn.Groups))
+	for gid := range tn.Groups {
+		if groups == nil || groups[gid] {
+			gids = append(gids, gid)
+		}
+	}
+	sort.Strings(gids)
+	for _, gid := range gids {
+		for _, e := range *tn.Groups[gid].list(by) {
+			if allowed(e, false) {
+				add(e)
+			}
+		}
+	}
+	// the overall size of a directory may include other groups' files
+	for _, e := range *tn.All.list(by) {
+		if !e.isDir() && allowed(e, true) {
+			add(e)
+		}
+	}
+	return
+}
+
+// topItem is an entry in a /api/v2/top response
+type topItem struct {
+	Path       string      `json:"path"`
+	Size       json.Number `json:"size"`
+	Count      json.Number `json:"count,omitempty"`
+	User       string      `json:"user,omitempty"`
+	Group      string      `json:"group"`
+	Atime      string      `json:"atime,omitempty"`
+	Mtime      string      `json:"mtime,omitempty"`
+	AccessCost json.Number `json:"acost,omitempty"`
+}
+
+// topResponse is the body of a /api/v2/top response
+type topResponse struct {
+	Date    string    `json:"date"` // when the input the tree was built from was made
+	Path    string    `json:"path"`
+	By      string    `json:"by"`
+	K       int       `json:"k"`
+	Entries []topItem `json:"entries"`
+}
+
+// top handles requests of the form <url>/api/v2/top?path=/lustre/scratch115&by=size&k=10, for the
+// largest files (by=size) or directories (by=dir_size) under path, or the files that have gone
+// unaccessed at the highest cost (by=acost). Giving group restricts them to the files and
+// directories of those groups.
+func (ts *TreeServe) top(w http.ResponseWriter, r *http.Request) *APIError {
+	path, _, apiErr := queryParameters(r)
+	if apiErr != nil {
+		return apiErr
+	}
+	vals := r.URL.Query()
+
+	by := vals.Get("by")
+	if by == "" {
+		by = topBySize
+	}
+	if by != topBySize && by != topByDirSize && by != topByAccessCost {
+		return badRequest(path, "by must be %s, not %q", strings.Join(topOrderings, ", "), by)
+	}
+
+	groups, unknown := filterSet(vals["group"], func(name string) (string, bool) { return ts.names.groupID(path, name) })
+	if len(unknown) > 0 {
+		return badRequest(path, "unknown group %s", strings.Join(unknown, ","))
+	}
+
+	nodeKey, apiErr := ts.visibleNodeKey(r, path)
+	if apiErr != nil {
+		return apiErr
+	}
+	tn, err := ts.getTopN(nodeKey)
+	if err != nil {
+		return internalError(path, err)
+	}
+
+	k := tn.K
+	if val := vals.Get("k"); val != "" {
+		k, err = strconv.Atoi(val)
+		if err != nil || k < 1 {
+			return badRequest(path, "k must be a whole number of at least 1, not %q", val)
+		}
+		if tn.K > 0 && k > tn.K {
+			return &APIError{Status: http.StatusUnprocessableEntity, Code: errorOverLimits, Path: path,
+				Message: fmt.Sprintf("k %d is more than the %d kept when the tree was built", k, tn.K)}
+		}
+	}
+
+	response := topResponse{Date: ts.scanDate.String(), Path: path, By: by, K: k, Entries: []topItem{}}
+	for _, e := range tn.selectTop(by, k, groups, principalFor(r), ts.CostReferenceTime) {
+		item := topItem{
+			Path:  e.Path,
+			Size:  json.Number(strconv.FormatUint(e.Size, 10)),
+			Group: ts.lookupGID(path, strconv.FormatUint(e.Gid, 10)),
+		}
+		if e.isDir() {
+			item.Count = json.Number(strconv.FormatUint(e.Count, 10))
+		} else {
+			item.User = ts.lookupUID(path, strconv.FormatUint(e.Uid, 10))
+			item.Atime = time.Unix(e.AccessTime, 0).UTC().Format(time.RFC3339)
+			item.Mtime = time.Unix(e.ModificationTime, 0).UTC().Format(time.RFC3339)
+			size, seconds, cost := NewBigint(), NewBigint(), NewBigint()
+			size.SetUint64(e.Size)
+			seconds.SetInt64(ts.CostReferenceTime - e.AccessTime)
+			cost.Mul(size, seconds)
+			item.AccessCost = json.Number(convertstatsForOutput(cost))
+		}
+		response.Entries = append(response.Entries, item)
+	}
+
+	j, err := json.Marshal(response)
+	if err != nil {
+		return internalError(path, err)
+	}
+	writeJSON(w, j)
+	return nil
+}
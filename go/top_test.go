@@ -0,0 +1,96 @@
+package treeserve
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTop(t *testing.T) {
+	ts, cleanup := newReadyTestTree(t)
+	defer cleanup()
+	ts.TopByGroup = true
+	err := ts.Finalize("/", 2)
+	if err != nil {
+		t.Fatalf("failed to finalize: %v", err)
+	}
+
+	get := func(query string, p *principal) (response topResponse, code int) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", apiPrefix+"/top?"+query, nil)
+		if p != nil {
+			r = r.WithContext(context.WithValue(r.Context(), principalContextKey{}, p))
+		}
+		ts.apiHandler(ts.top)(w, r)
+		if w.Code == http.StatusOK {
+			err := json.Unmarshal(w.Body.Bytes(), &response)
+			if err != nil {
+				t.Fatalf("failed to unmarshal %s: %v", w.Body.String(), err)
+			}
+		}
+		return response, w.Code
+	}
+	paths := func(response topResponse) string {
+		var p []string
+		for _, e := range response.Entries {
+			p = append(p, strings.TrimPrefix(e.Path, "/lustre/scratch/"))
+		}
+		return strings.Join(p, " ")
+	}
+
+	for _, c := range []struct{ query, paths string }{
+		{"path=/lustre", "b/c/z.cram a/y.txt a/x.bam"},
+		{"path=/lustre&k=2", "b/c/z.cram a/y.txt"},
+		{"path=/lustre/scratch/a", "a/y.txt a/x.bam"},
+		{"path=/lustre&by=acost", "a/y.txt b/c/z.cram a/x.bam"},
+		{"path=/lustre/scratch&by=dir_size", "b a b/c"},
+		{"path=/lustre/scratch&by=dir_size&group=20", "b b/c"},
+		{"path=/lustre&group=10", "a/y.txt a/x.bam"},
+		{"path=/lustre/scratch/a/x.bam", ""},
+	} {
+		response, code := get(c.query, nil)
+		if code != http.StatusOK {
+			t.Errorf("Expected 200 for %s, got %d", c.query, code)
+			continue
+		}
+		if got := paths(response); got != c.paths {
+			t.Errorf("Expected %s to give %q, got %q", c.query, c.paths, got)
+		}
+	}
+
+	response, _ := get("path=/lustre/scratch&by=dir_size", nil)
+	if e := response.Entries[0]; e.Size != "8492" || e.Count != "3" {
+		t.Errorf("Unexpected size and count of b %s %s", e.Size, e.Count)
+	}
+	response, _ = get("path=/lustre&by=acost&k=1", nil)
+	if e := response.Entries[0]; e.Group != "10" || e.User != "1" || e.Atime != "1970-01-01T00:08:20Z" || e.AccessCost == "" {
+		t.Errorf("Unexpected file entry %+v", e)
+	}
+
+	// restricted users only see their groups' and their own files
+	response, _ = get("path=/lustre", &principal{scopes: []idScope{{uids: map[string]bool{"5": true}, gids: map[string]bool{"10": true}}}})
+	if got := paths(response); got != "a/y.txt a/x.bam" {
+		t.Errorf("Expected a member of group 10 to only see its files, got %q", got)
+	}
+	response, _ = get("path=/lustre&group=20", &principal{scopes: []idScope{{uids: map[string]bool{"2": true}}}})
+	if got := paths(response); got != "b/c/z.cram" {
+		t.Errorf("Expected user 2 to see their own file, got %q", got)
+	}
+
+	for _, c := range []struct {
+		query string
+		code  int
+	}{
+		{"path=/lustre&by=name", http.StatusBadRequest},
+		{"path=/lustre&k=0", http.StatusBadRequest},
+		{"path=/lustre&k=11", http.StatusUnprocessableEntity},
+		{"path=/nowhere", http.StatusNotFound},
+	} {
+		if _, code := get(c.query, nil); code != c.code {
+			t.Errorf("Expected %d for %s, got %d", c.code, c.query, code)
+		}
+	}
+}
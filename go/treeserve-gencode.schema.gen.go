@@ -310,9 +310,10 @@ func (d *NodeStats) Unmarshal(buf []byte) (uint64, error) {
 }
 
 type StatMapping struct {
-	User  string
-	Group string
-	Tag   string
+	User       string
+	Group      string
+	Tag        string
+	Dimensions string
 }
 
 func (d *StatMapping) Size() (s uint64) {
@@ -362,6 +363,21 @@ func (d *StatMapping) Size() (s uint64) {
 		}
 		s += l
 	}
+	{
+		l := uint64(len(d.Dimensions))
+
+		{
+
+			t := l
+			for t >= 0x80 {
+				t >>= 7
+				s++
+			}
+			s++
+
+		}
+		s += l
+	}
 	return
 }
 func (d *StatMapping) Marshal(buf []byte) ([]byte, error) {
@@ -432,6 +448,25 @@ func (d *StatMapping) Marshal(buf []byte) ([]byte, error) {
 		copy(buf[i+0:], d.Tag)
 		i += l
 	}
+	{
+		l := uint64(len(d.Dimensions))
+
+		{
+
+			t := uint64(l)
+
+			for t >= 0x80 {
+				buf[i+0] = byte(t) | 0x80
+				t >>= 7
+				i++
+			}
+			buf[i+0] = byte(t)
+			i++
+
+		}
+		copy(buf[i+0:], d.Dimensions)
+		i += l
+	}
 	return buf[:i+0], nil
 }
 
@@ -498,5 +533,25 @@ func (d *StatMapping) Unmarshal(buf []byte) (uint64, error) {
 		d.Tag = string(buf[i+0 : i+0+l])
 		i += l
 	}
+	{
+		l := uint64(0)
+
+		{
+
+			bs := uint8(7)
+			t := uint64(buf[i+0] & 0x7F)
+			for buf[i+0]&0x80 == 0x80 {
+				i++
+				t |= uint64(buf[i+0]&0x7F) << bs
+				bs += 7
+			}
+			i++
+
+			l = t
+
+		}
+		d.Dimensions = string(buf[i+0 : i+0+l])
+		i += l
+	}
 	return i + 0, nil
 }
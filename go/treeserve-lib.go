@@ -27,8 +27,11 @@ import (
 	"io"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -44,13 +47,24 @@ type PathCheck func(string) bool
 type FinalizeWork struct {
 	SubtreeNode *Md5Key
 	Depth       int
-	Results     chan []*AggregateStats
+	Results     chan *SubtreeResults
+}
+
+// SubtreeResults is what aggregateSubtree passes up to the parent of a node: its aggregate stats
+// and the top lists and extension census including the node itself
+type SubtreeResults struct {
+	Stats      []*AggregateStats
+	Top        *TopN
+	Extensions *ExtensionCensus
 }
 
 type TreeServe struct {
 	LMDBPath                 string
 	LMDBMapSize              int64
+	LMDBMapGrowthFactor      float64 // factor to grow the map by when it is full
+	LMDBMaxMapSize           int64   // hard limit on growing the map
 	CostReferenceTime        int64
+	CostReferenceTimeGiven   bool // CostReferenceTime was chosen by the caller, which migrating a version 0 tree needs
 	NodesCreatedInfoEveryN   int64
 	NodesFinalizedInfoEveryN int64
 	FileCategoryPathChecks   map[string]PathCheck
@@ -65,11 +79,67 @@ type TreeServe struct {
 	AggregateCreateCostDB    GenericDB // maps  node+aggregateData  to aggregated cost since created for that node
 	AggregateModifyCostDB    GenericDB // maps  node+aggregateData  to aggregated cost since modified for that node
 	AggregateAccessCostDB    GenericDB // maps  node+aggregateData  to aggregated cost since accessed for that node
+	AggregateHistogramsDB    GenericDB // maps  node+aggregateData  to atime age and size histograms for that node
+	AggregateExtremesDB      GenericDB // maps  node+aggregateData  to oldest and newest times and largest file for that node
+	TopDB                    GenericDB // maps directory node Md5Key to the TopN lists of its subtree
+	ExtensionsDB             GenericDB // maps directory node Md5Key to the ExtensionCensus of its subtree
 	NodesCreated             int64
 	NodesFinalized           int64
 	StopInputAfterNLines     int64
 	StopFinalizeAfterNNodes  int64
 	Debug                    bool
+	lmdbResizeLock           sync.RWMutex  // held for writing while the LMDB map is resized
+	lmdbSwapLock             sync.RWMutex  // held for writing while switching to a newly published build
+	lmdbFileInfo             os.FileInfo   // identifies the environment file that is open
+	lmdbOpenPath             string        // the environment file that is open, with links resolved
+	lmdbOpen                 bool          // the environment is open, it is not while a server can't open a build
+	failedBuildInfo          os.FileInfo   // a published build that could not be switched to
+	migrationRefinalized     bool          // the tree has been refinalized by the migration in progress
+	ListenAddress            string        // host:port for the web server
+	ListenSocket             string        // unix socket path for the web server, used instead of ListenAddress
+	ListenSocketMode         os.FileMode   // permissions of ListenSocket, only the owner by default
+	TLSCertFile              string        // serve https with this certificate
+	TLSKeyFile               string        // and key
+	TLSClientCAFile          string        // require client certificates signed by these CAs
+	ShutdownTimeout          time.Duration // how long to wait for requests in progress when shutting down
+	stopWebserver            chan struct{}
+	MaxTreeDepth             int   // deepest /tree request allowed, 0 for no limit
+	MaxTreeNodes             int64 // most directories in a /tree response, 0 for no limit
+	MaxResponseBytes         int64 // largest /tree response, 0 for no limit
+	ResponseCacheEntries     int   // most responses kept in the cache, 0 for none
+	ResponseCacheBytes       int64 // most bytes of responses kept in the cache
+	responseCache            *responseCache
+	buildID                  string    // identifies the tree being served, for ETags
+	scanDate                 time.Time // when the input of the tree being served was made
+	progress                 buildProgress
+	webserverClosing         chan struct{} // closed when the web server starts shutting down
+	metrics                  *serverMetrics
+	MetricsPaths             []string // paths to give usage by group for in /metrics
+	HtpasswdFile             string   // authenticate users with basic auth against this htpasswd file
+	TokenFile                string   // authenticate bearer tokens listed in this file
+	TrustedProxyHeader       string   // take the user from this header set by a reverse proxy
+	TrustedProxies           []string // CIDRs the proxy header is accepted from, none by default
+	TrustListenSocket        bool     // accept the proxy header on ListenSocket too, off by default
+	AuthAdmins               []string // users who see every group and user, /metrics and /admin/db
+	CORSOrigin               string   // Access-Control-Allow-Origin of responses, "" for none
+	auth                     *authenticator
+	NameSources              []NameSource    // user and group files for volumes, used before -userFile and -groupFile
+	NameReloadInterval       time.Duration   // how often to check the user and group files for changes, 0 for only on SIGHUP
+	NameLookupOS             bool            // look up ids not in the files with os/user
+	names                    *nameResolver   // resolves the ids in the tree being served
+	TopK                     int             // length of the top lists kept for each directory, 0 for none
+	TopByGroup               bool            // keep top lists for each group as well
+	TopExtensions            int             // number of file extensions counted for each directory, 0 for none
+	Dimensions               []string        // what aggregates are broken down by, in the order of knownDimensions
+	Rollups                  [][]string      // combinations of Dimensions aggregates are kept for besides all "*", nil for every one
+	VolumeDepth              int             // number of path components that make up a volume
+	Projects                 []Project       // directories of projects, for the project dimension
+	ChargebackRates          ChargebackRates // prices per TiB year for the chargeback report
+	QuotaSources             []QuotaSource   // quota files of volumes for /api/v2/quota
+	QuotaWarnPercent         float64         // percentage of a quota used that gets a warning
+	quotaFiles               quotaFiles
+	QualitySamples           int // paths kept as examples of each data quality problem
+	dataQuality              dataQuality
 }
 
 // BinaryMarshallerUnmarshaller is used to make sure every
@@ -86,6 +156,29 @@ func NewTreeServe(lmdbPath string, lmdbMapSize int64, costReferenceTime int64, n
 	ts = new(TreeServe)
 	ts.LMDBPath = lmdbPath
 	ts.LMDBMapSize = lmdbMapSize
+	ts.LMDBMapGrowthFactor = defaultLMDBMapGrowthFactor
+	ts.LMDBMaxMapSize = defaultLMDBMaxMapSize
+	ts.ListenAddress = defaultListenAddress
+	ts.ListenSocketMode = defaultListenSocketMode
+	ts.ShutdownTimeout = defaultShutdownTimeout
+	ts.stopWebserver = make(chan struct{})
+	ts.webserverClosing = make(chan struct{})
+	ts.metrics = newServerMetrics()
+	ts.MaxTreeDepth = defaultMaxTreeDepth
+	ts.MaxTreeNodes = defaultMaxTreeNodes
+	ts.MaxResponseBytes = defaultMaxResponseBytes
+	ts.ResponseCacheEntries = defaultResponseCacheEntries
+	ts.ResponseCacheBytes = defaultResponseCacheBytes
+	ts.responseCache = newResponseCache()
+	ts.NameReloadInterval = defaultNameReloadInterval
+	ts.names = &nameResolver{}
+	ts.TopK = defaultTopK
+	ts.TopExtensions = defaultTopExtensions
+	ts.Dimensions = defaultDimensions
+	ts.VolumeDepth = defaultVolumeDepth
+	ts.ChargebackRates = ChargebackRates{Default: costPerTibYear}
+	ts.QuotaWarnPercent = defaultQuotaWarnPercent
+	ts.QualitySamples = defaultQualitySamples
 	ts.CostReferenceTime = costReferenceTime
 	ts.NodesCreatedInfoEveryN = nodesCreatedInfoEveryN
 	ts.StopInputAfterNLines = stopInputAfterNLines
@@ -132,6 +225,54 @@ func (ts *TreeServe) NewBigintDB(dbName string) (gdb GenericDB, err error) {
 	return
 }
 
+func (ts *TreeServe) NewHistogramsDB(dbName string) (gdb GenericDB, err error) {
+	gdb = GenericDB{DBCommon{TS: ts, Name: dbName}, func() BinaryMarshalUnmarshaler { return NewHistograms() }}
+	gdb.DBI, err = ts.openLMDBDBI(ts.LMDBEnv, gdb.Name, lmdb.Create)
+
+	log.WithFields(log.Fields{
+		"ts":     ts,
+		"dbName": dbName,
+	}).Debug("opened Histograms database")
+
+	return
+}
+
+func (ts *TreeServe) NewExtremesDB(dbName string) (gdb GenericDB, err error) {
+	gdb = GenericDB{DBCommon{TS: ts, Name: dbName}, func() BinaryMarshalUnmarshaler { return NewExtremes() }}
+	gdb.DBI, err = ts.openLMDBDBI(ts.LMDBEnv, gdb.Name, lmdb.Create)
+
+	log.WithFields(log.Fields{
+		"ts":     ts,
+		"dbName": dbName,
+	}).Debug("opened Extremes database")
+
+	return
+}
+
+func (ts *TreeServe) NewTopNDB(dbName string) (gdb GenericDB, err error) {
+	gdb = GenericDB{DBCommon{TS: ts, Name: dbName}, func() BinaryMarshalUnmarshaler { return &TopN{} }}
+	gdb.DBI, err = ts.openLMDBDBI(ts.LMDBEnv, gdb.Name, lmdb.Create)
+
+	log.WithFields(log.Fields{
+		"ts":     ts,
+		"dbName": dbName,
+	}).Debug("opened TopN database")
+
+	return
+}
+
+func (ts *TreeServe) NewExtensionCensusDB(dbName string) (gdb GenericDB, err error) {
+	gdb = GenericDB{DBCommon{TS: ts, Name: dbName}, func() BinaryMarshalUnmarshaler { return &ExtensionCensus{} }}
+	gdb.DBI, err = ts.openLMDBDBI(ts.LMDBEnv, gdb.Name, lmdb.Create)
+
+	log.WithFields(log.Fields{
+		"ts":     ts,
+		"dbName": dbName,
+	}).Debug("opened ExtensionCensus database")
+
+	return
+}
+
 func (ts *TreeServe) NewKeySetDB(dbName string) (ksdb KeySetDB, err error) {
 	ksdb = KeySetDB{DBCommon{TS: ts, Name: dbName}}
 	ksdb.DBI, err = ts.openLMDBDBI(ts.LMDBEnv, ksdb.Name, (lmdb.Create | lmdb.DupSort | lmdb.DupFixed))
@@ -144,126 +285,248 @@ func (ts *TreeServe) NewKeySetDB(dbName string) (ksdb KeySetDB, err error) {
 	return
 }
 
+// TagRule is how files are given a tag from their lower cased path, by its ending in or
+// containing one of Patterns
+type TagRule struct {
+	Tag      string   `json:"tag"`
+	Match    string   `json:"match"` // "suffix" or "contains"
+	Patterns []string `json:"patterns"`
+}
+
+// TagRules are the rules used to tag files, files matching none are tagged "other"
+var TagRules = []TagRule{
+	{"cram", "suffix", []string{".cram"}},
+	{"bam", "suffix", []string{".bam"}},
+	{"index", "suffix", []string{".crai", ".bai", ".sai", ".fai", ".csi"}},
+	{"compressed", "suffix", []string{".bzip2", ".gz", ".tgz", ".zip", ".xz", ".bgz", ".bcf"}},
+	{"uncompressed", "suffix", []string{".sam", ".fasta", ".fastq", ".fa", ".fq", ".vcf", ".csv", ".tsv", ".txt", ".text", "README"}},
+	{"checkpoint", "suffix", []string{"jobstate.context"}},
+	{"temporary", "contains", []string{"tmp", "temp"}},
+}
+
 func (ts *TreeServe) SetFileCategoryPathChecks() {
 	// TODO move to externally specifiable JSON?
 	ts.FileCategoryPathChecks = make(map[string]PathCheck)
-	ts.FileCategoryPathChecks["cram"] = func(path string) bool { return strings.HasSuffix(path, ".cram") }
-	ts.FileCategoryPathChecks["bam"] = func(path string) bool { return strings.HasSuffix(path, ".bam") }
-	ts.FileCategoryPathChecks["index"] = func(path string) bool {
-		for _, ending := range []string{".crai", ".bai", ".sai", ".fai", ".csi"} {
-			if strings.HasSuffix(path, ending) {
-				return true
-			}
+	for _, rule := range TagRules {
+		match := strings.HasSuffix
+		if rule.Match == "contains" {
+			match = strings.Contains
 		}
-		return false
-	}
-	ts.FileCategoryPathChecks["compressed"] = func(path string) bool {
-		for _, ending := range []string{".bzip2", ".gz", ".tgz", ".zip", ".xz", ".bgz", ".bcf"} {
-			if strings.HasSuffix(path, ending) {
-				return true
+		patterns := rule.Patterns
+		ts.FileCategoryPathChecks[rule.Tag] = func(path string) bool {
+			for _, pattern := range patterns {
+				if match(path, pattern) {
+					return true
+				}
 			}
+			return false
 		}
-		return false
 	}
-	ts.FileCategoryPathChecks["uncompressed"] = func(path string) bool {
-		for _, ending := range []string{".sam", ".fasta", ".fastq", ".fa", ".fq", ".vcf", ".csv", ".tsv", ".txt", ".text", "README"} {
-			if strings.HasSuffix(path, ending) {
-				return true
-			}
-		}
-		return false
+}
+
+// OpenLMDB opens the LMDB environment at LMDBPath and its databases. An environment with a
+// different schema version is refused, see Migrate.
+func (ts *TreeServe) OpenLMDB() (err error) {
+	err = ts.openLMDB()
+	if err != nil {
+		return
 	}
-	ts.FileCategoryPathChecks["checkpoint"] = func(path string) bool { return strings.HasSuffix(path, "jobstate.context") }
-	ts.FileCategoryPathChecks["temporary"] = func(path string) bool {
-		for _, containing := range []string{"tmp", "temp"} {
-			if strings.Contains(path, containing) {
-				return true
-			}
+
+	err = ts.checkSchemaVersion()
+	if err != nil {
+		ts.CloseLMDB()
+		return
+	}
+
+	// costs already saved in the tree were calculated from the time recorded when it was finalized
+	costReferenceTime, err := ts.GetMetadata("costReferenceTime")
+	if err != nil {
+		ts.CloseLMDB()
+		return
+	}
+	if costReferenceTime != "" {
+		ts.CostReferenceTime, err = strconv.ParseInt(costReferenceTime, 10, 64)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err":               err,
+				"costReferenceTime": costReferenceTime,
+			}).Error("failed to parse cost reference time saved in tree")
+			ts.CloseLMDB()
+			return
 		}
-		return false
 	}
+
+	ts.loadBuildID()
+	ts.loadScanDate()
+	ts.responseCache.purge()
+	return
 }
 
-func (ts *TreeServe) OpenLMDB() (err error) {
+// openLMDB opens the LMDB environment and its databases without checking the schema version.
+// The environment is left closed if it fails.
+func (ts *TreeServe) openLMDB() (err error) {
 
 	log.WithFields(log.Fields{"ts": ts}).Debug("configuring and opening LMDB environment")
 
 	ts.LMDBEnv, err = lmdb.NewEnv()
 	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Fatal("failed to create new LMDB environment")
+		log.WithFields(log.Fields{"err": err}).Error("failed to create new LMDB environment")
+		return
 	}
+	defer func() {
+		if err != nil {
+			ts.LMDBEnv.Close()
+		}
+		ts.lmdbOpen = err == nil
+	}()
 	err = ts.LMDBEnv.SetMapSize(ts.LMDBMapSize)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
 			"ts":  ts,
-		}).Fatal("failed to set LMDB environment map size")
+		}).Error("failed to set LMDB environment map size")
+		return
+	}
+	err = ts.LMDBEnv.SetMaxDBs(16)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to set LMDB environment max DBs")
+		return
+	}
+	// a published build is opened in its own directory so that LMDB uses the lock file there
+	envPath, err := filepath.EvalSymlinks(ts.LMDBPath)
+	if os.IsNotExist(err) {
+		envPath, err = ts.LMDBPath, nil
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+			"ts":  ts,
+		}).Error("failed to resolve LMDB environment path")
+		return
 	}
-	err = ts.LMDBEnv.SetMaxDBs(10)
+	err = ts.LMDBEnv.Open(envPath, (lmdb.MapAsync | lmdb.WriteMap | lmdb.NoSubdir), 0600)
 	if err != nil {
-		log.WithFields(log.Fields{"err": err}).Fatal("failed to set LMDB environment max DBs")
+		log.WithFields(log.Fields{
+			"err": err,
+			"ts":  ts,
+		}).Error("failed to open LMDB environment")
+		return
 	}
-	err = ts.LMDBEnv.Open(ts.LMDBPath, (lmdb.MapAsync | lmdb.WriteMap | lmdb.NoSubdir), 0600)
+	ts.lmdbOpenPath = envPath
+
+	ts.lmdbFileInfo, err = os.Stat(envPath)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err": err,
 			"ts":  ts,
-		}).Fatal("failed to open LMDB environment")
+		}).Error("failed to stat LMDB environment")
+		return
+	}
+
+	// an existing environment may already have been grown beyond the configured size
+	info, err := ts.LMDBEnv.Info()
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("failed to get LMDB environment info")
+		return
+	}
+	if info.MapSize > ts.LMDBMapSize {
+		log.WithFields(log.Fields{
+			"LMDBMapSize": ts.LMDBMapSize,
+			"MapSize":     info.MapSize,
+		}).Info("using larger map size from existing LMDB environment")
+		ts.LMDBMapSize = info.MapSize
 	}
 
 	ts.TreeServeDBI, err = ts.openLMDBDBI(ts.LMDBEnv, "TreeServe", lmdb.Create)
+	if err != nil {
+		return
+	}
 
 	log.WithFields(log.Fields{"ts": ts}).Debug("opened TreeServe database")
 
 	ts.TreeNodeDB, err = ts.NewTreeNodeDB("TreeNode")
 	if err != nil {
-		log.WithFields(log.Fields{"ts": ts}).Fatal("failed to open TreeNode database")
+		log.WithFields(log.Fields{"ts": ts}).Error("failed to open TreeNode database")
+		return
 	}
 
 	ts.StatMappingDB, err = ts.NewStatMappingDB("StatMapping")
 	if err != nil {
-		log.WithFields(log.Fields{"ts": ts}).Fatal("failed to open StatMapping database")
+		log.WithFields(log.Fields{"ts": ts}).Error("failed to open StatMapping database")
+		return
 	}
 
 	ts.ChildrenDB, err = ts.NewKeySetDB("Children")
 	if err != nil {
-		log.WithFields(log.Fields{"ts": ts}).Fatal("failed to open Children database")
+		log.WithFields(log.Fields{"ts": ts}).Error("failed to open Children database")
+		return
 	}
 
 	ts.StatMappingsDB, err = ts.NewKeySetDB("StatMappings")
 	if err != nil {
-		log.WithFields(log.Fields{"ts": ts}).Fatal("failed to open StatMappings database")
+		log.WithFields(log.Fields{"ts": ts}).Error("failed to open StatMappings database")
+		return
 	}
 
 	ts.AggregateSizeDB, err = ts.NewBigintDB("AggregateSize")
 	if err != nil {
-		log.WithFields(log.Fields{"ts": ts}).Fatal("failed to open AggregateSize database")
+		log.WithFields(log.Fields{"ts": ts}).Error("failed to open AggregateSize database")
+		return
 	}
 
 	ts.AggregateCountDB, err = ts.NewBigintDB("AggregateCount")
 	if err != nil {
-		log.WithFields(log.Fields{"ts": ts}).Fatal("failed to open AggregateCount database")
+		log.WithFields(log.Fields{"ts": ts}).Error("failed to open AggregateCount database")
+		return
 	}
 
 	ts.AggregateCreateCostDB, err = ts.NewBigintDB("AggregateCreateCost")
 	if err != nil {
-		log.WithFields(log.Fields{"ts": ts}).Fatal("failed to open AggregateCreateCost database")
+		log.WithFields(log.Fields{"ts": ts}).Error("failed to open AggregateCreateCost database")
+		return
 	}
 
 	ts.AggregateModifyCostDB, err = ts.NewBigintDB("AggregateModifyCost")
 	if err != nil {
-		log.WithFields(log.Fields{"ts": ts}).Fatal("failed to open AggregateModifyCost database")
+		log.WithFields(log.Fields{"ts": ts}).Error("failed to open AggregateModifyCost database")
+		return
 	}
 
 	ts.AggregateAccessCostDB, err = ts.NewBigintDB("AggregateAccessCost")
 	if err != nil {
-		log.WithFields(log.Fields{"ts": ts}).Fatal("failed to open AggregateAccessCost database")
+		log.WithFields(log.Fields{"ts": ts}).Error("failed to open AggregateAccessCost database")
+		return
+	}
+
+	ts.AggregateHistogramsDB, err = ts.NewHistogramsDB("AggregateHistograms")
+	if err != nil {
+		log.WithFields(log.Fields{"ts": ts}).Error("failed to open AggregateHistograms database")
+		return
+	}
+
+	ts.AggregateExtremesDB, err = ts.NewExtremesDB("AggregateExtremes")
+	if err != nil {
+		log.WithFields(log.Fields{"ts": ts}).Error("failed to open AggregateExtremes database")
+		return
+	}
+
+	ts.TopDB, err = ts.NewTopNDB("Top")
+	if err != nil {
+		log.WithFields(log.Fields{"ts": ts}).Error("failed to open Top database")
+		return
+	}
+
+	ts.ExtensionsDB, err = ts.NewExtensionCensusDB("Extensions")
+	if err != nil {
+		log.WithFields(log.Fields{"ts": ts}).Error("failed to open Extensions database")
+		return
 	}
 
 	return
 }
 
 func (ts *TreeServe) CloseLMDB() {
+	ts.lmdbOpen = false
 	ts.LMDBEnv.Close()
 }
 
@@ -380,17 +643,21 @@ func (ts *TreeServe) GetTags(treeNode *TreeNode) (categories []string) {
 	categories = append(categories, "*")
 
 	// add property based on file type
-	switch treeNode.Stats.FileType {
+	categories = append(categories, fileTypeName(treeNode.Stats.FileType))
+	return
+}
+
+// fileTypeName gets the tag for a file type
+func fileTypeName(fileType byte) string {
+	switch fileType {
 	case 'f':
-		categories = append(categories, "file")
+		return "file"
 	case 'd':
-		categories = append(categories, "directory")
+		return "directory"
 	case 'l':
-		categories = append(categories, "link")
-	default:
-		categories = append(categories, fmt.Sprintf("type_%s", string(treeNode.Stats.FileType)))
+		return "link"
 	}
-	return
+	return fmt.Sprintf("type_%s", string(fileType))
 }
 
 // createTreeNode adds a node to the database, with its parent and data
@@ -418,7 +685,16 @@ func (ts *TreeServe) createTreeNode(nodePath string, fileType string, nodeStats
 		overwrite = false
 	}
 
-	err = ts.TreeNodeDB.Add(nodeKey, node, overwrite)
+	if overwrite {
+		var previous BinaryMarshalUnmarshaler
+		previous, err = ts.TreeNodeDB.Replace(nodeKey, node)
+		// placeholders made for parents that come later in the input have empty stats
+		if err == nil && previous != nil && previous.(*TreeNode).Stats != (NodeStats{}) {
+			ts.noteDuplicateLine(nodePath)
+		}
+	} else {
+		err = ts.TreeNodeDB.Add(nodeKey, node, overwrite)
+	}
 
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -447,10 +723,10 @@ func (ts *TreeServe) createTreeNode(nodePath string, fileType string, nodeStats
 			return
 		}
 	}
-	ts.NodesCreated++
-	if ts.NodesCreated%ts.NodesCreatedInfoEveryN == 0 {
+	nodesCreated := atomic.AddInt64(&ts.NodesCreated, 1)
+	if nodesCreated%ts.NodesCreatedInfoEveryN == 0 {
 		log.WithFields(log.Fields{
-			"ts.NodesCreated": ts.NodesCreated,
+			"ts.NodesCreated": nodesCreated,
 		}).Info("created nodes")
 	}
 	return
@@ -502,6 +778,7 @@ func (ts *TreeServe) processLine(line string) (err error) {
 	//linkCount := s[9]
 	//devId := s[10]
 	nodeStats := NodeStats{size, uid, gid, accessTime, modificationTime, changeTime, fileType[0]}
+	ts.checkLine(nodePath, nodeStats)
 
 	log.WithFields(log.Fields{
 		"nodePath":  nodePath,
@@ -582,36 +859,64 @@ func (ts *TreeServe) FinalizeWorker(ctx context.Context, WorkerID int, finalizeW
 }
 
 func (ts *TreeServe) GetState() (state string, err error) {
-	var stateData []byte
-	err = ts.LMDBEnv.View(func(txn *lmdb.Txn) (err error) {
-		stateData, err = txn.Get(ts.TreeServeDBI, []byte("state"))
+	state, err = ts.GetMetadata("state")
+	return
+}
+
+// SetState records the state of the build. The environment is opened with MapAsync so nothing is
+// guaranteed to be on disk until it is synced, which is done here so that a build started again
+// after a crash can trust that everything done before the state it finds was saved.
+func (ts *TreeServe) SetState(state string) (err error) {
+	err = ts.SetMetadata("state", state)
+	if err != nil {
+		return
+	}
+	err = ts.LMDBEnv.Sync(true)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err":      err,
+			"state":    state,
+			"LMDBPath": ts.LMDBPath,
+		}).Error("failed to sync LMDB environment after setting state")
+	}
+	return
+}
+
+// GetMetadata gets a value about the tree as a whole from ts.TreeServeDBI, or "" if it has not been set
+func (ts *TreeServe) GetMetadata(key string) (value string, err error) {
+	var valueData []byte
+	err = ts.view(func(txn *lmdb.Txn) (err error) {
+		valueData, err = txn.Get(ts.TreeServeDBI, []byte(key))
 		return
 	})
 	if lmdb.IsNotFound(err) {
-		state = ""
+		value = ""
 		err = nil
 		return
 	} else if err != nil {
 		log.WithFields(log.Fields{
+			"key": key,
 			"err": err,
-		}).Fatal("failed to get state from ts.TreeServeDBI")
+		}).Error("failed to get metadata from ts.TreeServeDBI")
 	}
-	state = string(stateData)
+	value = string(valueData)
 	return
 }
 
-func (ts *TreeServe) SetState(state string) (err error) {
-	stateData := []byte(state)
-	err = ts.LMDBEnv.Update(func(txn *lmdb.Txn) (err error) {
-		err = txn.Put(ts.TreeServeDBI, []byte("state"), stateData, 0)
+// SetMetadata saves a value about the tree as a whole in ts.TreeServeDBI
+func (ts *TreeServe) SetMetadata(key string, value string) (err error) {
+	valueData := []byte(value)
+	err = ts.update(func(txn *lmdb.Txn) (err error) {
+		err = txn.Put(ts.TreeServeDBI, []byte(key), valueData, 0)
 		return
 	})
 	if err != nil {
 		log.WithFields(log.Fields{
-			"state":     state,
-			"stateData": stateData,
+			"key":       key,
+			"value":     value,
+			"valueData": valueData,
 			"err":       err,
-		}).Fatal("failed to set state in ts.TreeServeDBI")
+		}).Fatal("failed to set metadata in ts.TreeServeDBI")
 	}
 	return
 }
@@ -639,6 +944,15 @@ func (ts *TreeServe) ProcessInput(inputPath string, workers int) (err error) {
 			"ts":  ts,
 		}).Fatal("failed to reset children database")
 	}
+	err = ts.startBuildInfo(inputPath)
+	if err != nil {
+		return
+	}
+	ts.resetInputQuality()
+	ts.progress.startPhase()
+	atomic.StoreInt64(&ts.progress.linesRead, 0)
+	atomic.StoreInt64(&ts.progress.inputBytes, 0)
+
 	var inputWorkerGroup errgroup.Group
 	lines := make(chan string, workers*10)
 	for WorkerID := 1; WorkerID <= workers; WorkerID++ {
@@ -663,8 +977,11 @@ func (ts *TreeServe) ProcessInput(inputPath string, workers int) (err error) {
 		}).Fatal("Error opening input")
 	}
 	defer inputFile.Close()
+	if fileInfo, err := inputFile.Stat(); err == nil {
+		atomic.StoreInt64(&ts.progress.inputSize, fileInfo.Size())
+	}
 
-	gzipReader, err := gzip.NewReader(inputFile)
+	gzipReader, err := gzip.NewReader(&countingReader{r: inputFile, n: &ts.progress.inputBytes})
 	if err != nil {
 		log.WithFields(log.Fields{
 			"err":       err,
@@ -680,6 +997,7 @@ func (ts *TreeServe) ProcessInput(inputPath string, workers int) (err error) {
 	for lineScanner.Scan() {
 		lines <- lineScanner.Text()
 		lineCount++
+		atomic.AddInt64(&ts.progress.linesRead, 1)
 		if ts.StopInputAfterNLines >= 0 && lineCount > ts.StopInputAfterNLines {
 			break
 		}
@@ -699,6 +1017,16 @@ func (ts *TreeServe) ProcessInput(inputPath string, workers int) (err error) {
 		log.Info("InputWorkers successfully processed all input lines")
 	}
 
+	ts.metrics.phaseDone("inputProcessing", time.Since(ts.progress.started()))
+	err = ts.updateBuildInfo(func(info *BuildInfo) {
+		info.InputLines = lineCount
+		info.InputTruncated = ts.StopInputAfterNLines >= 0 && lineCount > ts.StopInputAfterNLines
+		info.NodesCreated = ts.NodesCreated
+	})
+	if err != nil {
+		return
+	}
+	err = ts.saveDataQuality()
 	return
 }
 
@@ -717,16 +1045,24 @@ func (ts *TreeServe) GenerateAggregateKeys(nodeKey *Md5Key, statMappingKey *Md5K
 }
 
 // GetStatMappings calculates a set of aggregate cost breakdown mappings for a node.
-// Just the group/user/tag information not the actual costs.
+// Just the group/user/tag and other dimension information not the actual costs. There is one
+// for each of the node's values of the dimensions of each rollup combination, with the rest "*".
 func (ts *TreeServe) GetStatMappings(tn *TreeNode) (statMappings *StatMappings) {
 	statMappings = NewStatMappings()
-	tags := ts.GetTags(tn)
-	for _, u := range []string{"*", strconv.FormatUint(tn.Stats.Uid, 10)} {
-		for _, g := range []string{"*", strconv.FormatUint(tn.Stats.Gid, 10)} {
-			for _, t := range tags {
-				statMapping := StatMapping{u, g, t}
-				statMappings.Add(statMapping.GetKey(), &statMapping)
+	values := ts.dimensionValues(tn)
+	for _, combination := range ts.rollupCombinations() {
+		mappings := []StatMapping{{User: "*", Group: "*", Tag: "*"}}
+		for _, d := range combination {
+			var next []StatMapping
+			for _, m := range mappings {
+				for _, v := range values[d] {
+					next = append(next, m.with(d, v))
+				}
 			}
+			mappings = next
+		}
+		for i := range mappings {
+			statMappings.Add(mappings[i].GetKey(), &mappings[i])
 		}
 	}
 	return
@@ -734,7 +1070,7 @@ func (ts *TreeServe) GetStatMappings(tn *TreeNode) (statMappings *StatMappings)
 
 // Calculate AggregateStats finds the aggregate costs breakdown for a node, worked out from the
 // size and elapsed time. If there is no file entry for a node (shown by
-// zero create time return empty )
+// zero create time return empty ), which Finalize counts in the data quality report
 func (ts *TreeServe) CalculateAggregateStats(nodeKey *Md5Key) (aggregateStats *AggregateStats, err error) {
 
 	log.WithFields(log.Fields{
@@ -752,7 +1088,9 @@ func (ts *TreeServe) CalculateAggregateStats(nodeKey *Md5Key) (aggregateStats *A
 	}
 
 	if treeNode.Stats.ChangeTime == 0 {
-		LogError(fmt.Errorf("No file entry, or empty file entry, for node %s ", treeNode.Name))
+		log.WithFields(log.Fields{
+			"treeNode.Name": treeNode.Name,
+		}).Debug("no file entry, or empty file entry, for node")
 		return
 	}
 
@@ -791,6 +1129,8 @@ func (ts *TreeServe) CalculateAggregateStats(nodeKey *Md5Key) (aggregateStats *A
 		CreateCost:   createCost,
 		ModifyCost:   modifyCost,
 		AccessCost:   accessCost,
+		Histograms:   newNodeHistograms(treeNode.Stats.FileSize, ts.CostReferenceTime-treeNode.Stats.AccessTime),
+		Extremes:     newNodeExtremes(treeNode.Stats),
 	}
 
 	return
@@ -803,6 +1143,32 @@ func (ts *TreeServe) Finalize(startPath string, workers int) (err error) {
 	// Ensure aggregation databases are reset
 	ts.resetAggregationDatabases()
 
+	// a build started again at finalize only knows how many nodes there are from its build info
+	totalNodes := atomic.LoadInt64(&ts.NodesCreated)
+	if info, err := ts.GetBuildInfo(); err == nil && info.NodesCreated > totalNodes {
+		totalNodes = info.NodesCreated
+	}
+	atomic.StoreInt64(&ts.progress.totalNodes, totalNodes)
+	ts.progress.startPhase()
+
+	// save the time costs are calculated from so they can be recalculated consistently later
+	ts.SetMetadata("costReferenceTime", strconv.FormatInt(ts.CostReferenceTime, 10))
+	err = ts.updateBuildInfo(func(info *BuildInfo) {
+		info.Dimensions = ts.Dimensions
+		info.Rollups = ts.rollupNames()
+	})
+	if err != nil {
+		return
+	}
+	err = ts.saveProjects()
+	if err != nil {
+		return
+	}
+	err = ts.resetFinalizeQuality()
+	if err != nil {
+		return
+	}
+
 	// set up context for cancelling workers.
 	//Package errgroup provides synchronization, error propagation,
 	//and Context cancelation for groups of goroutines working on subtasks of a common task.
@@ -835,7 +1201,7 @@ func (ts *TreeServe) Finalize(startPath string, workers int) (err error) {
 	}
 
 	startnode := ts.getPathKey(startPath)
-	startnodeResults := make(chan []*AggregateStats, 1)
+	startnodeResults := make(chan *SubtreeResults, 1)
 	startnodeWork := FinalizeWork{SubtreeNode: startnode, Depth: 0, Results: startnodeResults}
 
 	log.Info("Finalize: submitting initial finalizework to workers")
@@ -850,7 +1216,7 @@ WaitForResults:
 			break WaitForResults
 		case _ = <-nodesFinalized:
 
-			ts.NodesFinalized++
+			atomic.AddInt64(&ts.NodesFinalized, 1)
 			logInfo(" Nodes Finalised: " + strconv.Itoa(int(ts.NodesFinalized)))
 			if ts.StopFinalizeAfterNNodes >= 0 && ts.NodesFinalized > ts.StopFinalizeAfterNNodes {
 
@@ -879,7 +1245,9 @@ WaitForResults:
 	} else {
 		log.Info("FinalizeWorkers successfully processed all subtree nodes")
 	}
+	ts.metrics.phaseDone("finalize", time.Since(ts.progress.started()))
 
+	err = ts.finishDataQuality()
 	return
 }
 
@@ -897,7 +1265,7 @@ func (ts *TreeServe) aggregateSubtree(ctx context.Context, WorkerID int, subtree
 		}).Error("failed to get child keys for node")
 	}
 
-	childResults := make(chan []*AggregateStats, len(childKeys))
+	childResults := make(chan *SubtreeResults, len(childKeys))
 
 	for _, childKey := range childKeys {
 		childWork := &FinalizeWork{SubtreeNode: childKey, Depth: level + 1, Results: childResults}
@@ -924,19 +1292,24 @@ func (ts *TreeServe) aggregateSubtree(ctx context.Context, WorkerID int, subtree
 	a, err := ts.CalculateAggregateStats(node)
 
 	aggregateStats := []*AggregateStats{a}
+	top := ts.newTopN()
+	extensions := ts.newExtensionCensus()
+	var childExtensions []*ExtensionCensus
 
 	for range childKeys {
 
-		var childAggregateStats []*AggregateStats
+		var childSubtreeResults *SubtreeResults
 	WaitForIthChildResults:
 		for {
 			select {
 			case <-ctx.Done():
 
 				return
-			case childAggregateStats = <-childResults:
+			case childSubtreeResults = <-childResults:
 				//aggregateStats.Add(childAggregateStats)
-				aggregateStats = append(aggregateStats, childAggregateStats...)
+				aggregateStats = append(aggregateStats, childSubtreeResults.Stats...)
+				top.merge(childSubtreeResults.Top, ts.CostReferenceTime)
+				childExtensions = append(childExtensions, childSubtreeResults.Extensions)
 				break WaitForIthChildResults
 			}
 		}
@@ -944,13 +1317,26 @@ func (ts *TreeServe) aggregateSubtree(ctx context.Context, WorkerID int, subtree
 	}
 
 	aggregateStats, _ = combineAggregateStats(aggregateStats)
-	subtreeWork.Results <- aggregateStats
-	// save here as node is finished.... sarah
 
 	x, _ := ts.GetTreeNode(node)
+	ts.checkNode(x)
+	isDir := len(childKeys) > 0 || x.Stats.FileType == 'd'
+	// a directory's own lists are of what is under it, its parent's include it too
+	if isDir {
+		ts.saveTopN(node, top)
+	}
+	if isDir {
+		extensions.merge(childExtensions)
+		ts.saveExtensionCensus(node, extensions)
+	}
+	ts.addToTopN(top, x, isDir, aggregateStats)
+	extensions.addFile(x)
+	subtreeWork.Results <- &SubtreeResults{Stats: aggregateStats, Top: top, Extensions: extensions}
+	// save here as node is finished.... sarah
+
 	logInfo("saving for " + x.Name)
 
-	ts.saveAggregateStats(node, aggregateStats)
+	ts.saveAggregateStats(node, aggregateStats, isDir)
 	//
 	select {
 	case <-ctx.Done():
@@ -976,7 +1362,8 @@ func (ts *TreeServe) openLMDBDBI(lmdbEnv *lmdb.Env, dbName string, flags uint) (
 		log.WithFields(log.Fields{
 			"err":    err,
 			"dbName": dbName,
-		}).Fatal("failed to open/create LMDB database")
+		}).Error("failed to open/create LMDB database")
+		return
 	}
 	var dbiStat *lmdb.Stat
 	err = lmdbEnv.View(func(txn *lmdb.Txn) (err error) {
@@ -987,7 +1374,8 @@ func (ts *TreeServe) openLMDBDBI(lmdbEnv *lmdb.Env, dbName string, flags uint) (
 		log.WithFields(log.Fields{
 			"err":    err,
 			"dbName": dbName,
-		}).Fatal("failed to get stats for LMDB database")
+		}).Error("failed to get stats for LMDB database")
+		return
 	}
 	log.WithFields(log.Fields{
 		"dbiStat": dbiStat,
@@ -1049,6 +1437,34 @@ func (ts *TreeServe) resetAggregationDatabases() (err error) {
 			"ts":  ts,
 		}).Fatal("failed to reset aggregate access cost database")
 	}
+	err = ts.AggregateHistogramsDB.Reset()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+			"ts":  ts,
+		}).Fatal("failed to reset aggregate histograms database")
+	}
+	err = ts.AggregateExtremesDB.Reset()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+			"ts":  ts,
+		}).Fatal("failed to reset aggregate extremes database")
+	}
+	err = ts.TopDB.Reset()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+			"ts":  ts,
+		}).Fatal("failed to reset top database")
+	}
+	err = ts.ExtensionsDB.Reset()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+			"ts":  ts,
+		}).Fatal("failed to reset extensions database")
+	}
 
 	return
 }
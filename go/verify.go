@@ -0,0 +1,369 @@
+package treeserve
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Names of the checks made by Verify
+const (
+	checkParentKey  = "parent_key"
+	checkNodeKey    = "node_key"
+	checkMissing    = "missing_node"
+	checkOrphan     = "orphan_node"
+	checkCycle      = "cycle"
+	checkAggregates = "aggregates"
+	checkLineCount  = "line_count"
+)
+
+// maxVerifyFailuresPerCheck limits how many failures of each check are kept in the report, all are counted
+const maxVerifyFailuresPerCheck = 100
+
+// VerifyFailure describes one problem found in the database
+type VerifyFailure struct {
+	Check   string `json:"check"`
+	Path    string `json:"path,omitempty"`
+	Message string `json:"message"`
+}
+
+// VerifyReport is the result of checking the integrity of the database
+type VerifyReport struct {
+	LMDBPath      string           `json:"lmdb_path"`
+	OK            bool             `json:"ok"`
+	NodesInDB     uint64           `json:"nodes_in_db"`
+	NodesInTree   uint64           `json:"nodes_in_tree"`
+	NodesWithData uint64           `json:"nodes_with_data"`
+	InputLines    int64            `json:"input_lines,omitempty"`
+	RootCount     string           `json:"root_count"`
+	FailureCounts map[string]int64 `json:"failure_counts"`
+	Failures      []VerifyFailure  `json:"failures"`
+}
+
+func (report *VerifyReport) fail(check string, path string, format string, a ...interface{}) {
+	report.OK = false
+	report.FailureCounts[check]++
+	if report.FailureCounts[check] <= maxVerifyFailuresPerCheck {
+		report.Failures = append(report.Failures, VerifyFailure{Check: check, Path: path, Message: fmt.Sprintf(format, a...)})
+	}
+}
+
+// Verify walks the tree from the root checking that the children, parents and keys of every
+// node agree, that there are no orphan nodes or cycles and that the aggregates of each node are
+// its own stats plus those of its children. If inputLines is not negative the root "*" count is
+// checked against it, otherwise against the number of nodes with data.
+func (ts *TreeServe) Verify(inputLines int64) (report *VerifyReport, err error) {
+	report = &VerifyReport{LMDBPath: ts.LMDBPath, OK: true, FailureCounts: make(map[string]int64)}
+
+	treeNodeStat, err := ts.TreeNodeDB.Stat()
+	if err != nil {
+		return
+	}
+	report.NodesInDB = treeNodeStat.Entries
+
+	rootKey := ts.getPathKey("/")
+	haveRoot, err := ts.TreeNodeDB.HasKey(rootKey)
+	if err != nil {
+		return
+	}
+	if !haveRoot {
+		report.fail(checkMissing, "/", "root node is not in the database")
+		return
+	}
+
+	// depth first walk from the root. A child is only followed if its ParentKey points back to
+	// the node it was listed under, so the walk cannot loop even if the children database does.
+	stack := []*Md5Key{rootKey}
+	for len(stack) > 0 {
+		nodeKey := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		node, err := ts.GetTreeNode(nodeKey)
+		if err != nil {
+			return report, err
+		}
+		report.NodesInTree++
+		if node.Stats.ChangeTime != 0 {
+			report.NodesWithData++
+		}
+		if *ts.getPathKey(node.Name) != *nodeKey {
+			report.fail(checkNodeKey, node.Name, "node is stored under a key that is not the MD5 of its name")
+		}
+
+		childKeys, err := ts.children(nodeKey)
+		if err != nil {
+			return report, err
+		}
+		var existingChildKeys []*Md5Key
+		for _, childKey := range childKeys {
+			haveChild, err := ts.TreeNodeDB.HasKey(childKey)
+			if err != nil {
+				return report, err
+			}
+			if !haveChild {
+				report.fail(checkMissing, node.Name, "child %x is listed but not in the database", childKey.GetBytes())
+				continue
+			}
+			existingChildKeys = append(existingChildKeys, childKey)
+			child, err := ts.GetTreeNode(childKey)
+			if err != nil {
+				return report, err
+			}
+			if child.ParentKey != nodeKey.GetFixedBytes() {
+				report.fail(checkParentKey, child.Name, "listed as a child of %s but its parent key does not match", node.Name)
+				continue
+			}
+			stack = append(stack, childKey)
+		}
+
+		err = ts.verifyAggregates(report, nodeKey, node, existingChildKeys)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	// anything in the database that the walk did not reach is detached from the root
+	if report.NodesInTree != report.NodesInDB {
+		err = ts.findOrphans(report, rootKey)
+		if err != nil {
+			return
+		}
+	}
+
+	err = ts.verifyLineCount(report, rootKey, inputLines)
+	return
+}
+
+// verifyAggregates checks that the aggregates stored for a node are its own stats plus the sum of its children's
+func (ts *TreeServe) verifyAggregates(report *VerifyReport, nodeKey *Md5Key, node *TreeNode, childKeys []*Md5Key) (err error) {
+	expected := make(map[string]Aggregates)
+	own, err := ts.ownAggregates(nodeKey)
+	if err != nil {
+		return
+	}
+	for _, a := range own {
+		addToAggregateMap(expected, a)
+	}
+	for _, childKey := range childKeys {
+		// files have no histograms or extremes stored, so what they add is their own stats
+		isDir, err := ts.hasStoredDistributions(childKey)
+		if err != nil {
+			return err
+		}
+		var childAggregates []Aggregates
+		if isDir {
+			childAggregates, err = ts.retrieveAggregates(childKey)
+		} else {
+			childAggregates, err = ts.ownAggregates(childKey)
+		}
+		if err != nil {
+			return err
+		}
+		for _, a := range childAggregates {
+			addToAggregateMap(expected, a)
+		}
+	}
+	if len(childKeys) == 0 && node.Stats.FileType != 'd' {
+		for k, a := range expected {
+			a.Histograms, a.Extremes = nil, nil
+			expected[k] = a
+		}
+	}
+
+	stored, err := ts.retrieveAggregates(nodeKey)
+	if err != nil {
+		return
+	}
+	storedMap := make(map[string]Aggregates)
+	for _, a := range stored {
+		addToAggregateMap(storedMap, a)
+	}
+
+	for k, e := range expected {
+		s, ok := storedMap[k]
+		if !ok {
+			report.fail(checkAggregates, node.Name, "no aggregates stored for %s", k)
+			continue
+		}
+		if !aggregatesEqual(e, s) {
+			report.fail(checkAggregates, node.Name, "aggregates for %s are %s, expected %s", k, aggregatesText(s), aggregatesText(e))
+		}
+	}
+	for k := range storedMap {
+		if _, ok := expected[k]; !ok {
+			report.fail(checkAggregates, node.Name, "aggregates stored for %s which has no data", k)
+		}
+	}
+	return
+}
+
+// ownAggregates gets the aggregates of the stats of the node at nodeKey alone
+func (ts *TreeServe) ownAggregates(nodeKey *Md5Key) (aggregates []Aggregates, err error) {
+	own, err := ts.CalculateAggregateStats(nodeKey)
+	if err != nil || own == nil {
+		return
+	}
+	return AggregatesFromAggregateStats([]*AggregateStats{own}), nil
+}
+
+// hasStoredDistributions is true if the node at nodeKey is a directory, which are the nodes
+// histograms and extremes are stored for
+func (ts *TreeServe) hasStoredDistributions(nodeKey *Md5Key) (isDir bool, err error) {
+	node, err := ts.GetTreeNode(nodeKey)
+	if err != nil {
+		return
+	}
+	if node.Stats.FileType == 'd' {
+		return true, nil
+	}
+	childKeys, err := ts.children(nodeKey)
+	return len(childKeys) > 0, err
+}
+
+// findOrphans follows the parent keys of every node in the database to find those that do not lead back to the root
+func (ts *TreeServe) findOrphans(report *VerifyReport, rootKey *Md5Key) (err error) {
+	log.WithFields(log.Fields{
+		"NodesInDB":   report.NodesInDB,
+		"NodesInTree": report.NodesInTree,
+	}).Info("verify: not every node is in the tree, looking for orphans")
+
+	err = ts.TreeNodeDB.ForEachKey(func(nodeKey *Md5Key) (err error) {
+		node, err := ts.GetTreeNode(nodeKey)
+		if err != nil {
+			return
+		}
+		if *nodeKey != *rootKey {
+			parentKey := &Md5Key{}
+			parentKey.SetBytes(node.ParentKey[:])
+			listed, err := ts.ChildrenDB.HasKeyInKeySet(parentKey, nodeKey)
+			if err != nil {
+				return err
+			}
+			if !listed {
+				report.fail(checkOrphan, node.Name, "node is not listed as a child of its parent")
+				return nil
+			}
+		}
+
+		seen := make(map[Md5Key]bool)
+		key := nodeKey
+		for *key != *rootKey {
+			if seen[*key] {
+				report.fail(checkCycle, node.Name, "following parent keys from this node loops")
+				return
+			}
+			seen[*key] = true
+
+			n, err := ts.GetTreeNode(key)
+			if err != nil {
+				return err
+			}
+			parentKey := &Md5Key{}
+			parentKey.SetBytes(n.ParentKey[:])
+			haveParent, err := ts.TreeNodeDB.HasKey(parentKey)
+			if err != nil {
+				return err
+			}
+			if !haveParent {
+				report.fail(checkOrphan, node.Name, "ancestor %s has a parent that is not in the database", n.Name)
+				return nil
+			}
+			key = parentKey
+		}
+		return
+	})
+	return
+}
+
+// verifyLineCount checks the "*" count for the root against the number of input lines or nodes with data
+func (ts *TreeServe) verifyLineCount(report *VerifyReport, rootKey *Md5Key, inputLines int64) (err error) {
+	rootAggregates, err := ts.retrieveAggregates(rootKey)
+	if err != nil {
+		return
+	}
+	rootCount := NewBigint()
+	for _, a := range rootAggregates {
+		if a.Group == "*" && a.User == "*" && a.Tag == "*" && a.Dimensions == "" {
+			rootCount = a.Count
+		}
+	}
+	report.RootCount = rootCount.Text(10)
+
+	expected := NewBigint()
+	what := "nodes with data"
+	if inputLines >= 0 {
+		report.InputLines = inputLines
+		expected.SetInt64(inputLines)
+		what = "input lines"
+	} else {
+		expected.SetUint64(report.NodesWithData)
+	}
+	if !rootCount.Equals(expected) {
+		report.fail(checkLineCount, "/", "root count is %s but there are %s %s", rootCount.Text(10), expected.Text(10), what)
+	}
+	return
+}
+
+// addToAggregateMap adds a set of aggregates into a map keyed by group, user and tag
+func addToAggregateMap(m map[string]Aggregates, a Aggregates) {
+	k := a.Group + "|" + a.User + "|" + a.Tag + "|" + a.Dimensions
+	if existing, ok := m[k]; ok {
+		a, _ = addAggregates(existing, a)
+	}
+	m[k] = a
+}
+
+// aggregatesEqual is true if all the aggregate values are the same
+func aggregatesEqual(a, b Aggregates) bool {
+	return a.Count.Equals(b.Count) && a.Size.Equals(b.Size) && a.AccessCost.Equals(b.AccessCost) &&
+		a.ModifyCost.Equals(b.ModifyCost) && a.ChangeCost.Equals(b.ChangeCost) && histogramsEqual(a.Histograms, b.Histograms) &&
+		extremesEqual(a.Extremes, b.Extremes)
+}
+
+func histogramsEqual(a, b *Histograms) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func extremesEqual(a, b *Extremes) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// aggregatesText describes aggregate values for a verify failure
+func aggregatesText(a Aggregates) string {
+	return fmt.Sprintf("count %s size %s atime cost %s mtime cost %s ctime cost %s histograms %v extremes %v", a.Count.Text(10), a.Size.Text(10),
+		a.AccessCost.Text(10), a.ModifyCost.Text(10), a.ChangeCost.Text(10), a.Histograms, a.Extremes)
+}
+
+// CountInputLines counts the lines in a gzipped input file that ProcessInput would use
+func CountInputLines(inputPath string, stopInputAfterNLines int64) (lineCount int64, err error) {
+	inputFile, err := os.Open(inputPath)
+	if err != nil {
+		return
+	}
+	defer inputFile.Close()
+
+	gzipReader, err := gzip.NewReader(inputFile)
+	if err != nil {
+		return
+	}
+	defer gzipReader.Close()
+
+	lineScanner := bufio.NewScanner(gzipReader)
+	for lineScanner.Scan() {
+		lineCount++
+		if stopInputAfterNLines >= 0 && lineCount > stopInputAfterNLines {
+			break
+		}
+	}
+	err = lineScanner.Err()
+	return
+}
@@ -0,0 +1,59 @@
+package treeserve
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	lmdbDir, err := ioutil.TempDir("", "verify_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory for LMDB: %v", err)
+	}
+	defer os.RemoveAll(lmdbDir)
+
+	ts := buildTestTree(t, lmdbDir+"/lmdb", testTreeLines)
+	defer ts.CloseLMDB()
+
+	report := verifyTestTree(t, ts, "tree")
+	if report.NodesInTree != uint64(len(testTreeLines)) {
+		t.Errorf("Expected %d nodes in tree, got %d", len(testTreeLines), report.NodesInTree)
+	}
+
+	// a wrong line count is reported
+	report, err = ts.Verify(int64(len(testTreeLines) + 1))
+	if err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	if report.OK || report.FailureCounts[checkLineCount] != 1 {
+		t.Errorf("Expected a line count failure, got %v", report.FailureCounts)
+	}
+
+	// a node whose parent is not in the tree is an orphan
+	orphan := &TreeNode{Name: "/nowhere/orphan", ParentKey: ts.getPathKey("/nowhere").GetFixedBytes()}
+	err = ts.TreeNodeDB.Add(ts.getPathKey(orphan.Name), orphan, true)
+	if err != nil {
+		t.Fatalf("failed to add orphan node: %v", err)
+	}
+	report, err = ts.Verify(-1)
+	if err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	if report.OK || report.FailureCounts[checkOrphan] != 1 {
+		t.Errorf("Expected an orphan failure, got %v", report.FailureCounts)
+	}
+}
+
+// verifyTestTree checks that ts, built from testTreeLines, verifies, describing it as what in
+// the failure
+func verifyTestTree(t *testing.T, ts *TreeServe, what string) (report *VerifyReport) {
+	report, err := ts.Verify(int64(len(testTreeLines)))
+	if err != nil {
+		t.Fatalf("failed to verify %s: %v", what, err)
+	}
+	if !report.OK {
+		t.Errorf("Expected %s to verify, got failures %v", what, report.Failures)
+	}
+	return
+}
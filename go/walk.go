@@ -0,0 +1,128 @@
+package treeserve
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// treeVisitor is told about each directory of a tree in depth first order as it is walked.
+// The dirTree passed has its aggregates in stats but no Data. Its ChildDirs are the children
+// that will be visited next, which do not have their own ChildDirs yet.
+type treeVisitor interface {
+	// enter is called for a directory before its children, parent is nil for the first directory
+	enter(t *dirTree, parent *dirTree, level int) error
+	// leave is called for a directory after its children
+	leave(t *dirTree, level int) error
+}
+
+// treeWalk holds what is needed to walk a tree one directory at a time, so that only the
+// directories on the way down and their siblings are held in memory
+type treeWalk struct {
+	ts          *TreeServe
+	depth       int
+	filter      *aggregateFilter
+	arrangement *childArrangement
+	visitor     treeVisitor
+}
+
+// walkTree visits the directory at nodeKey and its subdirectories down to depth in the same
+// order, and with the same filter and arrangement, as the nested /tree output
+func (ts *TreeServe) walkTree(nodeKey *Md5Key, depth int, filter *aggregateFilter, arrangement *childArrangement, visitor treeVisitor) (err error) {
+	walk := treeWalk{ts: ts, depth: depth, filter: filter, arrangement: arrangement, visitor: visitor}
+	node, err := ts.GetTreeNode(nodeKey)
+	if err != nil {
+		return
+	}
+	t, err := walk.dirNode(nodeKey, node)
+	if err != nil {
+		return
+	}
+	err = walk.visit(t, nil, 0)
+	return
+}
+
+// dirNode makes the dirTree for a directory with its filtered aggregates
+func (walk *treeWalk) dirNode(nodeKey *Md5Key, node *TreeNode) (t *dirTree, err error) {
+	t = &dirTree{key: nodeKey}
+	t.Path = strings.TrimSuffix(node.Name, "/")
+	_, t.Name = filepath.Split(t.Path)
+
+	stats, err := walk.ts.retrieveAggregates(nodeKey)
+	if err != nil {
+		return
+	}
+	t.stats = walk.filter.apply(t.Path, stats)
+	return
+}
+
+func (walk *treeWalk) visit(t *dirTree, parent *dirTree, level int) (err error) {
+	if t.key != nil && level < walk.depth {
+		children, err := walk.children(t)
+		if err != nil {
+			return err
+		}
+		var total int
+		t.ChildDirs, total = walk.arrangement.arrangeLevel(t.Path, children)
+		if walk.arrangement != nil {
+			t.TotalChildDirs = total
+		}
+	}
+
+	err = walk.visitor.enter(t, parent, level)
+	if err != nil {
+		return
+	}
+	for _, child := range t.ChildDirs {
+		err = walk.visit(child, t, level+1)
+		if err != nil {
+			return
+		}
+	}
+	err = walk.visitor.leave(t, level)
+
+	// finished with the children
+	t.ChildDirs = nil
+	return
+}
+
+// children makes the dirTrees for the subdirectories of t that have aggregates passing the filter,
+// followed by the *.* summary of t and the files in it
+func (walk *treeWalk) children(t *dirTree) (children []*dirTree, err error) {
+	ts := walk.ts
+	childKeys, err := ts.children(t.key)
+	if err != nil {
+		return
+	}
+
+	immediateChildStats := []*AggregateStats{}
+	own, err := ts.CalculateAggregateStats(t.key)
+	LogError(err)
+	immediateChildStats = append(immediateChildStats, own)
+
+	for _, childKey := range childKeys {
+		node, err := ts.GetTreeNode(childKey)
+		if err != nil {
+			return nil, err
+		}
+		if node.Stats.FileType == 'f' {
+			a, err := ts.CalculateAggregateStats(childKey)
+			LogError(err)
+			immediateChildStats = append(immediateChildStats, a)
+			continue
+		}
+		child, err := walk.dirNode(childKey, node)
+		if err != nil {
+			return nil, err
+		}
+		if len(child.stats) > 0 || walk.filter == nil {
+			children = append(children, child)
+		}
+	}
+
+	immediateChildStats, _ = combineAggregateStats(immediateChildStats)
+	summary := walk.filter.apply(t.Path, AggregatesFromAggregateStats(immediateChildStats))
+	if len(summary) > 0 {
+		children = append(children, &dirTree{stats: summary, Name: "*.*", Path: t.Path + "/*.*"})
+	}
+	return
+}
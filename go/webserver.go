@@ -1,8 +1,6 @@
 package treeserve
 
 import (
-	"bufio"
-	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -12,9 +10,8 @@ import (
 	"path/filepath"
 	"runtime"
 	"strconv"
-	"strings"
-	"time"
 
+	"github.com/bmatsuo/lmdb-go/lmdb"
 	"github.com/gorilla/handlers"
 )
 
@@ -22,25 +19,23 @@ import (
 const secondsInYear = 60 * 60 * 24 * 365
 const costPerTibYear = 150.0
 
-// The files are made using getent group and getent passwd
-// the maps use the files to map GID and UID to the names
-var userMap map[string]string
-var groupMap map[string]string
 var groupfile = "/home/sjc/testdata/g"
 var userfile = "/home/sjc/testdata/p"
 
 // recursive tree structure, non binary tree, data at each level
 type dirTree struct {
-	key       *Md5Key    // not output in json
-	ChildDirs []*dirTree `json:"child_dirs,omitempty"`
-	Data      webAggData `json:"data,omitempty"`
-	Name      string     `json:"name"`
-	Path      string     `json:"path"`
+	key            *Md5Key      // not output in json
+	stats          []Aggregates // not output in json, kept for arranging child_dirs
+	ChildDirs      []*dirTree   `json:"child_dirs,omitempty"`
+	TotalChildDirs int          `json:"total_child_dirs,omitempty"` // before limit, offset and collapse_below
+	Data           webAggData   `json:"data,omitempty"`
+	Name           string       `json:"name"`
+	Path           string       `json:"path"`
 }
 
 // v2 of the original C++ added this
 type fullTree struct {
-	Date string  `json:"date"`
+	Date string  `json:"date"` // when the input the tree was built from was made
 	Tree dirTree `json:"tree"`
 }
 
@@ -52,6 +47,9 @@ type webAggData struct {
 	Atime map[string]map[string]map[string]string `json:"atime"`
 	Mtime map[string]map[string]map[string]string `json:"mtime"`
 	Size  map[string]map[string]map[string]string `json:"size"`
+
+	Histograms map[string]map[string]map[string]*Histograms `json:"histograms,omitempty"`
+	Extremes   map[string]map[string]map[string]*Extremes   `json:"extremes,omitempty"`
 }
 
 // Aggregates is one set of cost values, which will apply to one set of categories
@@ -59,170 +57,101 @@ type Aggregates struct {
 	Group string `json:"group"`
 	User  string `json:"user"`
 	Tag   string `json:"tag"`
+	// values of the dimensions other than group, user and tag, as name=value;name=value
+	Dimensions string `json:"dimensions,omitempty"`
 
 	Size       *Bigint `json:"size"`
 	Count      *Bigint `json:"count"`
 	ChangeCost *Bigint `json:"ccost"`
 	AccessCost *Bigint `json:"acost"`
 	ModifyCost *Bigint `json:"mcost"`
+
+	Histograms *Histograms `json:"histograms,omitempty"`
+	Extremes   *Extremes   `json:"extremes,omitempty"`
 }
 
 //Webserver listens for requests of the form
 // xxxxx/maxdepth=1&path=/lustre/scratch115/projects
 // and returns nodes in json
-func (ts *TreeServe) Webserver(groupFile, userFile string) {
-	groupMap, userMap = buildUserGroupMaps(groupFile, userFile)
+// It returns once the server has been shut down and requests in progress have finished.
+func (ts *TreeServe) Webserver(groupFile, userFile string) (err error) {
+	ts.names.configure(append([]NameSource{{UserFile: userFile, GroupFile: groupFile}}, ts.NameSources...), ts.NameLookupOS)
+	go ts.watchNames(ts.webserverClosing)
+	ts.auth, err = ts.newAuthenticator()
+	if err != nil {
+		return
+	}
 
-	port := "8000"
-	http.HandleFunc("/", hello)
-	http.HandleFunc("/tree", ts.tree)
-	http.HandleFunc("/raw", ts.raw)
-	//http.ListenAndServe(":"+port, nil)
-	err := http.ListenAndServe("127.0.0.1:"+port, handlers.LoggingHandler(os.Stdout, http.DefaultServeMux))
+	mux := http.NewServeMux()
+	handle := func(route string, h http.HandlerFunc) {
+		mux.HandleFunc(route, ts.instrument(route, h))
+	}
+	handle("/", ts.hello)
+	handle(apiPrefix+"/", apiNotFound)
+	for _, prefix := range []string{apiPrefix, ""} {
+		handle(prefix+"/tree", ts.authenticated(ts.apiHandler(ts.cached(ts.tree)), false))
+		handle(prefix+"/raw", ts.authenticated(ts.apiHandler(ts.cached(ts.raw)), false))
+	}
+	handle(apiPrefix+"/top", ts.authenticated(ts.apiHandler(ts.cached(ts.top)), false))
+	handle(apiPrefix+"/extensions", ts.authenticated(ts.apiHandler(ts.cached(ts.extensions)), false))
+	handle(apiPrefix+"/quality", ts.authenticated(ts.apiHandler(ts.cached(ts.quality)), false))
+	handle(apiPrefix+"/chargeback", ts.authenticated(ts.apiHandler(ts.cached(ts.chargeback)), false))
+	handle(apiPrefix+"/quota", ts.authenticated(ts.apiHandler(ts.quota), false))
+	handle(apiPrefix+"/info", ts.authenticated(ts.apiHandler(ts.info), false))
+	handle("/admin/db", ts.authenticated(ts.apiHandler(ts.adminDB), true))
+	handle("/healthz", ts.healthz)
+	handle("/readyz", ts.holdLMDB(ts.readyz))
+	handle("/progress", ts.authenticated(ts.progressHandler, false))
+	handle("/metrics", ts.authenticated(ts.metricsHandler, true))
+	err = ts.serve(handlers.LoggingHandler(os.Stdout, ts.cors(mux)))
 
 	LogError(err)
-
-	logInfo("Webserver started")
-
+	return
 }
 
-func hello(w http.ResponseWriter, r *http.Request) {
-	io.WriteString(w, "Listening on port 8000")
+func (ts *TreeServe) hello(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "Listening "+ts.listenDescription())
 }
 
 // tree handles requests of the form <url>/api/v2?maxdepth=1&path=/lustre/scratch115/projects
-// and returns the data in json format, or a 404 error
-func (ts *TreeServe) tree(w http.ResponseWriter, r *http.Request) {
-
-	path, depth := queryParameters(r)
-
-	nodeKey := ts.getPathKey(path)
-
-	j := []byte{}
-
-	t, err := ts.buildTree(nodeKey, 0, depth)
-
-	if err == nil {
-		ft := fullTree{Date: time.Now().String(), Tree: t}
-		j, err = json.Marshal(ft)
+// and returns the data in json format, or an APIError
+func (ts *TreeServe) tree(w http.ResponseWriter, r *http.Request) *APIError {
 
+	path, depth, apiErr := queryParameters(r)
+	if apiErr != nil {
+		return apiErr
 	}
-	if err != nil {
 
-		LogError(err)
-
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(http.StatusNotFound)
-		io.WriteString(w, "Could not retrieve tree")
-
-	} else {
-		w.Header().Set("Content-Type", "application/json; charset=utf-8") // normal header
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.WriteHeader(http.StatusOK)
-
-		io.WriteString(w, string(j))
+	apiErr = ts.checkDepth(path, depth)
+	if apiErr != nil {
+		return apiErr
 	}
 
-}
-
-// buildTree does a recursive tree build passing in level and depth so it will stop appropriately
-// Returning a few levels from the chosen directory means that recursion is not too expensive here.
-func (ts *TreeServe) buildTree(rootKey *Md5Key, level int, depth int) (t dirTree, err error) {
-	logInfo(fmt.Sprintf("buildTree level %d depth %d", level, depth))
-
-	if level > depth {
-		return
+	filter, apiErr := ts.filterParameters(r, path)
+	if apiErr != nil {
+		return apiErr
 	}
 
-	temp, err := ts.GetTreeNode(rootKey)
-	if err != nil {
-		LogError(err)
-		return
+	arrangement, apiErr := arrangementParameters(r, path)
+	if apiErr != nil {
+		return apiErr
 	}
 
-	t = dirTree{key: rootKey}
-	t.Path = strings.TrimSuffix(temp.Name, "/")
-	_, file := filepath.Split(t.Path)
-	t.Name = file
-
-	stats, err := ts.retrieveAggregates(rootKey)
-	if err != nil {
-		return
-	}
-	if len(stats) == 0 {
-		logInfo(" Blank stats at " + t.Path)
+	format, apiErr := formatParameter(r, path)
+	if apiErr != nil {
+		return apiErr
 	}
 
-	a, err := organiseAggregates(stats)
-	if err != nil {
-		LogError(err)
-		return
-	}
-	t.Data = a
-
-	child, err := ts.children(rootKey)
-	if err != nil {
-		LogError(err)
-		return
+	nodeKey, apiErr := ts.visibleNodeKey(r, path)
+	if apiErr != nil {
+		return apiErr
 	}
 
-	// the tree of local file data *.*
-	immediateChildStats := []*AggregateStats{}
-	// include this directory
-	aa, err := ts.CalculateAggregateStats(rootKey)
-	LogError(err)
-	immediateChildStats = append(immediateChildStats, aa)
-
-	// recursion and build file summary
-	for j := range child {
-		temp, err := ts.GetTreeNode(child[j])
-		LogError(err)
-
-		if temp.Stats.FileType != 'f' {
-
-			t2, err := ts.buildTree(child[j], level+1, depth) /// recursion ...make next level tree for each child
-			if err != nil {
-				LogError(err)
-			}
-			if t2.Path != "" {
-				t.addChild(&t2)
-			}
-
-		} else {
-			// collect files for the *.*, and not at lowest level
-			if level < depth {
-				a, err := ts.CalculateAggregateStats(child[j])
-				LogError(err)
-				immediateChildStats = append(immediateChildStats, a)
-			}
-		}
-
-	}
-	if level < depth { // only files in the *.*, and not at lowest level
-		immediateChildStats, _ = combineAggregateStats(immediateChildStats)
-		summaryTree, ok := getSummaryTree(t.Path, immediateChildStats)
-		if ok {
-			t.addChild(&summaryTree)
-		}
+	if format != formatNested {
+		return ts.writeFlatTree(w, nodeKey, path, depth, filter, arrangement, format)
 	}
 
-	return
-}
-
-// getSummaryTree makes an entry with path *.* that contains stats for the node itself and it's children.
-// No *.* is added for empty directories
-func getSummaryTree(path string, imm []*AggregateStats) (t dirTree, ok bool) {
-	ok = true
-	agg := AggregatesFromAggregateStats(imm)
-	if len(agg) > 0 { // don't add *.* if the directory has no contents
-		w, err := organiseAggregates(agg)
-		LogError(err)
-		t = dirTree{Name: "*.*", Path: path + "/*.*", Data: w}
-	} else {
-		ok = false
-	}
-
-	return
+	return ts.writeNestedTree(w, nodeKey, path, depth, filter, arrangement)
 }
 
 // build up the set of stats of grandchildren of a node by appending the data for children of a child
@@ -254,7 +183,7 @@ a.Count[g][u][t] = 6
 a.Size[g][u][t] = 7
 // but can't add to an empty map so work out which map levels exist
 */
-func organiseAggregates(stats []Aggregates) (a webAggData, err error) {
+func (ts *TreeServe) organiseAggregates(path string, stats []Aggregates) (a webAggData, err error) {
 
 	errorCount := 0
 	for i := range stats {
@@ -269,9 +198,9 @@ func organiseAggregates(stats []Aggregates) (a webAggData, err error) {
 			continue // don't add empty sets of aggregates
 		}
 
-		g := lookupGID(statsItem.Group)
-		u := lookupUID(statsItem.User)
-		tag := statsItem.Tag
+		g := ts.lookupGID(path, statsItem.Group)
+		u := ts.lookupUID(path, statsItem.User)
+		tag := statsItem.tagKey()
 
 		//Access Cost
 		b := statsItem.AccessCost
@@ -294,6 +223,32 @@ func organiseAggregates(stats []Aggregates) (a webAggData, err error) {
 		//fmt.Println("Adding:", b.Text(10), g, u, tag)
 		updateMap(false, &a.Count, b, g, u, tag)
 
+		if statsItem.Histograms != nil {
+			if a.Histograms == nil {
+				a.Histograms = make(map[string]map[string]map[string]*Histograms)
+			}
+			if a.Histograms[g] == nil {
+				a.Histograms[g] = make(map[string]map[string]*Histograms)
+			}
+			if a.Histograms[g][u] == nil {
+				a.Histograms[g][u] = make(map[string]*Histograms)
+			}
+			a.Histograms[g][u][tag] = statsItem.Histograms
+		}
+
+		if statsItem.Extremes != nil {
+			if a.Extremes == nil {
+				a.Extremes = make(map[string]map[string]map[string]*Extremes)
+			}
+			if a.Extremes[g] == nil {
+				a.Extremes[g] = make(map[string]map[string]*Extremes)
+			}
+			if a.Extremes[g][u] == nil {
+				a.Extremes[g][u] = make(map[string]*Extremes)
+			}
+			a.Extremes[g][u][tag] = statsItem.Extremes
+		}
+
 	}
 
 	if errorCount > 0 {
@@ -304,14 +259,9 @@ func organiseAggregates(stats []Aggregates) (a webAggData, err error) {
 
 //--------------------------------------------------------------
 
-// addChild adds a child dirTree to a dirTree
-func (t *dirTree) addChild(child *dirTree) {
-	t.ChildDirs = append(t.ChildDirs, child)
-}
-
 // get path and depth from request, or use defaults
 // /lustre/scratch115/realdata/mdt0 is an example
-func queryParameters(r *http.Request) (path string, depth int) {
+func queryParameters(r *http.Request) (path string, depth int, apiErr *APIError) {
 	url := r.URL
 	vals := url.Query()
 
@@ -323,12 +273,20 @@ func queryParameters(r *http.Request) (path string, depth int) {
 	if val, ok := vals["path"]; ok {
 		path = val[0]
 	}
+	path = filepath.Clean(path)
+	if !filepath.IsAbs(path) {
+		apiErr = badRequest(path, "path must be absolute")
+		return
+	}
+
 	if val, ok := vals["depth"]; ok {
 		depth, err = strconv.Atoi(val[0])
-		LogError(err)
+		if err != nil || depth < 0 {
+			apiErr = badRequest(path, "depth must be a whole number, not %q", val[0])
+			return
+		}
 	}
 
-	path = filepath.Clean(path)
 	return
 
 }
@@ -417,6 +375,7 @@ func (ts *TreeServe) retrieveAggregates(nodekey *Md5Key) (data []Aggregates, err
 		ag.Group = vals.(*StatMapping).Group
 		ag.User = vals.(*StatMapping).User
 		ag.Tag = vals.(*StatMapping).Tag
+		ag.Dimensions = vals.(*StatMapping).Dimensions
 
 		temp, err := ts.AggregateSizeDB.Get(x)
 		LogError(err)
@@ -440,6 +399,21 @@ func (ts *TreeServe) retrieveAggregates(nodekey *Md5Key) (data []Aggregates, err
 		temp, err = ts.AggregateCreateCostDB.Get(x)
 		LogError(err)
 		ag.ChangeCost = temp.(*Bigint)
+
+		// files have no histograms or extremes
+		temp, err = ts.AggregateHistogramsDB.Get(x)
+		if err == nil {
+			ag.Histograms = temp.(*Histograms)
+		} else if !lmdb.IsNotFound(err) {
+			LogError(err)
+		}
+
+		temp, err = ts.AggregateExtremesDB.Get(x)
+		if err == nil {
+			ag.Extremes = temp.(*Extremes)
+		} else if !lmdb.IsNotFound(err) {
+			LogError(err)
+		}
 		data = append(data, ag)
 
 	}
@@ -506,6 +480,11 @@ func addAggregates(a, b Aggregates) (c Aggregates, err error) {
 	} else {
 		c.Tag = a.Tag
 	}
+	if a.Dimensions != b.Dimensions {
+		err = fmt.Errorf("addAggregates ... dimensions don't match (%s, %s)", a.Dimensions, b.Dimensions)
+	} else {
+		c.Dimensions = a.Dimensions
+	}
 
 	temp := NewBigint()
 
@@ -527,6 +506,9 @@ func addAggregates(a, b Aggregates) (c Aggregates, err error) {
 	temp5 := NewBigint()
 	temp5.Add(a.ModifyCost, b.ModifyCost)
 	c.ModifyCost = temp5
+
+	c.Histograms = sumHistograms(a.Histograms, b.Histograms)
+	c.Extremes = mergeExtremes(a.Extremes, b.Extremes)
 	return
 
 }
@@ -635,66 +617,14 @@ func subtractAggregateMap(parent, child map[string]Aggregates) (out map[string]A
 	return
 }*/
 
-// buildMap builds a map from a file where each line in the file has two fields among others in a string separated by another string
-// at known positions (general for building user and group maps from linux getent data)
-// Format several fields, colon separated, groupname or username first, groupid or userid third
-// Used to get group and user names from ids using the getent format from group and passwd name:x:id:
-func buildMap(inputfile string, sep string, posKey, posValue int) (theMap map[string]string) {
-	theMap = make(map[string]string)
-	// open the file
-	if file, err := os.Open(inputfile); err == nil {
-
-		// make sure it gets closed
-		defer file.Close()
-
-		// create a new scanner and read the file line by line
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			a := strings.Split(scanner.Text(), sep)
-			if len(a) > max(posKey, posValue) {
-				theMap[a[2]] = a[0]
-			}
-		}
-
-		if err = scanner.Err(); err != nil {
-			LogError(err)
-		}
-
-	} else {
-		// if the file is not found, log it but not a disaster
-		LogError(err)
-	}
-	return
-}
-
-// get the group name from the map if it exists
-func lookupGID(id string) (val string) {
-	var ok bool
-	if val, ok = groupMap[id]; !ok {
-
-		val = id
-	}
-
-	return
+// get the name of a group in the tree at path if it is known
+func (ts *TreeServe) lookupGID(path string, id string) (val string) {
+	return ts.names.groupName(path, id)
 }
 
-// get the user name from the map if it exists
-func lookupUID(id string) (val string) {
-	var ok bool
-	if val, ok = userMap[id]; !ok {
-
-		val = id
-	}
-
-	return
-}
-
-// max returns max of two ints
-func max(x, y int) int {
-	if x > y {
-		return x
-	}
-	return y
+// get the name of a user in the tree at path if it is known
+func (ts *TreeServe) lookupUID(path string, id string) (val string) {
+	return ts.names.userName(path, id)
 }
 
 // to compare two floats allowing for size and rounding errors
@@ -722,12 +652,15 @@ func AggregatesFromAggregateStats(a []*AggregateStats) (b []Aggregates) {
 		nextACost := a[i].AccessCost
 		nextCCost := a[i].CreateCost
 		nextMCost := a[i].ModifyCost
+		nextHistograms := a[i].Histograms
+		nextExtremes := a[i].Extremes
 		for j := range statMappings {
 			nextGroup := statMappings[j].Group
 			nextUser := statMappings[j].User
 			nextTag := statMappings[j].Tag
+			nextDimensions := statMappings[j].Dimensions
 
-			nextEntry := Aggregates{Group: nextGroup, User: nextUser, Tag: nextTag, Count: nextCount, Size: nextSize, AccessCost: nextACost, ModifyCost: nextMCost, ChangeCost: nextCCost}
+			nextEntry := Aggregates{Group: nextGroup, User: nextUser, Tag: nextTag, Dimensions: nextDimensions, Count: nextCount, Size: nextSize, AccessCost: nextACost, ModifyCost: nextMCost, ChangeCost: nextCCost, Histograms: nextHistograms, Extremes: nextExtremes}
 			b = append(b, nextEntry)
 		}
 	}
@@ -735,17 +668,3 @@ func AggregatesFromAggregateStats(a []*AggregateStats) (b []Aggregates) {
 	return
 
 }
-
-// use the files of local groups and users, built in the startup shell script to translate codes to names
-// if file not found, map is empty and webserver uses codes not names
-func buildUserGroupMaps(groupFile string, userFile string) (groups map[string]string, users map[string]string) {
-
-	userCodePos := 2
-	userNamePos := 0
-	groupCodePos := 2
-	groupNamePos := 0
-	users = buildMap(userFile, ":", userCodePos, userNamePos)
-	groups = buildMap(groupFile, ":", groupCodePos, groupNamePos)
-
-	return
-}
@@ -3,8 +3,6 @@ package treeserve
 import (
 	"encoding/json"
 	"fmt"
-	"io"
-	"os"
 	"testing"
 )
 
@@ -63,7 +61,8 @@ func TestOrganiseAggregates(t *testing.T) {
 	b := Aggregates{Group: "xx", User: "yy", Tag: "zz", Count: b2, Size: b2, AccessCost: b2, ModifyCost: b1, ChangeCost: b1}
 	f := Aggregates{Group: "xx", User: "yy", Tag: "aa", Count: b2, Size: b2, AccessCost: b2, ModifyCost: b1, ChangeCost: b1}
 
-	m, err := organiseAggregates([]Aggregates{a, b, f})
+	ts := NewTreeServe("", 0, 0, 0, 0, 0, 0, false)
+	m, err := ts.organiseAggregates("", []Aggregates{a, b, f})
 	if err != nil {
 		t.Errorf(err.Error())
 	}
@@ -100,64 +99,18 @@ func TestAddAggregates(t *testing.T) {
 
 }
 
-func TestBuildMap(t *testing.T) {
-
-	//write the file
-	filename := "/tmp/temp"
-	testdata := []string{"sjc:x:1000:", "postfix:x:133:", "postdrop:x:134:", "docker:x:999:"}
-
-	fo, err := os.Create(filename)
-	if err != nil {
-		t.Errorf(err.Error())
-	}
-	defer fo.Close()
-
-	for i := range testdata {
-		s := testdata[i] + "\n"
-		_, err = io.WriteString(fo, s)
-		if err != nil {
-			t.Errorf(err.Error())
-		}
-	}
-
-	fo.Close()
-
-	// make the map ... what we are testing
-	m := buildMap(filename, ":", 2, 0)
-
-	for k, v := range m {
-		fmt.Println(k, v)
-	}
-
-	// check shoudl exist
-	if val, ok := m["133"]; ok {
-		if val != "postfix" {
-			t.Errorf("Got %s, wanted %s", val, "postfix")
-		}
-	} else {
-		t.Errorf("Got no entry, wanted %s", "postfix")
-	}
-	// check shoudl not exist
-	if val, ok := m["10"]; ok {
-
-		t.Errorf("Got %s, wanted no value", val)
-
-	}
-
-}
-
 func TestLookUpUID(t *testing.T) {
-	userMap = buildMap("/home/sjc/testdata/p", ":", 2, 0)
-	groupMap = buildMap("/home/sjc/testdata/g", ":", 2, 0)
-	fmt.Println(lookupUID("*"))
-	fmt.Println(lookupUID("0"))
+	ts := NewTreeServe("", 0, 0, 0, 0, 0, 0, false)
+	ts.names.configure([]NameSource{{UserFile: "/home/sjc/testdata/p", GroupFile: "/home/sjc/testdata/g"}}, false)
+	fmt.Println(ts.lookupUID("", "*"))
+	fmt.Println(ts.lookupUID("", "0"))
 }
 
 func TestLookUpGID(t *testing.T) {
-	userMap = buildMap("/home/sjc/testdata/p", ":", 2, 0)
-	groupMap = buildMap("/home/sjc/testdata/g", ":", 2, 0)
-	fmt.Println(lookupGID("*"))
-	fmt.Println(lookupGID("0"))
+	ts := NewTreeServe("", 0, 0, 0, 0, 0, 0, false)
+	ts.names.configure([]NameSource{{UserFile: "/home/sjc/testdata/p", GroupFile: "/home/sjc/testdata/g"}}, false)
+	fmt.Println(ts.lookupGID("", "*"))
+	fmt.Println(ts.lookupGID("", "0"))
 }
 
 /*